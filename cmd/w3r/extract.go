@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs-shipyard/w3rc"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+// extractPath writes the UnixFS file or directory at path under root to dir.
+// A directory is written as dir itself, and a file within dir, named after
+// the last segment of the path, or else the cid.
+func extractPath(ctx context.Context, w3s w3rc.Session, root cid.Cid, path datamodel.Path, dir string) error {
+	c, name := root, root.String()
+	if path.Len() > 0 {
+		parent, last := path.Pop(), path.Last().String()
+		n, err := w3s.GetPath(ctx, root, parent.String(), w3rc.ScopeEntity)
+		if err != nil {
+			return err
+		}
+		if c, err = entryCid(n, last); err != nil {
+			return err
+		}
+		if !validName(last) {
+			return fmt.Errorf("cannot extract to invalid name %q", last)
+		}
+		name = last
+	}
+
+	// the whole dag is fetched at once, so that extracting it reads only
+	// local blocks.
+	if _, err := w3s.Get(ctx, c, selectorparse.CommonSelector_MatchAllRecursively); err != nil {
+		return err
+	}
+	ud, err := unixfsData(ctx, w3s, c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// dir is the user's to place, even behind a symlink; nothing under it is.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return err
+	}
+	target := dir
+	if ud == nil || !isDir(ud) {
+		target = filepath.Join(dir, name)
+	}
+	ex := &extractor{w3s: w3s}
+	if err := ex.extract(ctx, c, target); err != nil {
+		return err
+	}
+	return ex.finish()
+}
+
+// An extractor writes a UnixFS dag to disk. Entries are never written through
+// or over anything already there, and symlinks are only created once all else
+// is written, so that no entry is written through one.
+type extractor struct {
+	w3s w3rc.Session
+	// symlinks are created by finish.
+	symlinks []symlink
+	// dirModes are applied by finish, after the entries of each directory.
+	dirModes []dirMode
+}
+
+type symlink struct {
+	target, path string
+}
+
+type dirMode struct {
+	path string
+	ud   data.UnixFSData
+}
+
+// extract writes the UnixFS node at c to target. File data is copied out as
+// its blocks arrive, so the dag is never held whole.
+func (ex *extractor) extract(ctx context.Context, c cid.Cid, target string) error {
+	ud, err := unixfsData(ctx, ex.w3s, c)
+	if err != nil {
+		return err
+	}
+	if ud == nil {
+		// a raw block is a file of its own.
+		return ex.extractFile(ctx, c, target, nil)
+	}
+
+	switch ud.FieldDataType().Int() {
+	case data.Data_File, data.Data_Raw:
+		return ex.extractFile(ctx, c, target, ud)
+	case data.Data_Symlink:
+		if !ud.FieldData().Exists() {
+			return fmt.Errorf("symlink %s has no target", c)
+		}
+		ex.symlinks = append(ex.symlinks, symlink{string(ud.FieldData().Must().Bytes()), target})
+		return nil
+	case data.Data_Directory, data.Data_HAMTShard:
+		return ex.extractDir(ctx, c, target, ud)
+	default:
+		return fmt.Errorf("cannot extract %s: unsupported unixfs type %d", c, ud.FieldDataType().Int())
+	}
+}
+
+func (ex *extractor) extractFile(ctx context.Context, c cid.Cid, target string, ud data.UnixFSData) error {
+	rs, err := ex.w3s.GetRange(ctx, c, "", 0, 0)
+	if err != nil {
+		return err
+	}
+	// O_EXCL fails on anything at target, symlinks included.
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return setMode(target, ud)
+}
+
+func (ex *extractor) extractDir(ctx context.Context, c cid.Cid, target string, ud data.UnixFSData) error {
+	// the whole directory is listed before any entry is fetched, sharded or not.
+	n, err := ex.w3s.GetPath(ctx, c, "", w3rc.ScopeEntity)
+	if err != nil {
+		return err
+	}
+	if err := makeDir(target); err != nil {
+		return err
+	}
+	itr := n.MapIterator()
+	if itr == nil {
+		return fmt.Errorf("cannot list directory %s", c)
+	}
+	seen := make(map[string]bool)
+	for !itr.Done() {
+		k, v, err := itr.Next()
+		if err != nil {
+			return err
+		}
+		name, err := k.AsString()
+		if err != nil {
+			return err
+		}
+		if !validName(name) {
+			return fmt.Errorf("directory %s has an invalid entry name %q", c, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("directory %s has more than one entry named %q", c, name)
+		}
+		seen[name] = true
+		child, err := linkCid(v)
+		if err != nil {
+			return err
+		}
+		if err := ex.extract(ctx, child, filepath.Join(target, name)); err != nil {
+			return err
+		}
+	}
+	ex.dirModes = append(ex.dirModes, dirMode{target, ud})
+	return nil
+}
+
+// finish creates the symlinks, then sets the modes of directories, deepest
+// first, in case they do not allow writing entries.
+func (ex *extractor) finish() error {
+	for _, l := range ex.symlinks {
+		if err := os.Symlink(l.target, l.path); err != nil {
+			return err
+		}
+	}
+	for _, d := range ex.dirModes {
+		if err := setMode(d.path, d.ud); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeDir creates a directory at target, or uses the directory already there,
+// but not a symlink or anything else that would be written through or over.
+func makeDir(target string) error {
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return os.Mkdir(target, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("cannot extract directory to %s: it exists and is not a directory", target)
+	}
+	return nil
+}
+
+// unixfsData fetches the block at c and decodes its UnixFS data, which is nil
+// for raw blocks.
+func unixfsData(ctx context.Context, w3s w3rc.Session, c cid.Cid) (data.UnixFSData, error) {
+	n, err := w3s.Get(ctx, c, nil)
+	if err != nil {
+		return nil, err
+	}
+	if n.Kind() == datamodel.Kind_Bytes {
+		return nil, nil
+	}
+	d, err := n.LookupByString("Data")
+	if err != nil {
+		return nil, fmt.Errorf("%s is not unixfs: %w", c, err)
+	}
+	b, err := d.AsBytes()
+	if err != nil {
+		return nil, err
+	}
+	return data.DecodeUnixFSData(b)
+}
+
+func isDir(ud data.UnixFSData) bool {
+	t := ud.FieldDataType().Int()
+	return t == data.Data_Directory || t == data.Data_HAMTShard
+}
+
+func entryCid(dir datamodel.Node, name string) (cid.Cid, error) {
+	v, err := dir.LookupByString(name)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return linkCid(v)
+}
+
+func linkCid(n datamodel.Node) (cid.Cid, error) {
+	lnk, err := n.AsLink()
+	if err != nil {
+		return cid.Undef, err
+	}
+	cl, ok := lnk.(cidlink.Link)
+	if !ok {
+		return cid.Undef, fmt.Errorf("unsupported link %s", lnk)
+	}
+	return cl.Cid, nil
+}
+
+// validName is whether a directory entry can be written without leaving the
+// directory.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`) && !strings.ContainsRune(name, 0)
+}
+
+// setMode applies the permissions of a UnixFS node, where it has any.
+func setMode(target string, ud data.UnixFSData) error {
+	if ud == nil || !ud.FieldMode().Exists() {
+		return nil
+	}
+	return os.Chmod(target, os.FileMode(ud.FieldMode().Must().Int())&os.ModePerm)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs-shipyard/w3rc"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	"github.com/ipfs/go-unixfsnode/file"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/multiformats/go-multicodec"
+)
+
+var dagpbProto = cidlink.LinkPrototype{Prefix: cid.Prefix{
+	Version:  1,
+	Codec:    uint64(multicodec.DagPb),
+	MhType:   uint64(multicodec.Sha2_256),
+	MhLength: -1,
+}}
+
+// localSession serves dags already in its link system, as a session does
+// once it has fetched them.
+type localSession struct {
+	w3rc.Session
+	ls ipld.LinkSystem
+}
+
+func newLocalSession() *localSession {
+	ls := cidlink.DefaultLinkSystem()
+	store := &memstore.Store{}
+	ls.SetReadStorage(store)
+	ls.SetWriteStorage(store)
+	return &localSession{ls: ls}
+}
+
+func (s *localSession) Get(ctx context.Context, c cid.Cid, _ datamodel.Node) (ipld.Node, error) {
+	lnk := cidlink.Link{Cid: c}
+	lc := ipld.LinkContext{Ctx: ctx}
+	np, err := dagpb.AddSupportToChooser(basicnode.Chooser)(lnk, lc)
+	if err != nil {
+		return nil, err
+	}
+	return s.ls.Load(lc, lnk, np)
+}
+
+func (s *localSession) GetPath(ctx context.Context, c cid.Cid, _ string, _ w3rc.Scope) (ipld.Node, error) {
+	n, err := s.Get(ctx, c, nil)
+	if err != nil {
+		return nil, err
+	}
+	return unixfsnode.Reify(ipld.LinkContext{Ctx: ctx}, n, &s.ls)
+}
+
+func (s *localSession) GetRange(ctx context.Context, c cid.Cid, _ string, _, _ int64) (io.ReadSeeker, error) {
+	n, err := s.GetPath(ctx, c, "", w3rc.ScopeAll)
+	if err != nil {
+		return nil, err
+	}
+	if lbn, ok := n.(file.LargeBytesNode); ok {
+		return lbn.AsLargeBytes()
+	}
+	b, err := n.AsBytes()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+// store stores a UnixFS node built by fn, linking to entries.
+func (s *localSession) store(t *testing.T, fn func(*builder.Builder), entries ...dagpb.PBLink) ipld.Link {
+	ud, err := builder.BuildUnixFS(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := qp.BuildMap(dagpb.Type.PBNode, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "Links", qp.List(int64(len(entries)), func(la datamodel.ListAssembler) {
+			for _, e := range entries {
+				qp.ListEntry(la, qp.Node(e))
+			}
+		}))
+		qp.MapEntry(ma, "Data", qp.Bytes(data.EncodeUnixFSData(ud)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnk, err := s.ls.Store(ipld.LinkContext{}, dagpbProto, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lnk
+}
+
+func (s *localSession) dir(t *testing.T, mode int, entries ...dagpb.PBLink) ipld.Link {
+	return s.store(t, func(b *builder.Builder) {
+		builder.DataType(b, data.Data_Directory)
+		if mode >= 0 {
+			builder.Permissions(b, mode)
+		}
+	}, entries...)
+}
+
+func (s *localSession) file(t *testing.T, content string, mode int) ipld.Link {
+	return s.store(t, func(b *builder.Builder) {
+		builder.DataType(b, data.Data_File)
+		builder.Data(b, []byte(content))
+		builder.FileSize(b, uint64(len(content)))
+		if mode >= 0 {
+			builder.Permissions(b, mode)
+		}
+	})
+}
+
+func (s *localSession) symlink(t *testing.T, target string) ipld.Link {
+	lnk, _, err := builder.BuildUnixFSSymlink(target, &s.ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lnk
+}
+
+func entry(t *testing.T, name string, lnk ipld.Link) dagpb.PBLink {
+	e, err := builder.BuildUnixFSDirectoryEntry(name, 0, lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func linkCidOf(lnk ipld.Link) cid.Cid {
+	return lnk.(cidlink.Link).Cid
+}
+
+func TestValidName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"file.txt": true,
+		".hidden":  true,
+		"..dots":   true,
+		"":         false,
+		".":        false,
+		"..":       false,
+		"a/b":      false,
+		`a\b`:      false,
+		"a\x00b":   false,
+	} {
+		if got := validName(name); got != want {
+			t.Errorf("validName(%q) = %t, expected %t", name, got, want)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	sess := newLocalSession()
+	sub := sess.dir(t, 0500, entry(t, "b.txt", sess.file(t, "hello", 0600)))
+	plain, _, err := builder.BuildUnixFSFile(strings.NewReader("plain"), "", &sess.ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := sess.dir(t, -1,
+		entry(t, "a.txt", plain),
+		entry(t, "link", sess.symlink(t, "../outside")),
+		entry(t, "sub", sub),
+	)
+
+	out := t.TempDir()
+	// the read only directory is made writable again to be cleaned up.
+	t.Cleanup(func() { os.Chmod(filepath.Join(out, "sub"), 0755) })
+	if err := extractPath(context.Background(), sess, linkCidOf(root), datamodel.Path{}, out); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"a.txt": "plain", "sub/b.txt": "hello"} {
+		got, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil || string(got) != want {
+			t.Fatalf("%s: expected %q, got %q (%v)", name, want, got, err)
+		}
+	}
+	for name, want := range map[string]os.FileMode{"sub": 0500, "sub/b.txt": 0600, "a.txt": 0644} {
+		fi, err := os.Lstat(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != want {
+			t.Fatalf("%s: expected mode %o, got %o", name, want, fi.Mode().Perm())
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(out, "link")); err != nil || target != "../outside" {
+		t.Fatalf("expected a symlink to ../outside, got %q (%v)", target, err)
+	}
+}
+
+func TestExtractStaysWithinTarget(t *testing.T) {
+	sess := newLocalSession()
+	sub := sess.dir(t, -1, entry(t, "b.txt", sess.file(t, "hello", -1)))
+
+	t.Run("ExistingSymlink", func(t *testing.T) {
+		out, elsewhere := t.TempDir(), t.TempDir()
+		if err := os.Symlink(elsewhere, filepath.Join(out, "sub")); err != nil {
+			t.Fatal(err)
+		}
+		root := sess.dir(t, -1, entry(t, "sub", sub))
+		if err := extractPath(context.Background(), sess, linkCidOf(root), datamodel.Path{}, out); err == nil {
+			t.Fatal("expected extracting through a symlink to fail")
+		}
+		assertEmpty(t, elsewhere)
+	})
+
+	t.Run("ExistingFile", func(t *testing.T) {
+		out := t.TempDir()
+		if err := os.WriteFile(filepath.Join(out, "sub"), []byte("mine"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		root := sess.dir(t, -1, entry(t, "sub", sub))
+		if err := extractPath(context.Background(), sess, linkCidOf(root), datamodel.Path{}, out); err == nil {
+			t.Fatal("expected extracting over a file to fail")
+		}
+		if got, _ := os.ReadFile(filepath.Join(out, "sub")); string(got) != "mine" {
+			t.Fatalf("expected the file to be left alone, got %q", got)
+		}
+	})
+
+	t.Run("DuplicateNames", func(t *testing.T) {
+		out, elsewhere := t.TempDir(), t.TempDir()
+		root := sess.dir(t, -1, entry(t, "sub", sess.symlink(t, elsewhere)), entry(t, "sub", sub))
+		if err := extractPath(context.Background(), sess, linkCidOf(root), datamodel.Path{}, out); err == nil {
+			t.Fatal("expected duplicate entries to fail")
+		}
+		assertEmpty(t, elsewhere)
+	})
+
+	t.Run("InvalidName", func(t *testing.T) {
+		out := t.TempDir()
+		root := sess.dir(t, -1, entry(t, "..", sub))
+		if err := extractPath(context.Background(), sess, linkCidOf(root), datamodel.Path{}, filepath.Join(out, "inner")); err == nil {
+			t.Fatal("expected an invalid entry name to fail")
+		}
+		if _, err := os.Stat(filepath.Join(out, "b.txt")); !os.IsNotExist(err) {
+			t.Fatalf("expected nothing written outside the target, got %v", err)
+		}
+	})
+}
+
+func assertEmpty(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected nothing written to %s, got %d entries", dir, len(entries))
+	}
+}
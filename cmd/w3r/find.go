@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/filecoin-project/index-provider/metadata"
+	"github.com/ipfs-shipyard/w3rc"
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/urfave/cli/v2"
+)
+
+// Find prints the routing records found for a CID, as a retrieval would see
+// them, without retrieving it.
+func Find(c *cli.Context) error {
+	if c.Bool("verbose") {
+		log.SetLogLevel("*", "debug")
+	}
+	if c.NArg() < 1 {
+		return fmt.Errorf("must provide a CID to find")
+	}
+	root, err := cid.Decode(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	opts, err := routingOptions(c)
+	if err != nil {
+		return err
+	}
+	router, err := w3rc.NewRouter(opts...)
+	if err != nil {
+		return err
+	}
+
+	found := 0
+	for rec := range router.FindProviders(c.Context, root) {
+		if rec.Protocol() != contentrouting.RoutingErrorProtocol {
+			found++
+		}
+		if c.Bool("json") {
+			err = printRecordJSON(c.App.Writer, rec)
+		} else {
+			err = printRecord(c.App.Writer, rec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if found == 0 {
+		return w3rc.ErrNoProvider
+	}
+	return nil
+}
+
+// findRecord is the JSON form of a routing record.
+type findRecord struct {
+	Provider interface{} `json:",omitempty"`
+	Protocol string      `json:",omitempty"`
+	Metadata interface{} `json:",omitempty"`
+	Error    string      `json:",omitempty"`
+}
+
+func printRecordJSON(w io.Writer, rec contentrouting.RoutingRecord) error {
+	var fr findRecord
+	if rec.Protocol() == contentrouting.RoutingErrorProtocol {
+		fr.Error = fmt.Sprint(rec.Payload())
+	} else {
+		fr.Provider, fr.Protocol, fr.Metadata = rec.Provider(), rec.Protocol().String(), rec.Payload()
+		if b, ok := fr.Metadata.([]byte); ok && len(b) == 0 {
+			fr.Metadata = nil
+		}
+	}
+	return json.NewEncoder(w).Encode(fr)
+}
+
+// printRecord writes a record as the provider and transport, followed by
+// indented lines of its addresses and what is known from its metadata.
+func printRecord(w io.Writer, rec contentrouting.RoutingRecord) error {
+	if rec.Protocol() == contentrouting.RoutingErrorProtocol {
+		_, err := fmt.Fprintf(w, "error: %v\n", rec.Payload())
+		return err
+	}
+	var lines []string
+	provider := fmt.Sprint(rec.Provider())
+	if ai, ok := rec.Provider().(peer.AddrInfo); ok {
+		provider = ai.ID.String()
+		if ai.ID == "" {
+			provider = "(no peer id)"
+		}
+		for _, addr := range ai.Addrs {
+			lines = append(lines, addr.String())
+		}
+	}
+	if md := describeMetadata(rec.Payload()); md != "" {
+		lines = append(lines, md)
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", provider, rec.Protocol())
+	for _, l := range lines {
+		if err != nil {
+			break
+		}
+		_, err = fmt.Fprintf(w, "  %s\n", l)
+	}
+	return err
+}
+
+// describeMetadata summarizes the metadata of a record, which is empty where
+// there is nothing to tell.
+func describeMetadata(md interface{}) string {
+	switch m := md.(type) {
+	case *metadata.GraphsyncFilecoinV1:
+		parts := []string{"piece " + m.PieceCID.String()}
+		if m.VerifiedDeal {
+			parts = append(parts, "verified")
+		}
+		if m.FastRetrieval {
+			parts = append(parts, "fast retrieval")
+		}
+		return strings.Join(parts, ", ")
+	case *metadata.Bitswap, metadata.Bitswap, nil:
+		return ""
+	case []byte:
+		if len(m) == 0 {
+			return ""
+		}
+		return fmt.Sprintf("metadata %x", m)
+	default:
+		return fmt.Sprintf("metadata %v", m)
+	}
+}
@@ -2,15 +2,30 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/ipfs-shipyard/w3rc"
+	"github.com/ipfs-shipyard/w3rc/contentrouting/static"
+	"github.com/ipfs-shipyard/w3rc/namesys"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
 	"github.com/ipfs/go-log/v2"
+	"github.com/ipfs/go-unixfsnode"
 	"github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime/datamodel"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/storage/bsadapter"
 	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/urfave/cli/v2"
 )
@@ -24,21 +39,34 @@ func Get(c *cli.Context) error {
 	store := memstore.Store{}
 
 	if c.NArg() < 1 {
-		return fmt.Errorf("must provide a CID to fetch")
+		return fmt.Errorf("must provide a CID or path to fetch")
 	}
 
-	parsedCid, err := cid.Decode(c.Args().First())
+	// paths are resolved up front, as the output file is opened with the root.
+	resolver, err := namesys.NewResolver(c.String("ipns-endpoint"))
+	if err != nil {
+		return err
+	}
+	parsedCid, rest, err := namesys.ResolvePath(c.Context, resolver, c.Args().First())
 	if err != nil {
 		return err
 	}
 
 	selectorSpec := selectorparse.CommonSelector_MatchPoint
+	scope := w3rc.ScopeBlock
 	if c.Bool("recursive") {
 		selectorSpec = selectorparse.CommonSelector_MatchAllRecursively
+		scope = w3rc.ScopeAll
+	}
+	if rest.Len() > 0 {
+		selectorSpec = unixfsPathSelector(rest, c.Bool("recursive"))
 	}
 
 	ls := cidlink.DefaultLinkSystem()
-	if c.IsSet("file") {
+	unixfsnode.AddUnixFSReificationToLinkSystem(&ls)
+	// a range is written out as is, rather than as a car file.
+	switch {
+	case c.IsSet("file") && !c.IsSet("range"):
 		bs, err := blockstore.OpenReadWrite(c.String("file"), []cid.Cid{parsedCid})
 		if err != nil {
 			return err
@@ -47,13 +75,39 @@ func Get(c *cli.Context) error {
 		ls.SetReadStorage(&bsa)
 		ls.SetWriteStorage(&bsa)
 		defer bs.Finalize()
-	} else {
+	case c.IsSet("extract"):
+		// blocks go to a scratch car file, so a large dag is not held in memory.
+		tmp, err := os.MkdirTemp("", "w3r-extract")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		bs, err := blockstore.OpenReadWrite(filepath.Join(tmp, "blocks.car"), []cid.Cid{parsedCid})
+		if err != nil {
+			return err
+		}
+		bsa := bsadapter.Adapter{Wrapped: bs}
+		ls.SetReadStorage(&bsa)
+		ls.SetWriteStorage(&bsa)
+		defer bs.Discard()
+	default:
 		ls.SetReadStorage(&store)
 		ls.SetWriteStorage(&store)
 	}
 
-	opts := []w3rc.Option{}
-	opts = append(opts, w3rc.WithIndexer(c.String("indexer")))
+	opts, err := routingOptions(c)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, w3rc.WithResolver(resolver))
+	if c.IsSet("cache-dir") {
+		ds, err := openCacheDir(c.String("cache-dir"))
+		if err != nil {
+			return err
+		}
+		defer ds.Close()
+		opts = append(opts, w3rc.WithDS(ds), w3rc.WithPersistentRoutingCache())
+	}
 	w3s, err := w3rc.NewSession(ls, opts...)
 	if err != nil {
 		return err
@@ -61,14 +115,27 @@ func Get(c *cli.Context) error {
 	if w3s == nil {
 		return fmt.Errorf("failed to create session")
 	}
-	if _, err = w3s.Get(c.Context, parsedCid, selectorSpec); err != nil {
+	defer w3s.Close()
+	if c.IsSet("range") {
+		return getRange(c, w3s, parsedCid, rest)
+	}
+	if c.IsSet("extract") {
+		return extractPath(c.Context, w3s, parsedCid, rest, c.String("extract"))
+	}
+	if rest.Len() > 0 {
+		_, err = w3s.GetPath(c.Context, parsedCid, rest.String(), scope)
+	} else {
+		_, err = w3s.Get(c.Context, parsedCid, selectorSpec)
+	}
+	if err != nil {
 		return err
 	}
 
 	// print
 	if !c.IsSet("file") {
 		outStream := c.App.Writer
-		_, err := car.TraverseV1(c.Context, &ls, parsedCid, selectorSpec, outStream)
+		_, err := car.TraverseV1(c.Context, &ls, parsedCid, selectorSpec, outStream,
+			car.WithTraversalPrototypeChooser(dagpb.AddSupportToChooser(basicnode.Chooser)))
 		if err != nil {
 			return err
 		}
@@ -76,3 +143,106 @@ func Get(c *cli.Context) error {
 
 	return nil
 }
+
+// routingOptions configures content routing from the indexer, routes and
+// private flags.
+func routingOptions(c *cli.Context) ([]w3rc.Option, error) {
+	var opts []w3rc.Option
+	if c.IsSet("routes") {
+		r, err := static.Load(c.String("routes"))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, w3rc.WithRouter(r))
+	}
+	// a routing table alone is enough, as for a private cluster.
+	if c.IsSet("indexer") || !c.IsSet("routes") {
+		opts = append(opts, w3rc.WithIndexer(c.String("indexer")))
+	}
+	if c.Bool("private") {
+		opts = append(opts, w3rc.WithReaderPrivacy())
+	}
+	return opts, nil
+}
+
+// getRange writes the bytes of the UnixFS file at path under root in the range
+// given, fetching only the blocks holding them.
+func getRange(c *cli.Context, w3s w3rc.Session, root cid.Cid, path datamodel.Path) error {
+	start, end, err := parseRange(c.String("range"))
+	if err != nil {
+		return err
+	}
+	rs, err := w3s.GetRange(c.Context, root, path.String(), start, end)
+	if err != nil {
+		return err
+	}
+	var src io.Reader = rs
+	if end >= 0 {
+		src = io.LimitReader(rs, end-start)
+	}
+
+	out := c.App.Writer
+	if c.IsSet("file") {
+		f, err := os.Create(c.String("file"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	_, err = io.Copy(out, src)
+	return err
+}
+
+// parseRange reads a range given as start-end, with end inclusive as in HTTP
+// range requests, or as start- for the rest of the file. The end returned is
+// exclusive, or -1 for the end of the file.
+func parseRange(r string) (int64, int64, error) {
+	parts := strings.SplitN(r, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %q", r)
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", r)
+	}
+	if parts[1] == "" {
+		return start, -1, nil
+	}
+	last, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || last < start {
+		return 0, 0, fmt.Errorf("invalid range %q", r)
+	}
+	return start, last + 1, nil
+}
+
+// unixfsPathSelector selects the blocks along a UnixFS path, and those of the
+// dag at its end if recursive.
+func unixfsPathSelector(path datamodel.Path, recursive bool) datamodel.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.Matcher()
+	if recursive {
+		sel = ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+	}
+	segs := path.Segments()
+	for i := len(segs) - 1; i >= 0; i-- {
+		next, field := sel, segs[i].String()
+		sel = ssb.ExploreInterpretAs("unixfs", ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert(field, next)
+		}))
+	}
+	return sel.Node()
+}
+
+// openCacheDir opens a leveldb datastore kept under dir, to be closed once
+// done with.
+func openCacheDir(dir string) (datastore.Batching, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ds, err := leveldb.NewDatastore(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
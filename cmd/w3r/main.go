@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 
+	"github.com/ipfs-shipyard/w3rc/namesys"
 	"github.com/urfave/cli/v2"
 )
 
@@ -16,7 +17,7 @@ func main1() int {
 		Commands: []*cli.Command{
 			{
 				Name:    "get",
-				Usage:   "Get a CID",
+				Usage:   "Get a CID, or a path such as /ipns/example.com/index.html",
 				Aliases: []string{"g"},
 				Action:  Get,
 				Flags: []cli.Flag{
@@ -35,6 +36,101 @@ func main1() int {
 						Usage: "query a specific indexer endpoint",
 						Value: "https://cid.contact/",
 					},
+					&cli.StringFlag{
+						Name:  "range",
+						Usage: "get only bytes `start-end` of a UnixFS file, written out as is rather than as a CAR",
+					},
+					&cli.StringFlag{
+						Name:  "extract",
+						Usage: "write the UnixFS file or directory out under `dir` rather than as a CAR",
+					},
+					&cli.StringFlag{
+						Name:  "ipns-endpoint",
+						Usage: "fetch IPNS records from a delegated routing endpoint",
+						Value: namesys.DefaultIPNSEndpoint,
+					},
+					&cli.StringFlag{
+						Name:  "routes",
+						Usage: "find providers in a YAML or JSON routing table, instead of the indexer unless one is given",
+					},
+					&cli.StringFlag{
+						Name:  "cache-dir",
+						Usage: "keep routing results and transfer state in a directory, for reuse across runs",
+					},
+					&cli.BoolFlag{
+						Name:  "private",
+						Usage: "use double-hashed lookups so the indexer does not learn the CID",
+					},
+					&cli.BoolFlag{
+						Name:    "verbose",
+						Aliases: []string{"v"},
+						Usage:   "verbose output",
+					},
+				},
+			},
+			{
+				Name:      "find",
+				Usage:     "Find the providers of a CID, without retrieving it",
+				ArgsUsage: "<cid>",
+				Aliases:   []string{"f"},
+				Action:    Find,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "indexer",
+						Usage: "query a specific indexer endpoint",
+						Value: "https://cid.contact/",
+					},
+					&cli.StringFlag{
+						Name:  "routes",
+						Usage: "find providers in a YAML or JSON routing table, instead of the indexer unless one is given",
+					},
+					&cli.BoolFlag{
+						Name:  "private",
+						Usage: "use double-hashed lookups so the indexer does not learn the CID",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print each record as a line of JSON",
+					},
+					&cli.BoolFlag{
+						Name:    "verbose",
+						Aliases: []string{"v"},
+						Usage:   "verbose output",
+					},
+				},
+			},
+			{
+				Name:   "serve",
+				Usage:  "Serve /ipfs/ and /ipns/ paths over HTTP as a trustless gateway, retrieving as requests arrive",
+				Action: Serve,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "listen for HTTP requests on `addr`",
+						Value: "127.0.0.1:8080",
+					},
+					&cli.StringFlag{
+						Name:  "indexer",
+						Usage: "query a specific indexer endpoint",
+						Value: "https://cid.contact/",
+					},
+					&cli.StringFlag{
+						Name:  "routes",
+						Usage: "find providers in a YAML or JSON routing table, instead of the indexer unless one is given",
+					},
+					&cli.StringFlag{
+						Name:  "ipns-endpoint",
+						Usage: "fetch IPNS records from a delegated routing endpoint",
+						Value: namesys.DefaultIPNSEndpoint,
+					},
+					&cli.StringFlag{
+						Name:  "cache-dir",
+						Usage: "keep retrieved blocks, routing results and transfer state in a leveldb directory for reuse across runs; without it, blocks are kept in a temporary leveldb directory removed on exit",
+					},
+					&cli.BoolFlag{
+						Name:  "private",
+						Usage: "use double-hashed lookups so the indexer does not learn the CID",
+					},
 					&cli.BoolFlag{
 						Name:    "verbose",
 						Aliases: []string{"v"},
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/ipfs-shipyard/w3rc"
+	"github.com/ipfs-shipyard/w3rc/namesys"
+	"github.com/ipfs-shipyard/w3rc/server"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-log/v2"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/bsadapter"
+	"github.com/urfave/cli/v2"
+)
+
+// Serve answers gateway requests over HTTP with content retrieved through a
+// single long-lived session, until interrupted.
+func Serve(c *cli.Context) error {
+	if c.Bool("verbose") {
+		log.SetLogLevel("*", "debug")
+	}
+
+	// retrieved blocks are kept on disk for later requests: in the cache
+	// directory if there is one, or else in a temporary one removed on exit.
+	dir := c.String("cache-dir")
+	if !c.IsSet("cache-dir") {
+		tmp, err := os.MkdirTemp("", "w3r-serve-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+	ds, err := openCacheDir(dir)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	bsa := bsadapter.Adapter{Wrapped: blockstore.NewBlockstore(ds)}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(&bsa)
+	ls.SetWriteStorage(&bsa)
+
+	resolver, err := namesys.NewResolver(c.String("ipns-endpoint"))
+	if err != nil {
+		return err
+	}
+	opts, err := routingOptions(c)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, w3rc.WithResolver(resolver))
+	if c.IsSet("cache-dir") {
+		opts = append(opts, w3rc.WithDS(ds), w3rc.WithPersistentRoutingCache())
+	}
+	w3s, err := w3rc.NewSession(ls, opts...)
+	if err != nil {
+		return err
+	}
+	defer w3s.Close()
+
+	ln, err := net.Listen("tcp", c.String("listen"))
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler: server.NewHandler(w3s, ls),
+		// clients slow to send their headers do not hold connections open.
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	ctx, stop := signal.NotifyContext(c.Context, os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+
+	fmt.Fprintf(c.App.ErrWriter, "serving on http://%s\n", ln.Addr())
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
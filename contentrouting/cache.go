@@ -0,0 +1,318 @@
+package contentrouting
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/index-provider/metadata"
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multicodec"
+)
+
+// Defaults for a routing cache.
+const (
+	DefaultCacheTTL         = 10 * time.Minute
+	DefaultNegativeCacheTTL = time.Minute
+	DefaultCacheSize        = 1024
+)
+
+var cacheKeyPrefix = datastore.NewKey("/routing-cache")
+
+var errNotPersistable = errors.New("record cannot be persisted")
+
+// A CacheOption configures a routing cache.
+type CacheOption func(*cacheRouter)
+
+// WithCacheTTL sets how long the records found for a cid are reused.
+func WithCacheTTL(ttl time.Duration) CacheOption {
+	return func(cr *cacheRouter) {
+		cr.ttl = ttl
+	}
+}
+
+// WithNegativeCacheTTL sets how long a cid without any providers is remembered
+// as such.
+func WithNegativeCacheTTL(ttl time.Duration) CacheOption {
+	return func(cr *cacheRouter) {
+		cr.negativeTTL = ttl
+	}
+}
+
+// WithCacheSize bounds the number of cids the cache holds.
+func WithCacheSize(entries int) CacheOption {
+	return func(cr *cacheRouter) {
+		cr.size = entries
+	}
+}
+
+// WithCacheDatastore persists cache entries to ds, so they outlive the cache.
+// Only records with a peer.AddrInfo provider and a metadata or byte payload,
+// as returned by indexers, are persisted.
+func WithCacheDatastore(ds datastore.Batching) CacheOption {
+	return func(cr *cacheRouter) {
+		cr.ds = ds
+	}
+}
+
+// NewCache makes a Routing that remembers the records found by r for each cid.
+// Queries that end in an error without finding anything are not cached, nor
+// are queries cut short by their context.
+func NewCache(r Routing, opts ...CacheOption) Routing {
+	cr := &cacheRouter{
+		backend:     r,
+		ttl:         DefaultCacheTTL,
+		negativeTTL: DefaultNegativeCacheTTL,
+		size:        DefaultCacheSize,
+		lru:         list.New(),
+		entries:     make(map[cid.Cid]*list.Element),
+	}
+	for _, opt := range opts {
+		opt(cr)
+	}
+	return cr
+}
+
+type cacheRouter struct {
+	backend     Routing
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+	ds          datastore.Batching
+
+	lk      sync.Mutex
+	lru     *list.List
+	entries map[cid.Cid]*list.Element
+}
+
+type cacheEntry struct {
+	c       cid.Cid
+	expires time.Time
+	records []RoutingRecord
+}
+
+// FindProviders implements the content routing interface.
+// The backend is queried without options, so that the records cached are
+// complete, and the options applied to them. A request cut short by its
+// timeout or record limit is thus not cached.
+func (cr *cacheRouter) FindProviders(ctx context.Context, c cid.Cid, opts ...RoutingOptions) <-chan RoutingRecord {
+	return FindWithOptions(ctx, opts, func(ctx context.Context) <-chan RoutingRecord {
+		return cr.find(ctx, c)
+	})
+}
+
+func (cr *cacheRouter) find(ctx context.Context, c cid.Cid) <-chan RoutingRecord {
+	if records, ok := cr.get(ctx, c); ok {
+		ch := make(chan RoutingRecord, len(records))
+		for _, r := range records {
+			ch <- r
+		}
+		close(ch)
+		return ch
+	}
+
+	ch := make(chan RoutingRecord, 1)
+	go func() {
+		defer close(ch)
+		var found []RoutingRecord
+		failed := false
+		for rec := range cr.backend.FindProviders(ctx, c) {
+			if rec.Protocol() == RoutingErrorProtocol {
+				failed = true
+			} else {
+				found = append(found, rec)
+			}
+			select {
+			case ch <- rec:
+			case <-ctx.Done():
+				// keep draining, as routers must be consumed until closed.
+			}
+		}
+		if ctx.Err() != nil || (failed && len(found) == 0) {
+			return
+		}
+		cr.put(ctx, c, found)
+	}()
+	return ch
+}
+
+func (cr *cacheRouter) get(ctx context.Context, c cid.Cid) ([]RoutingRecord, bool) {
+	cr.lk.Lock()
+	if elem, ok := cr.entries[c]; ok {
+		e := elem.Value.(*cacheEntry)
+		if time.Now().Before(e.expires) {
+			cr.lru.MoveToFront(elem)
+			cr.lk.Unlock()
+			return e.records, true
+		}
+		cr.remove(elem)
+		cr.lk.Unlock()
+		cr.forget(ctx, c)
+		return nil, false
+	}
+	cr.lk.Unlock()
+
+	if cr.ds == nil {
+		return nil, false
+	}
+	e, err := cr.load(ctx, c)
+	if err != nil {
+		return nil, false
+	}
+	if !time.Now().Before(e.expires) {
+		cr.forget(ctx, c)
+		return nil, false
+	}
+	cr.lk.Lock()
+	var evicted []cid.Cid
+	if _, ok := cr.entries[c]; !ok {
+		evicted = cr.insert(e)
+	}
+	cr.lk.Unlock()
+	cr.forget(ctx, evicted...)
+	return e.records, true
+}
+
+func (cr *cacheRouter) put(ctx context.Context, c cid.Cid, records []RoutingRecord) {
+	ttl := cr.ttl
+	if len(records) == 0 {
+		ttl = cr.negativeTTL
+	}
+	if ttl <= 0 || cr.size <= 0 {
+		return
+	}
+	e := &cacheEntry{c: c, expires: time.Now().Add(ttl), records: records}
+
+	cr.lk.Lock()
+	if elem, ok := cr.entries[c]; ok {
+		cr.remove(elem)
+	}
+	evicted := cr.insert(e)
+	cr.lk.Unlock()
+
+	if cr.ds != nil {
+		// persistence is best effort; the entry remains cached in memory.
+		_ = cr.store(ctx, e)
+	}
+	cr.forget(ctx, evicted...)
+}
+
+// insert adds e as the most recently used entry, evicting the least recently
+// used ones beyond the size bound, and returns the cids evicted. cr.lk must be
+// held.
+func (cr *cacheRouter) insert(e *cacheEntry) []cid.Cid {
+	cr.entries[e.c] = cr.lru.PushFront(e)
+	var evicted []cid.Cid
+	for cr.lru.Len() > cr.size {
+		evicted = append(evicted, cr.remove(cr.lru.Back()))
+	}
+	return evicted
+}
+
+// remove drops an entry from memory, returning its cid. cr.lk must be held.
+func (cr *cacheRouter) remove(elem *list.Element) cid.Cid {
+	e := cr.lru.Remove(elem).(*cacheEntry)
+	delete(cr.entries, e.c)
+	return e.c
+}
+
+// forget deletes the entries for cids from the datastore. It is called without
+// cr.lk held, so that lookups do not wait on the datastore.
+func (cr *cacheRouter) forget(ctx context.Context, cids ...cid.Cid) {
+	if cr.ds == nil {
+		return
+	}
+	for _, c := range cids {
+		_ = cr.ds.Delete(ctx, dsKey(c))
+	}
+}
+
+func dsKey(c cid.Cid) datastore.Key {
+	return cacheKeyPrefix.ChildString(c.String())
+}
+
+type persistedEntry struct {
+	Expires time.Time
+	Records []persistedRecord
+}
+
+type persistedRecord struct {
+	Protocol uint64
+	Provider peer.AddrInfo
+	// Metadata holds a metadata.Protocol payload, Payload a payload of raw bytes.
+	Metadata []byte `json:",omitempty"`
+	Payload  []byte `json:",omitempty"`
+}
+
+func (cr *cacheRouter) store(ctx context.Context, e *cacheEntry) error {
+	pe := persistedEntry{Expires: e.expires, Records: make([]persistedRecord, 0, len(e.records))}
+	for _, r := range e.records {
+		prov, ok := r.Provider().(peer.AddrInfo)
+		if !ok {
+			return errNotPersistable
+		}
+		pr := persistedRecord{Protocol: uint64(r.Protocol()), Provider: prov}
+		switch p := r.Payload().(type) {
+		case metadata.Protocol:
+			md, err := p.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			pr.Metadata = md
+		case []byte:
+			pr.Payload = p
+		default:
+			return errNotPersistable
+		}
+		pe.Records = append(pe.Records, pr)
+	}
+	b, err := json.Marshal(pe)
+	if err != nil {
+		return err
+	}
+	return cr.ds.Put(ctx, dsKey(e.c), b)
+}
+
+func (cr *cacheRouter) load(ctx context.Context, c cid.Cid) (*cacheEntry, error) {
+	b, err := cr.ds.Get(ctx, dsKey(c))
+	if err != nil {
+		return nil, err
+	}
+	var pe persistedEntry
+	if err := json.Unmarshal(b, &pe); err != nil {
+		return nil, err
+	}
+	e := &cacheEntry{c: c, expires: pe.Expires, records: make([]RoutingRecord, 0, len(pe.Records))}
+	for _, pr := range pe.Records {
+		rec := &cachedRecord{request: c, protocol: multicodec.Code(pr.Protocol), provider: pr.Provider}
+		if pr.Metadata != nil {
+			var md metadata.Metadata
+			if err := md.UnmarshalBinary(pr.Metadata); err != nil {
+				return nil, err
+			}
+			rec.payload = md.Get(rec.protocol)
+		} else {
+			rec.payload = pr.Payload
+		}
+		e.records = append(e.records, rec)
+	}
+	return e, nil
+}
+
+// cachedRecord is a record restored from a datastore.
+type cachedRecord struct {
+	request  cid.Cid
+	protocol multicodec.Code
+	provider peer.AddrInfo
+	payload  interface{}
+}
+
+func (r *cachedRecord) Request() cid.Cid          { return r.request }
+func (r *cachedRecord) Protocol() multicodec.Code { return r.protocol }
+func (r *cachedRecord) Provider() interface{}     { return r.provider }
+func (r *cachedRecord) Payload() interface{}      { return r.payload }
@@ -0,0 +1,164 @@
+package contentrouting_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/index-provider/metadata"
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// countingRouter answers from records, counting the queries it receives.
+type countingRouter struct {
+	queries int32
+	records map[cid.Cid][]contentrouting.RoutingRecord
+}
+
+func (r *countingRouter) FindProviders(_ context.Context, c cid.Cid, _ ...contentrouting.RoutingOptions) <-chan contentrouting.RoutingRecord {
+	atomic.AddInt32(&r.queries, 1)
+	recs := r.records[c]
+	ch := make(chan contentrouting.RoutingRecord, len(recs))
+	for _, rec := range recs {
+		ch <- rec
+	}
+	close(ch)
+	return ch
+}
+
+func (r *countingRouter) count() int {
+	return int(atomic.LoadInt32(&r.queries))
+}
+
+type payloadRecord struct {
+	testRecord
+	payload interface{}
+}
+
+func (r payloadRecord) Payload() interface{} { return r.payload }
+
+func testCid(s string) cid.Cid {
+	mh, _ := multihash.Encode([]byte(s), multihash.IDENTITY)
+	return cid.NewCidV1(uint64(multicodec.Raw), mh)
+}
+
+func TestCache(t *testing.T) {
+	found, missing, broken := testCid("found"), testCid("missing"), testCid("broken")
+	a := peer.AddrInfo{ID: peer.ID("a")}
+	backend := &countingRouter{records: map[cid.Cid][]contentrouting.RoutingRecord{
+		found:  {testRecord{found, multicodec.TransportBitswap, a}},
+		broken: {contentrouting.RecordError(broken, errors.New("indexer down"))},
+	}}
+	cache := contentrouting.NewCache(backend,
+		contentrouting.WithCacheTTL(time.Hour),
+		contentrouting.WithNegativeCacheTTL(50*time.Millisecond))
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if recs := drain(cache.FindProviders(ctx, found)); len(recs) != 1 {
+			t.Fatalf("expected 1 record, got %d", len(recs))
+		}
+	}
+	if backend.count() != 1 {
+		t.Fatalf("expected cached records to be reused, backend queried %d times", backend.count())
+	}
+
+	for i := 0; i < 2; i++ {
+		if recs := drain(cache.FindProviders(ctx, missing)); len(recs) != 0 {
+			t.Fatalf("expected no records, got %d", len(recs))
+		}
+	}
+	if backend.count() != 2 {
+		t.Fatalf("expected not found to be cached, backend queried %d times", backend.count())
+	}
+	time.Sleep(100 * time.Millisecond)
+	drain(cache.FindProviders(ctx, missing))
+	if backend.count() != 3 {
+		t.Fatalf("expected not found to expire, backend queried %d times", backend.count())
+	}
+
+	for i := 0; i < 2; i++ {
+		if recs := drain(cache.FindProviders(ctx, broken)); len(recs) != 1 || recs[0].Protocol() != contentrouting.RoutingErrorProtocol {
+			t.Fatalf("expected the error to be passed on, got %v", recs)
+		}
+	}
+	if backend.count() != 5 {
+		t.Fatalf("expected errors not to be cached, backend queried %d times", backend.count())
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	a := peer.AddrInfo{ID: peer.ID("a")}
+	cids := []cid.Cid{testCid("1"), testCid("2"), testCid("3")}
+	backend := &countingRouter{records: make(map[cid.Cid][]contentrouting.RoutingRecord)}
+	for _, c := range cids {
+		backend.records[c] = []contentrouting.RoutingRecord{testRecord{c, multicodec.TransportBitswap, a}}
+	}
+	cache := contentrouting.NewCache(backend, contentrouting.WithCacheSize(2))
+	ctx := context.Background()
+
+	for _, c := range cids {
+		drain(cache.FindProviders(ctx, c))
+	}
+	// the first cid was evicted, the last two are still held.
+	drain(cache.FindProviders(ctx, cids[2]))
+	drain(cache.FindProviders(ctx, cids[1]))
+	if backend.count() != 3 {
+		t.Fatalf("expected recent entries to be held, backend queried %d times", backend.count())
+	}
+	drain(cache.FindProviders(ctx, cids[0]))
+	if backend.count() != 4 {
+		t.Fatalf("expected oldest entry to be evicted, backend queried %d times", backend.count())
+	}
+}
+
+func TestCachePersisted(t *testing.T) {
+	c := testCid("persisted")
+	// persisted peer ids must be valid multihashes.
+	id, _ := multihash.Sum([]byte("a"), multihash.IDENTITY, -1)
+	a := peer.AddrInfo{ID: peer.ID(id)}
+	backend := &countingRouter{records: map[cid.Cid][]contentrouting.RoutingRecord{
+		c: {
+			payloadRecord{testRecord{c, multicodec.TransportBitswap, a}, &metadata.Bitswap{}},
+			payloadRecord{testRecord{c, multicodec.TransportIpfsGatewayHttp, a}, []byte("gw")},
+		},
+	}}
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	ctx := context.Background()
+
+	drain(contentrouting.NewCache(backend, contentrouting.WithCacheDatastore(ds)).FindProviders(ctx, c))
+
+	// a new cache, as in a later run, starts from the datastore.
+	recs := drain(contentrouting.NewCache(backend, contentrouting.WithCacheDatastore(ds)).FindProviders(ctx, c))
+	if backend.count() != 1 {
+		t.Fatalf("expected persisted records to be reused, backend queried %d times", backend.count())
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(recs))
+	}
+	if _, ok := recs[0].Payload().(*metadata.Bitswap); !ok {
+		t.Fatalf("expected bitswap metadata, got %T", recs[0].Payload())
+	}
+	if p, ok := recs[1].Payload().([]byte); !ok || string(p) != "gw" {
+		t.Fatalf("unexpected payload %v", recs[1].Payload())
+	}
+	if recs[1].Provider().(peer.AddrInfo).ID != a.ID || recs[1].Request() != c {
+		t.Fatalf("unexpected record %v", recs[1])
+	}
+}
+
+func drain(ch <-chan contentrouting.RoutingRecord) []contentrouting.RoutingRecord {
+	recs := make([]contentrouting.RoutingRecord, 0)
+	for r := range ch {
+		recs = append(recs, r)
+	}
+	return recs
+}
@@ -0,0 +1,106 @@
+package contentrouting
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multicodec"
+)
+
+// NewComposite makes a Routing that queries all of routers in parallel.
+// Records are passed on as soon as any router returns them, skipping those with
+// a provider and protocol already seen from another router. A record with the
+// addresses of a peer is still passed on after those without, such as from a
+// DHT that knows the peer by its ID alone.
+func NewComposite(routers ...Routing) Routing {
+	return &compositeRouter{routers}
+}
+
+type compositeRouter struct {
+	routers []Routing
+}
+
+type recordKey struct {
+	provider string
+	protocol multicodec.Code
+}
+
+// FindProviders implements the content routing interface
+func (cr *compositeRouter) FindProviders(ctx context.Context, c cid.Cid, opts ...RoutingOptions) <-chan RoutingRecord {
+	return FindWithOptions(ctx, opts, func(ctx context.Context) <-chan RoutingRecord {
+		return cr.find(ctx, c, opts)
+	})
+}
+
+// find merges the records of all routers, each of which is given the options
+// of the request as well.
+func (cr *compositeRouter) find(ctx context.Context, c cid.Cid, opts []RoutingOptions) <-chan RoutingRecord {
+	ch := make(chan RoutingRecord, 1)
+	var lk sync.Mutex
+	// seen is whether the records passed on for each key had addresses.
+	seen := make(map[recordKey]bool)
+	var wg sync.WaitGroup
+	for _, r := range cr.routers {
+		wg.Add(1)
+		go func(r Routing) {
+			defer wg.Done()
+			for rec := range r.FindProviders(ctx, c, opts...) {
+				if rec.Protocol() != RoutingErrorProtocol {
+					key := recordKey{providerKey(rec.Provider()), rec.Protocol()}
+					addrs := hasAddrs(rec.Provider())
+					lk.Lock()
+					hadAddrs, dup := seen[key]
+					skip := dup && (hadAddrs || !addrs)
+					if !skip {
+						seen[key] = addrs
+					}
+					lk.Unlock()
+					if skip {
+						continue
+					}
+				}
+				select {
+				case ch <- rec:
+				case <-ctx.Done():
+					// keep draining, as routers must be consumed until closed.
+				}
+			}
+		}(r)
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+// providerKey identifies a provider across routers. Peers are identified by their
+// ID alone, as routers may know of different addresses for the same peer.
+func providerKey(p interface{}) string {
+	switch v := p.(type) {
+	case peer.AddrInfo:
+		return v.ID.String()
+	case *peer.AddrInfo:
+		return v.ID.String()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// hasAddrs is false for a peer without addresses to dial it at. Other
+// providers are taken to be complete.
+func hasAddrs(p interface{}) bool {
+	switch v := p.(type) {
+	case peer.AddrInfo:
+		return len(v.Addrs) > 0
+	case *peer.AddrInfo:
+		return len(v.Addrs) > 0
+	default:
+		return true
+	}
+}
@@ -0,0 +1,104 @@
+package contentrouting_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+type testRecord struct {
+	request  cid.Cid
+	protocol multicodec.Code
+	provider peer.AddrInfo
+}
+
+func (r testRecord) Request() cid.Cid          { return r.request }
+func (r testRecord) Protocol() multicodec.Code { return r.protocol }
+func (r testRecord) Provider() interface{}     { return r.provider }
+func (r testRecord) Payload() interface{}      { return nil }
+
+// staticRouter answers every query with the same records, after a delay.
+type staticRouter struct {
+	delay   time.Duration
+	records []contentrouting.RoutingRecord
+}
+
+func (s *staticRouter) FindProviders(ctx context.Context, _ cid.Cid, _ ...contentrouting.RoutingOptions) <-chan contentrouting.RoutingRecord {
+	ch := make(chan contentrouting.RoutingRecord)
+	go func() {
+		defer close(ch)
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return
+		}
+		for _, r := range s.records {
+			ch <- r
+		}
+	}()
+	return ch
+}
+
+func TestComposite(t *testing.T) {
+	mh, _ := multihash.Encode([]byte("composite"), multihash.IDENTITY)
+	c := cid.NewCidV1(uint64(multicodec.Raw), mh)
+	a := peer.AddrInfo{ID: peer.ID("a"), Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/1")}}
+	aElsewhere := peer.AddrInfo{ID: peer.ID("a"), Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.2/tcp/1")}}
+	b := peer.AddrInfo{ID: peer.ID("b")}
+
+	fast := &staticRouter{records: []contentrouting.RoutingRecord{
+		testRecord{c, multicodec.TransportBitswap, a},
+	}}
+	slow := &staticRouter{delay: 50 * time.Millisecond, records: []contentrouting.RoutingRecord{
+		testRecord{c, multicodec.TransportBitswap, aElsewhere},
+		testRecord{c, multicodec.TransportGraphsyncFilecoinv1, a},
+		testRecord{c, multicodec.TransportBitswap, b},
+		contentrouting.RecordError(c, errors.New("partial failure")),
+	}}
+
+	records := contentrouting.NewComposite(fast, slow).FindProviders(context.Background(), c)
+	first := <-records
+	if first.Provider().(peer.AddrInfo).ID != a.ID || first.Protocol() != multicodec.TransportBitswap {
+		t.Fatalf("expected first record from the fast router, got %v", first)
+	}
+	rest := make([]contentrouting.RoutingRecord, 0)
+	for r := range records {
+		rest = append(rest, r)
+	}
+	if len(rest) != 3 {
+		t.Fatalf("expected 3 more records after de-duplication, got %d", len(rest))
+	}
+	if rest[2].Protocol() != contentrouting.RoutingErrorProtocol {
+		t.Fatalf("expected error record to be passed on, got %v", rest[2])
+	}
+}
+
+func TestCompositePrefersAddresses(t *testing.T) {
+	mh, _ := multihash.Encode([]byte("composite"), multihash.IDENTITY)
+	c := cid.NewCidV1(uint64(multicodec.Raw), mh)
+	bare := peer.AddrInfo{ID: peer.ID("a")}
+	dialable := peer.AddrInfo{ID: peer.ID("a"), Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/1")}}
+
+	// the dht finds the peer first, without its addresses.
+	dht := &staticRouter{records: []contentrouting.RoutingRecord{testRecord{c, multicodec.TransportBitswap, bare}}}
+	indexer := &staticRouter{delay: 50 * time.Millisecond, records: []contentrouting.RoutingRecord{
+		testRecord{c, multicodec.TransportBitswap, dialable},
+		testRecord{c, multicodec.TransportBitswap, dialable},
+	}}
+
+	var got []peer.AddrInfo
+	for r := range contentrouting.NewComposite(dht, indexer).FindProviders(context.Background(), c) {
+		got = append(got, r.Provider().(peer.AddrInfo))
+	}
+	if len(got) != 2 || len(got[0].Addrs) != 0 || len(got[1].Addrs) != 1 {
+		t.Fatalf("expected the record with addresses to follow the one without, got %v", got)
+	}
+}
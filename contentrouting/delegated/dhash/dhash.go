@@ -0,0 +1,137 @@
+// Package dhash implements the double hashing and encryption used by indexers
+// for reader-private lookups. A client asks for the hash of a multihash, so
+// the indexer never learns which content is being looked up, and decrypts the
+// returned values with keys only someone holding the original multihash can
+// derive.
+package dhash
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+)
+
+const nonceLen = 12
+
+var (
+	secondHashPrefix = []byte("CR_DOUBLEHASH\x00")
+	deriveKeyPrefix  = []byte("CR_ENCRYPTIONKEY\x00")
+	noncePrefix      = []byte("CR_NONCE\x00")
+)
+
+// SecondMultihash is the double hash of mh that is sent to the indexer in
+// place of mh.
+func SecondMultihash(mh multihash.Multihash) multihash.Multihash {
+	digest := sha(secondHashPrefix, mh)
+	dh, _ := multihash.Encode(digest, multihash.DBL_SHA2_256)
+	return dh
+}
+
+// MetadataKey is the key under which the metadata for a value key is stored.
+func MetadataKey(valueKey []byte) multihash.Multihash {
+	mh, _ := multihash.Encode(sha(valueKey), multihash.SHA2_256)
+	return mh
+}
+
+// CreateValueKey joins a provider and context id into a value key.
+func CreateValueKey(pid peer.ID, contextID []byte) []byte {
+	vk := varint.ToUvarint(uint64(len(pid)))
+	vk = append(vk, pid...)
+	vk = append(vk, varint.ToUvarint(uint64(len(contextID)))...)
+	return append(vk, contextID...)
+}
+
+// SplitValueKey splits a value key into its provider and context id.
+func SplitValueKey(valueKey []byte) (peer.ID, []byte, error) {
+	pid, rest, err := readPrefixed(valueKey)
+	if err != nil {
+		return "", nil, err
+	}
+	contextID, rest, err := readPrefixed(rest)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(rest) != 0 {
+		return "", nil, errors.New("trailing bytes in value key")
+	}
+	return peer.ID(pid), contextID, nil
+}
+
+// EncryptValueKey encrypts a value key with a key derived from mh.
+func EncryptValueKey(valueKey []byte, mh multihash.Multihash) ([]byte, error) {
+	return encrypt(valueKey, deriveKey(mh))
+}
+
+// DecryptValueKey reverses EncryptValueKey given the original multihash.
+func DecryptValueKey(encrypted []byte, mh multihash.Multihash) ([]byte, error) {
+	return decrypt(encrypted, deriveKey(mh))
+}
+
+// EncryptMetadata encrypts metadata with a key derived from its value key.
+func EncryptMetadata(metadata, valueKey []byte) ([]byte, error) {
+	return encrypt(metadata, deriveKey(valueKey))
+}
+
+// DecryptMetadata reverses EncryptMetadata given the value key.
+func DecryptMetadata(encrypted, valueKey []byte) ([]byte, error) {
+	return decrypt(encrypted, deriveKey(valueKey))
+}
+
+func deriveKey(b []byte) []byte {
+	return sha(deriveKeyPrefix, b)
+}
+
+func sha(parts ...[]byte) []byte {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func readPrefixed(b []byte) ([]byte, []byte, error) {
+	l, n, err := varint.FromUvarint(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	b = b[n:]
+	if uint64(len(b)) < l {
+		return nil, nil, errors.New("value key too short")
+	}
+	return b[:l], b[l:], nil
+}
+
+// encrypt seals payload with AES-GCM, prefixing the output with the nonce.
+// The nonce is derived from the payload and key so encryption is deterministic.
+func encrypt(payload, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := sha(noncePrefix, payload, key)[:nonceLen]
+	return gcm.Seal(nonce, nonce, payload, nil), nil
+}
+
+func decrypt(payload, key []byte) ([]byte, error) {
+	if len(payload) < nonceLen {
+		return nil, errors.New("encrypted payload too short")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, payload[:nonceLen], payload[nonceLen:], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
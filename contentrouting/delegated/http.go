@@ -2,67 +2,236 @@ package delegated
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sync/atomic"
 
 	metadata "github.com/filecoin-project/index-provider/metadata"
 	finderhttpclient "github.com/filecoin-project/storetheindex/api/v0/finder/client/http"
+	"github.com/filecoin-project/storetheindex/api/v0/finder/model"
+	"github.com/filecoin-project/storetheindex/api/v0/httpclient"
 	"github.com/ipfs-shipyard/w3rc/contentrouting"
 	cid "github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-varint"
 )
 
+var log = logging.Logger("w3rc-delegated")
+
+// ContentTypeNDJSON is the media type of streamed find responses, carrying one
+// provider result per line.
+const ContentTypeNDJSON = "application/x-ndjson"
+
+const finderPath = "/multihash"
+
+// An Option configures an HTTPRouter.
+type Option func(*HTTPRouter)
+
+// WithReaderPrivacy makes the router look up double-hashed multihashes, so
+// the indexer does not learn which content is being requested.
+func WithReaderPrivacy() Option {
+	return func(hr *HTTPRouter) {
+		hr.private = true
+	}
+}
+
 // NewDelegatedHTTP makes a routing provider backed by an HTTP endpoint.
-func NewDelegatedHTTP(url string) (contentrouting.Routing, error) {
+func NewDelegatedHTTP(url string, opts ...Option) (contentrouting.Routing, error) {
 	fmt.Printf("delegated to %s\n", url)
 	client, err := finderhttpclient.New(url)
 	if err != nil {
 		return nil, err
 	}
-	return &HTTPRouter{
-		Client: client,
-	}, nil
+	u, hc, err := httpclient.New(url, "")
+	if err != nil {
+		return nil, err
+	}
+	hr := &HTTPRouter{
+		Client:  client,
+		httpc:   hc,
+		baseURL: u.String(),
+	}
+	for _, opt := range opts {
+		opt(hr)
+	}
+	return hr, nil
 }
 
 // HTTPRouter contains the state for an active delegated HTTP client.
 type HTTPRouter struct {
 	*finderhttpclient.Client
+
+	httpc   *http.Client
+	baseURL string
+	private bool
+	// noStream is set once the endpoint has answered a streaming request
+	// with something other than ndjson.
+	noStream int32
+}
+
+// errNoStream signals that the endpoint does not support streamed responses.
+var errNoStream = errors.New("endpoint does not stream ndjson")
+
+// FindProviders implements the content routing interface.
+// In privacy mode the lookup is double-hashed, otherwise results are requested
+// as ndjson and passed on as each is decoded. Endpoints that do not stream are
+// queried for a complete JSON response instead.
+func (hr *HTTPRouter) FindProviders(ctx context.Context, c cid.Cid, opts ...contentrouting.RoutingOptions) <-chan contentrouting.RoutingRecord {
+	return contentrouting.FindWithOptions(ctx, opts, func(ctx context.Context) <-chan contentrouting.RoutingRecord {
+		return hr.find(ctx, c)
+	})
 }
 
-// FindProviders implements the content routing interface
-func (hr *HTTPRouter) FindProviders(ctx context.Context, c cid.Cid, _ ...contentrouting.RoutingOptions) <-chan contentrouting.RoutingRecord {
+func (hr *HTTPRouter) find(ctx context.Context, c cid.Cid) <-chan contentrouting.RoutingRecord {
 	ch := make(chan contentrouting.RoutingRecord, 1)
 	go func() {
 		defer close(ch)
 
-		parsedResp, err := hr.Client.Find(ctx, c.Hash())
-		if err != nil {
-			ch <- contentrouting.RecordError(c, err)
+		if hr.private {
+			if err := hr.findPrivate(ctx, c, ch); err != nil {
+				sendRecord(ctx, ch, contentrouting.RecordError(c, err))
+			}
 			return
 		}
 
-		hash := string(c.Hash())
-		// turn parsedResp into records.
-		for _, multihashResult := range parsedResp.MultihashResults {
-			if !(string(multihashResult.Multihash) == hash) {
-				continue
+		if atomic.LoadInt32(&hr.noStream) == 0 {
+			err := hr.findStream(ctx, c, ch)
+			if err == nil {
+				return
 			}
-			for _, val := range multihashResult.ProviderResults {
-				var md metadata.Metadata
-				if err := md.UnmarshalBinary(val.Metadata); err != nil {
-					ch <- &httpRecord{Cid: c, Prov: val.Provider, Proto: multicodec.Identity, Value: val.Metadata}
-					continue
-				}
-				for _, p := range md.Protocols() {
-					ch <- &httpRecord{Cid: c, Prov: val.Provider, Proto: p, Value: md.Get(p)}
-				}
+			if !errors.Is(err, errNoStream) {
+				sendRecord(ctx, ch, contentrouting.RecordError(c, err))
+				return
 			}
+			atomic.StoreInt32(&hr.noStream, 1)
 		}
+
+		parsedResp, err := hr.Client.Find(ctx, c.Hash())
+		if err != nil {
+			sendRecord(ctx, ch, contentrouting.RecordError(c, err))
+			return
+		}
+		emitFindResponse(ctx, ch, c, parsedResp)
 	}()
 
 	return ch
 }
 
+// emitFindResponse turns the provider results for c in a complete find
+// response into records.
+func emitFindResponse(ctx context.Context, ch chan<- contentrouting.RoutingRecord, c cid.Cid, parsedResp *model.FindResponse) {
+	hash := string(c.Hash())
+	for _, multihashResult := range parsedResp.MultihashResults {
+		if !(string(multihashResult.Multihash) == hash) {
+			continue
+		}
+		for _, val := range multihashResult.ProviderResults {
+			if !emitResult(ctx, ch, c, val) {
+				return
+			}
+		}
+	}
+}
+
+// findStream queries the endpoint for an ndjson response, emitting a record
+// set for each provider result as it arrives. An endpoint answering with a
+// complete JSON response instead is marked as not streaming, and its response
+// used as is. errNoStream is returned, before anything is emitted, if the
+// endpoint answers in another format.
+func (hr *HTTPRouter) findStream(ctx context.Context, c cid.Cid, ch chan<- contentrouting.RoutingRecord) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hr.baseURL+finderPath+"/"+c.Hash().B58String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", ContentTypeNDJSON)
+	resp, err := hr.httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil
+	case http.StatusBadRequest, http.StatusNotAcceptable, http.StatusUnsupportedMediaType:
+		return errNoStream
+	default:
+		return httpclient.ReadErrorFrom(resp.StatusCode, resp.Body)
+	}
+	mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err == nil && mt == "application/json" {
+		atomic.StoreInt32(&hr.noStream, 1)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		parsedResp, err := model.UnmarshalFindResponse(body)
+		if err != nil {
+			return err
+		}
+		emitFindResponse(ctx, ch, c, parsedResp)
+		return nil
+	}
+	if err != nil || mt != ContentTypeNDJSON {
+		return errNoStream
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var val model.ProviderResult
+		if err := dec.Decode(&val); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !emitResult(ctx, ch, c, val) {
+			return nil
+		}
+	}
+}
+
+// emitResult turns a provider result into records, one per protocol in its
+// metadata. It is false if ctx ended first.
+func emitResult(ctx context.Context, ch chan<- contentrouting.RoutingRecord, c cid.Cid, val model.ProviderResult) bool {
+	var md metadata.Metadata
+	if err := md.UnmarshalBinary(val.Metadata); err != nil {
+		// transports unknown to the metadata library, such as http, are passed
+		// on with their undecoded payload.
+		if proto, n, err := varint.FromUvarint(val.Metadata); err == nil && isTransport(multicodec.Code(proto)) {
+			return sendRecord(ctx, ch, &httpRecord{Cid: c, Prov: val.Provider, Proto: multicodec.Code(proto), Value: val.Metadata[n:]})
+		}
+		return sendRecord(ctx, ch, &httpRecord{Cid: c, Prov: val.Provider, Proto: multicodec.Identity, Value: val.Metadata})
+	}
+	for _, p := range md.Protocols() {
+		if !sendRecord(ctx, ch, &httpRecord{Cid: c, Prov: val.Provider, Proto: p, Value: md.Get(p)}) {
+			return false
+		}
+	}
+	return true
+}
+
+func sendRecord(ctx context.Context, ch chan<- contentrouting.RoutingRecord, r contentrouting.RoutingRecord) bool {
+	select {
+	case ch <- r:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// isTransport is true for codes in the range reserved for transports in the multicodec table.
+func isTransport(c multicodec.Code) bool {
+	return c >= multicodec.TransportBitswap && c < 0x0a00
+}
+
 type httpRecord struct {
 	Cid   cid.Cid
 	Prov  peer.AddrInfo
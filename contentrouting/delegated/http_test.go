@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/ipfs-shipyard/w3rc/contentrouting"
 	"github.com/ipfs-shipyard/w3rc/contentrouting/delegated"
@@ -53,6 +54,10 @@ func TestHTTPFetch(t *testing.T) {
 	if rcrds[0].Protocol() != multicodec.TransportBitswap {
 		t.Fatalf("expected protocol '1', got %d", rcrds[0].Protocol())
 	}
+	rcrds = doDrain(cr.FindProviders(context.Background(), foundCid, contentrouting.WithProtocols(multicodec.TransportGraphsyncFilecoinv1)))
+	if len(rcrds) != 0 {
+		t.Fatalf("expected bitswap record to be filtered, got %d", len(rcrds))
+	}
 
 	// An unknown record:
 	otherMH, _ := multihash.Encode([]byte("differentCID"), multihash.IDENTITY)
@@ -85,3 +90,220 @@ func doDrain(c <-chan contentrouting.RoutingRecord) []contentrouting.RoutingReco
 	}
 	return rcrds
 }
+
+func TestHTTPFetchUnknownTransport(t *testing.T) {
+	serv := mockdelegatedrouter.New()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serv.Serve(listener)
+	defer serv.Close()
+
+	cr, err := delegated.NewDelegatedHTTP(fmt.Sprintf("http://%s/", listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := p2ptestutil.RandTestBogusIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	foundMH, _ := multihash.Encode([]byte("hello gateway"), multihash.IDENTITY)
+	foundCid := cid.NewCidV1(uint64(multicodec.Raw), foundMH)
+	addr := peer.AddrInfo{
+		ID: p.ID(),
+		Addrs: []multiaddr.Multiaddr{
+			multiaddr.StringCast("/dns/example.com/tcp/443/https"),
+		},
+	}
+	serv.Add(foundCid, addr, uint64(multicodec.TransportIpfsGatewayHttp), []byte(""))
+	rcrds := doDrain(cr.FindProviders(context.Background(), foundCid))
+	if len(rcrds) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(rcrds))
+	}
+	if rcrds[0].Protocol() != multicodec.TransportIpfsGatewayHttp {
+		t.Fatalf("expected gateway protocol, got %s", rcrds[0].Protocol())
+	}
+}
+
+func TestHTTPFetchStreaming(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DisableNDJSON=%t", disable), func(t *testing.T) {
+			serv := mockdelegatedrouter.New()
+			serv.DisableNDJSON = disable
+			listener, err := net.Listen("tcp", ":0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go serv.Serve(listener)
+			defer serv.Close()
+
+			cr, err := delegated.NewDelegatedHTTP(fmt.Sprintf("http://%s/", listener.Addr().String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			foundMH, _ := multihash.Encode([]byte("many providers"), multihash.IDENTITY)
+			foundCid := cid.NewCidV1(uint64(multicodec.Raw), foundMH)
+			for i := 0; i < 3; i++ {
+				p, err := p2ptestutil.RandTestBogusIdentity()
+				if err != nil {
+					t.Fatal(err)
+				}
+				addr := peer.AddrInfo{
+					ID:    p.ID(),
+					Addrs: []multiaddr.Multiaddr{multiaddr.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 4000+i))},
+				}
+				serv.Add(foundCid, addr, uint64(multicodec.TransportBitswap), []byte(""))
+			}
+
+			// the second query exercises a router that has already fallen back.
+			for q := 0; q < 2; q++ {
+				rcrds := doDrain(cr.FindProviders(context.Background(), foundCid))
+				if len(rcrds) != 3 {
+					t.Fatalf("expected 3 records, got %d", len(rcrds))
+				}
+				for _, r := range rcrds {
+					if r.Protocol() != multicodec.TransportBitswap {
+						t.Fatalf("expected bitswap protocol, got %s", r.Protocol())
+					}
+				}
+				// a complete response to the streaming request is used as is.
+				if n := serv.PlaintextLookups(); n != q+1 {
+					t.Fatalf("expected a single request per query, got %d after %d queries", n, q+1)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPFetchStreamsRecords(t *testing.T) {
+	serv := mockdelegatedrouter.New()
+	serv.Hold = make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serv.Serve(listener)
+	defer serv.Close()
+
+	cr, err := delegated.NewDelegatedHTTP(fmt.Sprintf("http://%s/", listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	foundMH, _ := multihash.Encode([]byte("streamed providers"), multihash.IDENTITY)
+	foundCid := cid.NewCidV1(uint64(multicodec.Raw), foundMH)
+	for i := 0; i < 2; i++ {
+		p, err := p2ptestutil.RandTestBogusIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := peer.AddrInfo{
+			ID:    p.ID(),
+			Addrs: []multiaddr.Multiaddr{multiaddr.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 4000+i))},
+		}
+		serv.Add(foundCid, addr, uint64(multicodec.TransportBitswap), []byte(""))
+	}
+
+	// the first record arrives while the endpoint holds back the rest.
+	rcrdChan := cr.FindProviders(context.Background(), foundCid)
+	select {
+	case r := <-rcrdChan:
+		if r.Protocol() != multicodec.TransportBitswap {
+			t.Fatalf("expected bitswap protocol, got %s", r.Protocol())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a record before the response ended")
+	}
+	close(serv.Hold)
+	if rcrds := doDrain(rcrdChan); len(rcrds) != 1 {
+		t.Fatalf("expected 1 more record, got %d", len(rcrds))
+	}
+}
+
+func TestHTTPFetchPrivate(t *testing.T) {
+	serv := mockdelegatedrouter.New()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serv.Serve(listener)
+	defer serv.Close()
+
+	cr, err := delegated.NewDelegatedHTTP(fmt.Sprintf("http://%s/", listener.Addr().String()), delegated.WithReaderPrivacy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := p2ptestutil.RandTestBogusIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	foundMH, _ := multihash.Encode([]byte("hello private"), multihash.IDENTITY)
+	foundCid := cid.NewCidV1(uint64(multicodec.Raw), foundMH)
+	addr := peer.AddrInfo{
+		ID: p.ID(),
+		Addrs: []multiaddr.Multiaddr{
+			multiaddr.StringCast("/ip4/127.0.0.1/tcp/8080"),
+		},
+	}
+	serv.Add(foundCid, addr, uint64(multicodec.TransportBitswap), []byte(""))
+
+	rcrds := doDrain(cr.FindProviders(context.Background(), foundCid))
+	if len(rcrds) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(rcrds))
+	}
+	if rcrds[0].Protocol() != multicodec.TransportBitswap {
+		t.Fatalf("expected bitswap protocol, got %s", rcrds[0].Protocol())
+	}
+	prov := rcrds[0].Provider().(peer.AddrInfo)
+	if prov.ID != p.ID() || len(prov.Addrs) != 1 || !prov.Addrs[0].Equal(addr.Addrs[0]) {
+		t.Fatalf("unexpected provider %s", prov)
+	}
+
+	otherMH, _ := multihash.Encode([]byte("unknown private"), multihash.IDENTITY)
+	otherCid := cid.NewCidV1(uint64(multicodec.Raw), otherMH)
+	if rcrds := doDrain(cr.FindProviders(context.Background(), otherCid)); len(rcrds) != 0 {
+		t.Fatalf("expected no record, got %d", len(rcrds))
+	}
+	if n := serv.PlaintextLookups(); n != 0 {
+		t.Fatalf("expected no plaintext lookups, got %d", n)
+	}
+}
+
+func TestHTTPFetchPrivateSkipsCorruptEntries(t *testing.T) {
+	serv := mockdelegatedrouter.New()
+	serv.CorruptValueKeys = true
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serv.Serve(listener)
+	defer serv.Close()
+
+	cr, err := delegated.NewDelegatedHTTP(fmt.Sprintf("http://%s/", listener.Addr().String()), delegated.WithReaderPrivacy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	foundMH, _ := multihash.Encode([]byte("hello corrupt"), multihash.IDENTITY)
+	foundCid := cid.NewCidV1(uint64(multicodec.Raw), foundMH)
+	for i := 0; i < 2; i++ {
+		p, err := p2ptestutil.RandTestBogusIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := peer.AddrInfo{
+			ID:    p.ID(),
+			Addrs: []multiaddr.Multiaddr{multiaddr.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 4000+i))},
+		}
+		serv.Add(foundCid, addr, uint64(multicodec.TransportBitswap), []byte(""))
+	}
+
+	rcrds := doDrain(cr.FindProviders(context.Background(), foundCid))
+	if len(rcrds) != 2 {
+		t.Fatalf("expected the 2 good records, got %d", len(rcrds))
+	}
+	for _, r := range rcrds {
+		if r.Protocol() != multicodec.TransportBitswap {
+			t.Fatalf("expected bitswap protocol, got %s", r.Protocol())
+		}
+	}
+}
@@ -2,10 +2,14 @@ package mockdelegatedrouter
 
 import (
 	"encoding/json"
+	"mime"
 	"net/http"
 	"path"
+	"strings"
+	"sync/atomic"
 
 	"github.com/filecoin-project/storetheindex/api/v0/finder/model"
+	"github.com/ipfs-shipyard/w3rc/contentrouting/delegated/dhash"
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/multiformats/go-multihash"
@@ -17,10 +21,25 @@ import (
 type MockDelegatedProvider struct {
 	http.Server
 	records map[string]model.MultihashResult
+
+	// DisableNDJSON makes the provider answer every request with a complete
+	// JSON response, as indexers without streaming support do.
+	DisableNDJSON bool
+	// Hold, if set, delays streamed responses after their first result until
+	// it is closed.
+	Hold chan struct{}
+	// CorruptValueKeys makes double-hashed lookups return, along with the
+	// value keys of each record, one that cannot be decrypted, one that
+	// decrypts to a malformed value key, and one whose metadata fails to be
+	// served.
+	CorruptValueKeys bool
+
+	plaintextLookups int32
 }
 
 // OnReq handles requests from the http delegated routing client
 func (m *MockDelegatedProvider) OnReq(resp http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&m.plaintextLookups, 1)
 	_, queryCid := path.Split(req.URL.Path)
 	mh, err := multihash.FromB58String(queryCid)
 	if err != nil {
@@ -28,6 +47,22 @@ func (m *MockDelegatedProvider) OnReq(resp http.ResponseWriter, req *http.Reques
 		return
 	}
 	if qresp, ok := m.records[string(mh)]; ok {
+		if !m.DisableNDJSON && acceptsNDJSON(req) {
+			resp.Header().Set("Content-Type", ndjson)
+			enc := json.NewEncoder(resp)
+			for _, pr := range qresp.ProviderResults {
+				if err := enc.Encode(pr); err != nil {
+					return
+				}
+				if f, ok := resp.(http.Flusher); ok {
+					f.Flush()
+				}
+				if m.Hold != nil {
+					<-m.Hold
+				}
+			}
+			return
+		}
 		outBytes, err := json.Marshal(model.FindResponse{
 			MultihashResults: []model.MultihashResult{qresp},
 		})
@@ -36,6 +71,7 @@ func (m *MockDelegatedProvider) OnReq(resp http.ResponseWriter, req *http.Reques
 			return
 		}
 
+		resp.Header().Set("Content-Type", "application/json")
 		resp.Write(outBytes)
 	} else {
 		resp.WriteHeader(http.StatusNotFound)
@@ -43,30 +79,164 @@ func (m *MockDelegatedProvider) OnReq(resp http.ResponseWriter, req *http.Reques
 	}
 }
 
+const ndjson = "application/x-ndjson"
+
+func acceptsNDJSON(req *http.Request) bool {
+	for _, accept := range req.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mt == ndjson {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PlaintextLookups is the number of lookups made without double hashing.
+func (m *MockDelegatedProvider) PlaintextLookups() int {
+	return int(atomic.LoadInt32(&m.plaintextLookups))
+}
+
+// OnEncryptedReq handles double-hashed lookups from clients in privacy mode.
+func (m *MockDelegatedProvider) OnEncryptedReq(resp http.ResponseWriter, req *http.Request) {
+	_, query := path.Split(req.URL.Path)
+	dh, err := multihash.FromB58String(query)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, res := range m.records {
+		if string(dhash.SecondMultihash(res.Multihash)) != string(dh) {
+			continue
+		}
+		evks := make([][]byte, 0, len(res.ProviderResults)+3)
+		if m.CorruptValueKeys {
+			malformed, err := dhash.EncryptValueKey([]byte{0xff}, res.Multihash)
+			if err != nil {
+				resp.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			unserved, err := dhash.EncryptValueKey(dhash.CreateValueKey(peer.ID("unserved"), []byte("something")), res.Multihash)
+			if err != nil {
+				resp.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			evks = append(evks, []byte("not encrypted"), malformed, unserved)
+		}
+		for _, pr := range res.ProviderResults {
+			evk, err := dhash.EncryptValueKey(dhash.CreateValueKey(pr.Provider.ID, pr.ContextID), res.Multihash)
+			if err != nil {
+				resp.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			evks = append(evks, evk)
+		}
+		writeJSON(resp, encryptedFindResponse{
+			EncryptedMultihashResults: []encryptedMultihashResult{{Multihash: dh, EncryptedValueKeys: evks}},
+		})
+		return
+	}
+	resp.WriteHeader(http.StatusNotFound)
+}
+
+// OnMetadataReq serves the encrypted metadata for a hashed value key.
+func (m *MockDelegatedProvider) OnMetadataReq(resp http.ResponseWriter, req *http.Request) {
+	_, query := path.Split(req.URL.Path)
+	key, err := multihash.FromB58String(query)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, res := range m.records {
+		for _, pr := range res.ProviderResults {
+			vk := dhash.CreateValueKey(pr.Provider.ID, pr.ContextID)
+			if string(dhash.MetadataKey(vk)) != string(key) {
+				continue
+			}
+			em, err := dhash.EncryptMetadata(pr.Metadata, vk)
+			if err != nil {
+				resp.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(resp, encryptedMetadata{EncryptedMetadata: em})
+			return
+		}
+	}
+	if m.CorruptValueKeys {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.WriteHeader(http.StatusNotFound)
+}
+
+// OnProviderReq serves the addresses of a provider.
+func (m *MockDelegatedProvider) OnProviderReq(resp http.ResponseWriter, req *http.Request) {
+	_, query := path.Split(req.URL.Path)
+	pid, err := peer.Decode(query)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, res := range m.records {
+		for _, pr := range res.ProviderResults {
+			if pr.Provider.ID == pid {
+				writeJSON(resp, model.ProviderInfo{AddrInfo: pr.Provider})
+				return
+			}
+		}
+	}
+	resp.WriteHeader(http.StatusNotFound)
+}
+
+type encryptedFindResponse struct {
+	EncryptedMultihashResults []encryptedMultihashResult
+}
+
+type encryptedMultihashResult struct {
+	Multihash          multihash.Multihash
+	EncryptedValueKeys [][]byte
+}
+
+type encryptedMetadata struct {
+	EncryptedMetadata []byte
+}
+
+func writeJSON(resp http.ResponseWriter, v interface{}) {
+	outBytes, err := json.Marshal(v)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(outBytes)
+}
+
 // New creates a mock provider that can serve as a counterpart to the http
 // delegated content routing client
 func New() *MockDelegatedProvider {
 	mdp := MockDelegatedProvider{}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", mdp.OnReq)
+	mux.HandleFunc("/encrypted/multihash/", mdp.OnEncryptedReq)
+	mux.HandleFunc("/metadata/", mdp.OnMetadataReq)
+	mux.HandleFunc("/providers/", mdp.OnProviderReq)
 	mdp.Server.Handler = mux
 	mdp.records = make(map[string]model.MultihashResult)
 	return &mdp
 }
 
-// Add adds a record for the provider to return.
+// Add adds a record for the provider to return. Records added for the same
+// cid are returned together.
 func (m *MockDelegatedProvider) Add(c cid.Cid, peerAddr peer.AddrInfo, protocol uint64, md []byte) error {
 	mdp := varint.ToUvarint(protocol)
 	md = append(mdp, md...)
-	m.records[string(c.Hash())] = model.MultihashResult{
-		Multihash: c.Hash(),
-		ProviderResults: []model.ProviderResult{
-			{
-				ContextID: []byte("something"),
-				Metadata:  md,
-				Provider:  peerAddr,
-			},
-		},
-	}
+	res := m.records[string(c.Hash())]
+	res.Multihash = c.Hash()
+	res.ProviderResults = append(res.ProviderResults, model.ProviderResult{
+		ContextID: []byte("something"),
+		Metadata:  md,
+		Provider:  peerAddr,
+	})
+	m.records[string(c.Hash())] = res
 	return nil
 }
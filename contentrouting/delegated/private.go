@@ -0,0 +1,126 @@
+package delegated
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/filecoin-project/storetheindex/api/v0/finder/model"
+	"github.com/filecoin-project/storetheindex/api/v0/httpclient"
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	"github.com/ipfs-shipyard/w3rc/contentrouting/delegated/dhash"
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	encryptedFinderPath = "/encrypted/multihash"
+	metadataPath        = "/metadata"
+)
+
+type encryptedFindResponse struct {
+	EncryptedMultihashResults []encryptedMultihashResult
+}
+
+type encryptedMultihashResult struct {
+	Multihash          multihash.Multihash
+	EncryptedValueKeys [][]byte
+}
+
+type encryptedMetadata struct {
+	EncryptedMetadata []byte
+}
+
+// findPrivate looks up the double hash of c, then resolves each value key
+// the indexer returns into a provider result without revealing c.
+func (hr *HTTPRouter) findPrivate(ctx context.Context, c cid.Cid, ch chan<- contentrouting.RoutingRecord) error {
+	dh := dhash.SecondMultihash(c.Hash())
+	var resp encryptedFindResponse
+	found, err := hr.getJSON(ctx, encryptedFinderPath+"/"+dh.B58String(), &resp)
+	if err != nil || !found {
+		return err
+	}
+
+	providers := make(map[peer.ID]peer.AddrInfo)
+	for _, res := range resp.EncryptedMultihashResults {
+		if string(res.Multihash) != string(dh) {
+			continue
+		}
+		for _, evk := range res.EncryptedValueKeys {
+			// a corrupt entry does not spoil the others.
+			valueKey, err := dhash.DecryptValueKey(evk, c.Hash())
+			if err != nil {
+				log.Warnf("skipping value key for %s that cannot be decrypted: %s", c, err)
+				continue
+			}
+			pid, contextID, err := dhash.SplitValueKey(valueKey)
+			if err != nil {
+				log.Warnf("skipping malformed value key for %s: %s", c, err)
+				continue
+			}
+
+			var em encryptedMetadata
+			found, err := hr.getJSON(ctx, metadataPath+"/"+dhash.MetadataKey(valueKey).B58String(), &em)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Warnf("skipping value key for %s whose metadata cannot be fetched: %s", c, err)
+				continue
+			}
+			if !found {
+				// the provider has since removed this content.
+				continue
+			}
+			md, err := dhash.DecryptMetadata(em.EncryptedMetadata, valueKey)
+			if err != nil {
+				log.Warnf("skipping metadata for %s that cannot be decrypted: %s", c, err)
+				continue
+			}
+
+			addrInfo, ok := providers[pid]
+			if !ok {
+				addrInfo = peer.AddrInfo{ID: pid}
+				if info, err := hr.Client.GetProvider(ctx, pid); err == nil {
+					addrInfo = info.AddrInfo
+				}
+				providers[pid] = addrInfo
+			}
+			val := model.ProviderResult{ContextID: contextID, Metadata: md, Provider: addrInfo}
+			if !emitResult(ctx, ch, c, val) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// getJSON decodes the response at path into v. It is false if there is no
+// such resource.
+func (hr *HTTPRouter) getJSON(ctx context.Context, path string, v interface{}) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hr.baseURL+path, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := hr.httpc.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, httpclient.ReadErrorFrom(resp.StatusCode, resp.Body)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(body, v)
+}
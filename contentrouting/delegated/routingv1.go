@@ -0,0 +1,228 @@
+package delegated
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	metadata "github.com/filecoin-project/index-provider/metadata"
+	"github.com/filecoin-project/storetheindex/api/v0/httpclient"
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-varint"
+)
+
+const routingV1ProvidersPath = "/routing/v1/providers/"
+
+// Record schemas of the delegated routing v1 API.
+const (
+	SchemaPeer                = "peer"
+	SchemaBitswap             = "bitswap"
+	SchemaGraphsyncFilecoinV1 = "graphsync-filecoinv1"
+)
+
+// NewRoutingV1 makes a routing provider backed by an endpoint of the delegated
+// routing v1 HTTP API.
+func NewRoutingV1(url string) (contentrouting.Routing, error) {
+	u, hc, err := httpclient.New(url, "")
+	if err != nil {
+		return nil, err
+	}
+	return &RoutingV1Router{
+		httpc:   hc,
+		baseURL: u.String(),
+	}, nil
+}
+
+// RoutingV1Router contains the state for an active delegated routing v1 client.
+type RoutingV1Router struct {
+	httpc   *http.Client
+	baseURL string
+}
+
+// FindProviders implements the content routing interface.
+// Providers are requested as ndjson, with JSON accepted as well, and passed on
+// as each is decoded.
+func (rr *RoutingV1Router) FindProviders(ctx context.Context, c cid.Cid, opts ...contentrouting.RoutingOptions) <-chan contentrouting.RoutingRecord {
+	return contentrouting.FindWithOptions(ctx, opts, func(ctx context.Context) <-chan contentrouting.RoutingRecord {
+		ch := make(chan contentrouting.RoutingRecord, 1)
+		go func() {
+			defer close(ch)
+			if err := rr.find(ctx, c, ch); err != nil {
+				sendRecord(ctx, ch, contentrouting.RecordError(c, err))
+			}
+		}()
+		return ch
+	})
+}
+
+func (rr *RoutingV1Router) find(ctx context.Context, c cid.Cid, ch chan<- contentrouting.RoutingRecord) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rr.baseURL+routingV1ProvidersPath+c.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", ContentTypeNDJSON+", application/json;q=0.9")
+	resp, err := rr.httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil
+	default:
+		return httpclient.ReadErrorFrom(resp.StatusCode, resp.Body)
+	}
+
+	mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	emit := func(raw json.RawMessage) bool {
+		for _, rec := range v1Records(c, raw) {
+			if !sendRecord(ctx, ch, rec) {
+				return false
+			}
+		}
+		return true
+	}
+	switch mt {
+	case ContentTypeNDJSON:
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			if !emit(raw) {
+				return nil
+			}
+		}
+	case "application/json":
+		var body struct {
+			Providers []json.RawMessage
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return err
+		}
+		for _, raw := range body.Providers {
+			if !emit(raw) {
+				return nil
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected content type %q", mt)
+	}
+}
+
+type v1Record struct {
+	Schema    string
+	ID        string
+	Addrs     []string
+	Protocols []string
+	// Protocol, PieceCID, VerifiedDeal and FastRetrieval are set by the
+	// bitswap and graphsync-filecoinv1 schemas.
+	Protocol      string
+	PieceCID      json.RawMessage
+	VerifiedDeal  bool
+	FastRetrieval bool
+}
+
+// v1Records translates a provider of the routing v1 API into records. Records
+// of unknown schemas, or for unknown protocols, are skipped, as the API asks
+// of clients.
+func v1Records(c cid.Cid, raw json.RawMessage) []contentrouting.RoutingRecord {
+	var rec v1Record
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return nil
+	}
+	id, err := peer.Decode(rec.ID)
+	if err != nil {
+		return nil
+	}
+	prov := peer.AddrInfo{ID: id}
+	for _, a := range rec.Addrs {
+		if ma, err := multiaddr.NewMultiaddr(a); err == nil {
+			prov.Addrs = append(prov.Addrs, ma)
+		}
+	}
+
+	switch rec.Schema {
+	case SchemaBitswap:
+		return []contentrouting.RoutingRecord{
+			&httpRecord{Cid: c, Prov: prov, Proto: multicodec.TransportBitswap, Value: &metadata.Bitswap{}},
+		}
+	case SchemaGraphsyncFilecoinV1:
+		pieceCid, err := parseCid(rec.PieceCID)
+		if err != nil {
+			return nil
+		}
+		return []contentrouting.RoutingRecord{
+			&httpRecord{Cid: c, Prov: prov, Proto: multicodec.TransportGraphsyncFilecoinv1, Value: &metadata.GraphsyncFilecoinV1{
+				PieceCID:      pieceCid,
+				VerifiedDeal:  rec.VerifiedDeal,
+				FastRetrieval: rec.FastRetrieval,
+			}},
+		}
+	case SchemaPeer:
+		// peer records may carry the metadata of each protocol in a field
+		// named after it.
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil
+		}
+		out := make([]contentrouting.RoutingRecord, 0, len(rec.Protocols))
+		for _, name := range rec.Protocols {
+			var proto multicodec.Code
+			if err := proto.Set(name); err != nil {
+				continue
+			}
+			var md []byte
+			if f, ok := fields[name]; ok {
+				_ = json.Unmarshal(f, &md)
+			}
+			out = append(out, &httpRecord{Cid: c, Prov: prov, Proto: proto, Value: protocolPayload(proto, md)})
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+// protocolPayload decodes the metadata of a protocol where the metadata
+// library knows it, and otherwise passes it on undecoded.
+func protocolPayload(proto multicodec.Code, md []byte) interface{} {
+	if proto == multicodec.TransportBitswap {
+		return &metadata.Bitswap{}
+	}
+	var decoded metadata.Metadata
+	if err := decoded.UnmarshalBinary(append(varint.ToUvarint(uint64(proto)), md...)); err == nil {
+		if p := decoded.Get(proto); p != nil {
+			return p
+		}
+	}
+	return md
+}
+
+// parseCid reads a cid given either as a string or in its dag-json form.
+func parseCid(raw json.RawMessage) (cid.Cid, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return cid.Decode(s)
+	}
+	var c cid.Cid
+	err := json.Unmarshal(raw, &c)
+	return c, err
+}
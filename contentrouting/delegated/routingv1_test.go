@@ -0,0 +1,103 @@
+package delegated_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	metadata "github.com/filecoin-project/index-provider/metadata"
+	"github.com/ipfs-shipyard/w3rc/contentrouting/delegated"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	p2ptestutil "github.com/libp2p/go-libp2p-testing/netutil"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+)
+
+func TestRoutingV1(t *testing.T) {
+	mh, _ := multihash.Encode([]byte("routing v1"), multihash.IDENTITY)
+	c := cid.NewCidV1(uint64(multicodec.Raw), mh)
+	pieceMH, _ := multihash.Encode([]byte("piece"), multihash.IDENTITY)
+	piece := cid.NewCidV1(uint64(multicodec.FilCommitmentUnsealed), pieceMH)
+	ids := make([]peer.ID, 3)
+	for i := range ids {
+		p, err := p2ptestutil.RandTestBogusIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = p.ID()
+	}
+	gsMeta, err := (&metadata.GraphsyncFilecoinV1{PieceCID: piece, FastRetrieval: true}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// peer records carry metadata without its protocol prefix.
+	_, n, _ := varint.FromUvarint(gsMeta)
+	records := []string{
+		fmt.Sprintf(`{"Schema":"bitswap","Protocol":"transport-bitswap","ID":%q,"Addrs":["/ip4/127.0.0.1/tcp/4001"]}`, ids[0]),
+		fmt.Sprintf(`{"Schema":"graphsync-filecoinv1","Protocol":"transport-graphsync-filecoinv1","ID":%q,"Addrs":[],"PieceCID":%q,"VerifiedDeal":true}`, ids[1], piece),
+		fmt.Sprintf(`{"Schema":"peer","ID":%q,"Addrs":["/ip4/127.0.0.1/tcp/4002"],"Protocols":["transport-bitswap","transport-graphsync-filecoinv1","not-a-protocol"],"transport-graphsync-filecoinv1":%q}`,
+			ids[2], base64.StdEncoding.EncodeToString(gsMeta[n:])),
+		`{"Schema":"unknown","ID":"whatever"}`,
+	}
+
+	for _, ndjson := range []bool{true, false} {
+		t.Run(fmt.Sprintf("ndjson=%t", ndjson), func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/routing/v1/providers/"+c.String() {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if !ndjson || !strings.Contains(r.Header.Get("Accept"), delegated.ContentTypeNDJSON) {
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprintf(w, `{"Providers":[%s]}`, strings.Join(records, ","))
+					return
+				}
+				w.Header().Set("Content-Type", delegated.ContentTypeNDJSON)
+				for _, rec := range records {
+					fmt.Fprintln(w, rec)
+				}
+			}))
+			defer s.Close()
+
+			cr, err := delegated.NewRoutingV1(s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rcrds := doDrain(cr.FindProviders(context.Background(), c))
+			if len(rcrds) != 4 {
+				t.Fatalf("expected 4 records, got %d", len(rcrds))
+			}
+			expected := []multicodec.Code{
+				multicodec.TransportBitswap,
+				multicodec.TransportGraphsyncFilecoinv1,
+				multicodec.TransportBitswap,
+				multicodec.TransportGraphsyncFilecoinv1,
+			}
+			for i, r := range rcrds {
+				if r.Protocol() != expected[i] {
+					t.Fatalf("expected record %d to be %s, got %s", i, expected[i], r.Protocol())
+				}
+			}
+			if gs, ok := rcrds[1].Payload().(*metadata.GraphsyncFilecoinV1); !ok || gs.PieceCID != piece || !gs.VerifiedDeal {
+				t.Fatalf("unexpected graphsync payload %v", rcrds[1].Payload())
+			}
+			if gs, ok := rcrds[3].Payload().(*metadata.GraphsyncFilecoinV1); !ok || gs.PieceCID != piece || !gs.FastRetrieval {
+				t.Fatalf("unexpected peer record payload %v", rcrds[3].Payload())
+			}
+			if prov := rcrds[2].Provider().(peer.AddrInfo); prov.ID != ids[2] || len(prov.Addrs) != 1 {
+				t.Fatalf("unexpected provider %v", prov)
+			}
+
+			other, _ := multihash.Encode([]byte("unknown"), multihash.IDENTITY)
+			if rcrds := doDrain(cr.FindProviders(context.Background(), cid.NewCidV1(uint64(multicodec.Raw), other))); len(rcrds) != 0 {
+				t.Fatalf("expected no records, got %d", len(rcrds))
+			}
+		})
+	}
+}
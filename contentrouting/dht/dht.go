@@ -0,0 +1,120 @@
+// Package dht finds providers through the libp2p Kademlia DHT.
+// Peers providing content on the DHT serve it over bitswap, so each provider
+// found is reported as a bitswap record.
+package dht
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/multiformats/go-multicodec"
+)
+
+// joinTimeout bounds how long a query waits for the DHT client to find its
+// first peers after starting.
+const joinTimeout = 10 * time.Second
+
+// Router is a content router backed by a DHT client.
+type Router struct {
+	dht *kaddht.IpfsDHT
+}
+
+// New joins the DHT as a client on h. Unless opts set other bootstrap peers,
+// the public IPFS bootstrap peers are used.
+func New(ctx context.Context, h host.Host, opts ...kaddht.Option) (*Router, error) {
+	defaults := []kaddht.Option{
+		kaddht.Mode(kaddht.ModeClient),
+		kaddht.BootstrapPeers(kaddht.GetDefaultBootstrapPeerAddrInfos()...),
+	}
+	d, err := kaddht.New(ctx, h, append(defaults, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Bootstrap(ctx); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return &Router{dht: d}, nil
+}
+
+// FindProviders implements the content routing interface
+func (r *Router) FindProviders(ctx context.Context, c cid.Cid, opts ...contentrouting.RoutingOptions) <-chan contentrouting.RoutingRecord {
+	// the DHT can stop early once enough providers are found, unless some of
+	// them may yet be filtered out.
+	rc := contentrouting.ParseOptions(opts...)
+	count := 0
+	if rc.MaxRecords > 0 && len(rc.ExcludePeers) == 0 && len(rc.RequirePeers) == 0 {
+		count = rc.MaxRecords
+	}
+	return contentrouting.FindWithOptions(ctx, opts, func(ctx context.Context) <-chan contentrouting.RoutingRecord {
+		ch := make(chan contentrouting.RoutingRecord, 1)
+		go func() {
+			defer close(ch)
+			r.waitJoined(ctx)
+			for ai := range r.dht.FindProvidersAsync(ctx, c, count) {
+				select {
+				case ch <- &dhtRecord{Cid: c, Prov: ai}:
+				case <-ctx.Done():
+					// keep draining, as the query closes its channel once canceled.
+				}
+			}
+		}()
+		return ch
+	})
+}
+
+// waitJoined waits for the routing table to have peers, as a query made
+// before bootstrapping completes finds nothing.
+func (r *Router) waitJoined(ctx context.Context) {
+	if r.dht.RoutingTable().Size() > 0 {
+		return
+	}
+	timeout := time.NewTimer(joinTimeout)
+	defer timeout.Stop()
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for r.dht.RoutingTable().Size() == 0 {
+		select {
+		case <-tick.C:
+		case <-timeout.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close leaves the DHT.
+func (r *Router) Close() error {
+	return r.dht.Close()
+}
+
+type dhtRecord struct {
+	Cid  cid.Cid
+	Prov peer.AddrInfo
+}
+
+// Request is the Cid providers were found for
+func (r *dhtRecord) Request() cid.Cid {
+	return r.Cid
+}
+
+// Protocol is bitswap, which DHT providers serve content over
+func (r *dhtRecord) Protocol() multicodec.Code {
+	return multicodec.TransportBitswap
+}
+
+// Payload is empty, as bitswap needs no parameters
+func (r *dhtRecord) Payload() interface{} {
+	return nil
+}
+
+// Provider is the peer.AddrInfo of the provider
+func (r *dhtRecord) Provider() interface{} {
+	return r.Prov
+}
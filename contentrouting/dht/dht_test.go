@@ -0,0 +1,89 @@
+package dht_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	"github.com/ipfs-shipyard/w3rc/contentrouting/dht"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestDHTFindProviders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+	var servers []*kaddht.IpfsDHT
+	var hosts []host.Host
+	for i := 0; i < 4; i++ {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := kaddht.New(ctx, h, kaddht.Mode(kaddht.ModeServer), kaddht.BootstrapPeers())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		servers = append(servers, d)
+		hosts = append(hosts, h)
+	}
+	client, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range hosts {
+		for _, other := range hosts[i+1:] {
+			if _, err := mn.ConnectPeers(h.ID(), other.ID()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, d := range servers {
+		for d.RoutingTable().Size() < len(servers)-1 {
+			select {
+			case <-ctx.Done():
+				t.Fatal("dht servers did not find each other")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	mh, _ := multihash.Sum([]byte("provided over the dht"), multihash.SHA2_256, -1)
+	c := cid.NewCidV1(uint64(multicodec.Raw), mh)
+	if err := servers[3].Provide(ctx, c, true); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := dht.New(ctx, client, kaddht.BootstrapPeers(peer.AddrInfo{ID: hosts[0].ID(), Addrs: hosts[0].Addrs()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var records []contentrouting.RoutingRecord
+	for rec := range r.FindProviders(ctx, c, contentrouting.WithMaxRecords(1)) {
+		records = append(records, rec)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	if records[0].Protocol() != multicodec.TransportBitswap {
+		t.Fatalf("expected bitswap record, got %s", records[0].Protocol())
+	}
+	if prov := records[0].Provider().(peer.AddrInfo); prov.ID != hosts[3].ID() {
+		t.Fatalf("expected provider %s, got %s", hosts[3].ID(), prov.ID)
+	}
+}
@@ -17,6 +17,9 @@ import (
 // Caller. The same instance of a provider may block if previous calls have
 // left un-drained records. The provider will close the channel once complete
 // or once the context is canceled.
+//
+// Implementations honor the RoutingOptions of a request, typically by
+// producing their records through FindWithOptions.
 type Routing interface {
 	FindProviders(context.Context, cid.Cid, ...RoutingOptions) <-chan RoutingRecord
 }
@@ -29,9 +32,6 @@ type RoutingRecord interface {
 	Payload() interface{}
 }
 
-// RoutingOptions further specify a content routing request
-type RoutingOptions func()
-
 // RoutingErrorProtocol is the protocol identity for conveying a routing error
 const RoutingErrorProtocol = multicodec.ReservedEnd
 
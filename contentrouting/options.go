@@ -0,0 +1,167 @@
+package contentrouting
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multicodec"
+)
+
+// RoutingConfig is the set of constraints on a content routing request.
+// The zero value places no constraints.
+type RoutingConfig struct {
+	// Protocols, if any, are the only protocols for which records are returned.
+	Protocols []multicodec.Code
+	// MaxRecords, if positive, ends the request after that many records.
+	MaxRecords int
+	// ExcludePeers are providers for which no records are returned.
+	ExcludePeers []peer.ID
+	// RequirePeers, if any, are the only providers for which records are returned.
+	RequirePeers []peer.ID
+	// Timeout, if positive, bounds the duration of the request.
+	Timeout time.Duration
+}
+
+// RoutingOptions further specify a content routing request
+type RoutingOptions func(*RoutingConfig)
+
+// WithProtocols limits the records returned to the given transports.
+func WithProtocols(codes ...multicodec.Code) RoutingOptions {
+	return func(rc *RoutingConfig) {
+		rc.Protocols = append(rc.Protocols, codes...)
+	}
+}
+
+// WithMaxRecords ends a request once n records have been returned.
+func WithMaxRecords(n int) RoutingOptions {
+	return func(rc *RoutingConfig) {
+		rc.MaxRecords = n
+	}
+}
+
+// WithoutPeers drops the records of the given providers.
+func WithoutPeers(ids ...peer.ID) RoutingOptions {
+	return func(rc *RoutingConfig) {
+		rc.ExcludePeers = append(rc.ExcludePeers, ids...)
+	}
+}
+
+// WithPeers limits the records returned to those of the given providers.
+func WithPeers(ids ...peer.ID) RoutingOptions {
+	return func(rc *RoutingConfig) {
+		rc.RequirePeers = append(rc.RequirePeers, ids...)
+	}
+}
+
+// WithTimeout bounds the duration of a request.
+func WithTimeout(d time.Duration) RoutingOptions {
+	return func(rc *RoutingConfig) {
+		rc.Timeout = d
+	}
+}
+
+// ParseOptions collects options into a RoutingConfig.
+func ParseOptions(opts ...RoutingOptions) *RoutingConfig {
+	rc := &RoutingConfig{}
+	for _, opt := range opts {
+		opt(rc)
+	}
+	return rc
+}
+
+// Accept is whether rec satisfies the filters of the config. Errors are
+// always accepted. Providers that are not libp2p peers are never excluded,
+// but neither are they among any required peers.
+func (rc *RoutingConfig) Accept(rec RoutingRecord) bool {
+	if rec.Protocol() == RoutingErrorProtocol {
+		return true
+	}
+	if len(rc.Protocols) > 0 && !containsCode(rc.Protocols, rec.Protocol()) {
+		return false
+	}
+	if len(rc.ExcludePeers) == 0 && len(rc.RequirePeers) == 0 {
+		return true
+	}
+	id, ok := ProviderPeer(rec.Provider())
+	if !ok {
+		return len(rc.RequirePeers) == 0
+	}
+	if containsPeer(rc.ExcludePeers, id) {
+		return false
+	}
+	return len(rc.RequirePeers) == 0 || containsPeer(rc.RequirePeers, id)
+}
+
+// FindWithOptions applies the options of a request to the records produced by
+// find. find is called with a context carrying any timeout, which is also
+// canceled once the maximum number of records has been returned; the records
+// it produces are drained until closed either way. Routing implementations
+// use it so that options are honored consistently.
+func FindWithOptions(ctx context.Context, opts []RoutingOptions, find func(context.Context) <-chan RoutingRecord) <-chan RoutingRecord {
+	rc := ParseOptions(opts...)
+	var cancel context.CancelFunc
+	if rc.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, rc.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	records := find(ctx)
+
+	ch := make(chan RoutingRecord, 1)
+	go func() {
+		defer close(ch)
+		defer cancel()
+		sent := 0
+		for rec := range records {
+			if ctx.Err() != nil || !rc.Accept(rec) {
+				continue
+			}
+			select {
+			case ch <- rec:
+			case <-ctx.Done():
+				continue
+			}
+			if rec.Protocol() == RoutingErrorProtocol {
+				continue
+			}
+			sent++
+			if rc.MaxRecords > 0 && sent >= rc.MaxRecords {
+				cancel()
+			}
+		}
+	}()
+	return ch
+}
+
+// ProviderPeer is the peer ID of a record provider, if it is a libp2p peer.
+func ProviderPeer(p interface{}) (peer.ID, bool) {
+	switch v := p.(type) {
+	case peer.AddrInfo:
+		return v.ID, true
+	case *peer.AddrInfo:
+		return v.ID, true
+	case peer.ID:
+		return v, true
+	default:
+		return "", false
+	}
+}
+
+func containsCode(codes []multicodec.Code, c multicodec.Code) bool {
+	for _, code := range codes {
+		if code == c {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPeer(ids []peer.ID, id peer.ID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
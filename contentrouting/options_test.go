@@ -0,0 +1,59 @@
+package contentrouting_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multicodec"
+)
+
+func TestRoutingOptions(t *testing.T) {
+	c := testCid("options")
+	a, b := peer.AddrInfo{ID: peer.ID("a")}, peer.AddrInfo{ID: peer.ID("b")}
+	records := []contentrouting.RoutingRecord{
+		testRecord{c, multicodec.TransportBitswap, a},
+		testRecord{c, multicodec.TransportGraphsyncFilecoinv1, a},
+		testRecord{c, multicodec.TransportBitswap, b},
+		contentrouting.RecordError(c, errors.New("partial failure")),
+	}
+
+	cases := []struct {
+		name     string
+		opts     []contentrouting.RoutingOptions
+		expected int
+	}{
+		{"none", nil, 4},
+		{"protocols", []contentrouting.RoutingOptions{contentrouting.WithProtocols(multicodec.TransportBitswap)}, 3},
+		{"max records", []contentrouting.RoutingOptions{contentrouting.WithMaxRecords(2)}, 2},
+		{"exclude peers", []contentrouting.RoutingOptions{contentrouting.WithoutPeers(a.ID)}, 2},
+		{"require peers", []contentrouting.RoutingOptions{contentrouting.WithPeers(a.ID)}, 3},
+		{"combined", []contentrouting.RoutingOptions{
+			contentrouting.WithPeers(a.ID),
+			contentrouting.WithProtocols(multicodec.TransportGraphsyncFilecoinv1),
+		}, 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := contentrouting.NewComposite(&staticRouter{records: records})
+			if got := drain(r.FindProviders(context.Background(), c, tc.opts...)); len(got) != tc.expected {
+				t.Fatalf("expected %d records, got %d", tc.expected, len(got))
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		slow := &staticRouter{delay: time.Second, records: records}
+		r := contentrouting.NewComposite(slow)
+		start := time.Now()
+		if got := drain(r.FindProviders(context.Background(), c, contentrouting.WithTimeout(20*time.Millisecond))); len(got) != 0 {
+			t.Fatalf("expected no records, got %d", len(got))
+		}
+		if time.Since(start) > 500*time.Millisecond {
+			t.Fatalf("expected the request to time out")
+		}
+	})
+}
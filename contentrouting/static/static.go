@@ -0,0 +1,225 @@
+// Package static answers content routing requests from a fixed table, as
+// loaded from a YAML or JSON file, for deployments without an indexer.
+//
+// A table lists routes, each matching content by an exact CID, which matches
+// every CID of the same multihash, a prefix of the CID string ending in '*',
+// or '*' alone for all content:
+//
+//	routes:
+//	  - match: bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi
+//	    providers:
+//	      - peer: 12D3KooWGzxzKZYveHXtpG6AsrUJBcWxHBFS2HsEoGTxrMLvKXtf
+//	        addrs: [/ip4/10.0.0.1/tcp/4001]
+//	  - match: "*"
+//	    providers:
+//	      - addrs: [/dns/gateway.internal/tcp/443/https]
+//	        transport: transport-ipfs-gateway-http
+//
+// A provider's transport defaults to transport-bitswap. Its metadata, if the
+// transport needs any, is given base64 encoded, without the transport prefix.
+package static
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	metadata "github.com/filecoin-project/index-provider/metadata"
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-varint"
+	"gopkg.in/yaml.v3"
+)
+
+// Wildcard matches all content.
+const Wildcard = "*"
+
+// Config is the routing table of a static router.
+type Config struct {
+	Routes []Route `yaml:"routes"`
+}
+
+// A Route lists the providers of the content it matches.
+type Route struct {
+	Match     string     `yaml:"match"`
+	Providers []Provider `yaml:"providers"`
+}
+
+// A Provider is a source of content over a single transport.
+type Provider struct {
+	Peer      string   `yaml:"peer"`
+	Addrs     []string `yaml:"addrs"`
+	Transport string   `yaml:"transport"`
+	Metadata  string   `yaml:"metadata"`
+}
+
+// Load reads a routing table from a YAML or JSON file.
+func Load(path string) (*Router, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse reads a routing table in YAML or JSON.
+func Parse(data []byte) (*Router, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return New(cfg)
+}
+
+// New makes a router answering from cfg.
+func New(cfg Config) (*Router, error) {
+	r := &Router{exact: make(map[string][]provider)}
+	for i, route := range cfg.Routes {
+		providers := make([]provider, 0, len(route.Providers))
+		for j, p := range route.Providers {
+			parsed, err := parseProvider(p)
+			if err != nil {
+				return nil, fmt.Errorf("route %d, provider %d: %w", i, j, err)
+			}
+			providers = append(providers, parsed)
+		}
+
+		switch {
+		case route.Match == Wildcard:
+			r.wildcard = append(r.wildcard, providers...)
+		case strings.HasSuffix(route.Match, Wildcard):
+			r.prefixes = append(r.prefixes, prefixRoute{strings.TrimSuffix(route.Match, Wildcard), providers})
+		default:
+			c, err := cid.Decode(route.Match)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+			// cidv0 and cidv1 of the same content share a multihash.
+			mh := string(c.Hash())
+			r.exact[mh] = append(r.exact[mh], providers...)
+		}
+	}
+	return r, nil
+}
+
+// Router is a content router answering from a fixed table.
+type Router struct {
+	// exact holds the providers of exact routes by multihash.
+	exact    map[string][]provider
+	prefixes []prefixRoute
+	wildcard []provider
+}
+
+type prefixRoute struct {
+	prefix    string
+	providers []provider
+}
+
+type provider struct {
+	addr    peer.AddrInfo
+	proto   multicodec.Code
+	payload interface{}
+}
+
+// FindProviders implements the content routing interface.
+// Providers of exact matches come first, then those of prefixes, then those
+// of the wildcard.
+func (r *Router) FindProviders(ctx context.Context, c cid.Cid, opts ...contentrouting.RoutingOptions) <-chan contentrouting.RoutingRecord {
+	return contentrouting.FindWithOptions(ctx, opts, func(ctx context.Context) <-chan contentrouting.RoutingRecord {
+		matched := append([]provider{}, r.exact[string(c.Hash())]...)
+		s := c.String()
+		for _, pr := range r.prefixes {
+			if strings.HasPrefix(s, pr.prefix) {
+				matched = append(matched, pr.providers...)
+			}
+		}
+		matched = append(matched, r.wildcard...)
+
+		ch := make(chan contentrouting.RoutingRecord, len(matched))
+		for _, p := range matched {
+			ch <- &staticRecord{Cid: c, Prov: p.addr, Proto: p.proto, Value: p.payload}
+		}
+		close(ch)
+		return ch
+	})
+}
+
+func parseProvider(p Provider) (provider, error) {
+	var parsed provider
+	if p.Peer != "" {
+		id, err := peer.Decode(p.Peer)
+		if err != nil {
+			return parsed, err
+		}
+		parsed.addr.ID = id
+	}
+	for _, a := range p.Addrs {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return parsed, err
+		}
+		parsed.addr.Addrs = append(parsed.addr.Addrs, ma)
+	}
+
+	parsed.proto = multicodec.TransportBitswap
+	if p.Transport != "" {
+		if err := parsed.proto.Set(p.Transport); err != nil {
+			return parsed, err
+		}
+	}
+	md, err := base64.StdEncoding.DecodeString(p.Metadata)
+	if err != nil {
+		return parsed, err
+	}
+	parsed.payload, err = payload(parsed.proto, md)
+	return parsed, err
+}
+
+// payload decodes the metadata of transports known to the metadata library,
+// passing that of others on as is.
+func payload(proto multicodec.Code, md []byte) (interface{}, error) {
+	switch proto {
+	case multicodec.TransportBitswap:
+		return &metadata.Bitswap{}, nil
+	case multicodec.TransportGraphsyncFilecoinv1:
+		var decoded metadata.Metadata
+		if err := decoded.UnmarshalBinary(append(varint.ToUvarint(uint64(proto)), md...)); err != nil {
+			return nil, err
+		}
+		return decoded.Get(proto), nil
+	default:
+		return md, nil
+	}
+}
+
+type staticRecord struct {
+	Cid   cid.Cid
+	Prov  peer.AddrInfo
+	Proto multicodec.Code
+	Value interface{}
+}
+
+// Request is the Cid the record was found for
+func (r *staticRecord) Request() cid.Cid {
+	return r.Cid
+}
+
+// Protocol is the transport of the provider
+func (r *staticRecord) Protocol() multicodec.Code {
+	return r.Proto
+}
+
+// Payload is the decoded metadata for the transport
+func (r *staticRecord) Payload() interface{} {
+	return r.Value
+}
+
+// Provider is the peer.AddrInfo of the provider
+func (r *staticRecord) Provider() interface{} {
+	return r.Prov
+}
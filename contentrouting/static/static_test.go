@@ -0,0 +1,107 @@
+package static_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	"github.com/ipfs-shipyard/w3rc/contentrouting/static"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	p2ptestutil "github.com/libp2p/go-libp2p-testing/netutil"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestStatic(t *testing.T) {
+	ids := make([]peer.ID, 2)
+	for i := range ids {
+		p, err := p2ptestutil.RandTestBogusIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = p.ID()
+	}
+	mh, _ := multihash.Sum([]byte("static"), multihash.SHA2_256, -1)
+	exact := cid.NewCidV1(uint64(multicodec.Raw), mh)
+	other, _ := multihash.Sum([]byte("other"), multihash.SHA2_256, -1)
+	dagpb := cid.NewCidV1(uint64(multicodec.DagPb), other)
+
+	yamlTable := fmt.Sprintf(`
+routes:
+  - match: %s
+    providers:
+      - peer: %s
+        addrs: [/ip4/10.0.0.1/tcp/4001]
+  - match: "bafybei*"
+    providers:
+      - addrs: [/dns/gateway.internal/tcp/443/https]
+        transport: transport-ipfs-gateway-http
+  - match: "*"
+    providers:
+      - peer: %s
+        addrs: [/ip4/10.0.0.2/tcp/4001]
+`, exact, ids[0], ids[1])
+	jsonTable := fmt.Sprintf(`{"routes": [
+		{"match": %q, "providers": [{"peer": %q, "addrs": ["/ip4/10.0.0.1/tcp/4001"]}]},
+		{"match": "bafybei*", "providers": [{"addrs": ["/dns/gateway.internal/tcp/443/https"], "transport": "transport-ipfs-gateway-http"}]},
+		{"match": "*", "providers": [{"peer": %q, "addrs": ["/ip4/10.0.0.2/tcp/4001"]}]}
+	]}`, exact, ids[0], ids[1])
+
+	for name, table := range map[string]string{"yaml": yamlTable, "json": jsonTable} {
+		t.Run(name, func(t *testing.T) {
+			r, err := static.Parse([]byte(table))
+			if err != nil {
+				t.Fatal(err)
+			}
+			recs := drain(r.FindProviders(context.Background(), exact))
+			if len(recs) != 2 {
+				t.Fatalf("expected exact and wildcard records, got %d", len(recs))
+			}
+			if recs[0].Provider().(peer.AddrInfo).ID != ids[0] || recs[0].Protocol() != multicodec.TransportBitswap {
+				t.Fatalf("unexpected first record %v", recs[0])
+			}
+			if recs[1].Provider().(peer.AddrInfo).ID != ids[1] {
+				t.Fatalf("expected wildcard provider last, got %v", recs[1])
+			}
+
+			// the route matches the content under another version of its cid.
+			recs = drain(r.FindProviders(context.Background(), cid.NewCidV0(mh)))
+			if len(recs) != 2 || recs[0].Provider().(peer.AddrInfo).ID != ids[0] {
+				t.Fatalf("expected exact and wildcard records for the cidv0, got %v", recs)
+			}
+
+			recs = drain(r.FindProviders(context.Background(), dagpb))
+			if len(recs) != 2 || recs[0].Protocol() != multicodec.TransportIpfsGatewayHttp {
+				t.Fatalf("expected prefix and wildcard records, got %v", recs)
+			}
+
+			recs = drain(r.FindProviders(context.Background(), dagpb, contentrouting.WithProtocols(multicodec.TransportBitswap)))
+			if len(recs) != 1 || recs[0].Provider().(peer.AddrInfo).ID != ids[1] {
+				t.Fatalf("expected only the wildcard bitswap record, got %v", recs)
+			}
+		})
+	}
+}
+
+func TestStaticInvalid(t *testing.T) {
+	for _, table := range []string{
+		`routes: [{match: notacid, providers: []}]`,
+		`routes: [{match: "*", providers: [{peer: notapeer}]}]`,
+		`routes: [{match: "*", providers: [{addrs: [notanaddr]}]}]`,
+		`routes: [{match: "*", providers: [{transport: notatransport}]}]`,
+	} {
+		if _, err := static.Parse([]byte(table)); err == nil {
+			t.Fatalf("expected %q to be rejected", table)
+		}
+	}
+}
+
+func drain(ch <-chan contentrouting.RoutingRecord) []contentrouting.RoutingRecord {
+	recs := make([]contentrouting.RoutingRecord, 0)
+	for r := range ch {
+		recs = append(recs, r)
+	}
+	return recs
+}
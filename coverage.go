@@ -0,0 +1,84 @@
+package w3rc
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/traversal"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+)
+
+// MissingLink is a link reached while traversing a selector whose block is
+// not available from the local link system.
+type MissingLink struct {
+	Path datamodel.Path
+	Link datamodel.Link
+}
+
+// ErrIncompleteDAG is returned when transports have finished, but the requested
+// selector cannot be fully traversed from the session link system.
+type ErrIncompleteDAG struct {
+	Root    cid.Cid
+	Missing []MissingLink
+}
+
+func (e *ErrIncompleteDAG) Error() string {
+	if len(e.Missing) == 1 {
+		return fmt.Sprintf("incomplete dag under %s: missing %s at %q", e.Root, e.Missing[0].Link, e.Missing[0].Path)
+	}
+	return fmt.Sprintf("incomplete dag under %s: %d links missing", e.Root, len(e.Missing))
+}
+
+// missingLinks walks selector from root over lsys without fetching anything,
+// and reports every link the selector reaches that cannot be loaded.
+// Subtrees under a missing link are not explored.
+func missingLinks(ctx context.Context, lsys ipld.LinkSystem, root cid.Cid, selector datamodel.Node) ([]MissingLink, error) {
+	sel, err := ipldselector.CompileSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make([]MissingLink, 0)
+	local := withUnixFS(lsys)
+	local.StorageReadOpener = func(lc linking.LinkContext, l datamodel.Link) (io.Reader, error) {
+		r, err := lsys.StorageReadOpener(lc, l)
+		if err != nil {
+			missing = append(missing, MissingLink{Path: lc.LinkPath, Link: l})
+			return nil, traversal.SkipMe{}
+		}
+		return r, nil
+	}
+
+	rootLink := cidlink.Link{Cid: root}
+	lc := ipld.LinkContext{Ctx: ctx}
+	np, err := unixfsChooser(rootLink, lc)
+	if err != nil {
+		return nil, err
+	}
+	rootNode, err := local.Load(lc, rootLink, np)
+	if _, ok := err.(traversal.SkipMe); ok {
+		return missing, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	prog := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     local,
+			LinkTargetNodePrototypeChooser: unixfsChooser,
+			LinkVisitOnlyOnce:              true,
+		},
+	}
+	prog.LastBlock.Link = rootLink
+	if err := prog.WalkAdv(rootNode, sel, func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil }); err != nil {
+		return nil, err
+	}
+	return missing, nil
+}
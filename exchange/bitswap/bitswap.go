@@ -7,6 +7,8 @@ import (
 	"io"
 
 	"github.com/ipfs-shipyard/w3rc/exchange"
+	"github.com/ipfs/go-unixfsnode"
+	dagpb "github.com/ipld/go-codec-dagpb"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/linking"
@@ -21,6 +23,9 @@ import (
 	bsc "github.com/willscott/go-selfish-bitswap-client"
 )
 
+// chooser loads dag-pb blocks such that they can be interpreted as UnixFS.
+var chooser = dagpb.AddSupportToChooser(basicnode.Chooser)
+
 func NewBitswaExchange(h host.Host, lsys *ipld.LinkSystem) *BitswapExchange {
 	return &BitswapExchange{
 		h:        h,
@@ -40,7 +45,7 @@ func (*BitswapExchange) Code() multicodec.Code {
 }
 
 func singleTerminalError(err error) <-chan exchange.EventData {
-	resultChan := make(chan exchange.EventData)
+	resultChan := make(chan exchange.EventData, 1)
 	resultChan <- exchange.EventData{Event: exchange.FailureEvent, State: err}
 	close(resultChan)
 	return resultChan
@@ -70,7 +75,10 @@ func (be *BitswapExchange) RequestData(ctx context.Context, root ipld.Link, sele
 }
 
 func (be *BitswapExchange) traverse(ctx context.Context, root ipld.Link, s ipldselector.Selector, session *bsc.Session, status chan exchange.EventData) {
+	defer close(status)
 	ls := cidlink.DefaultLinkSystem()
+	// selectors may interpret dag-pb as UnixFS, such as to follow a path.
+	unixfsnode.AddUnixFSReificationToLinkSystem(&ls)
 
 	ls.StorageReadOpener = func(lc linking.LinkContext, l datamodel.Link) (io.Reader, error) {
 		r, err := be.lsys.StorageReadOpener(lc, l)
@@ -98,14 +106,26 @@ func (be *BitswapExchange) traverse(ctx context.Context, root ipld.Link, s iplds
 
 	prog := traversal.Progress{
 		Cfg: &traversal.Config{
-			Ctx:               ctx,
-			LinkSystem:        ls,
-			LinkVisitOnlyOnce: true,
+			Ctx:                            ctx,
+			LinkSystem:                     ls,
+			LinkTargetNodePrototypeChooser: chooser,
+			LinkVisitOnlyOnce:              true,
 		},
 	}
 	status <- exchange.EventData{Event: exchange.StartEvent, State: nil}
 
-	err := prog.WalkAdv(basicnode.NewLink(root), s, func(prog traversal.Progress, _ ipld.Node, _ traversal.VisitReason) error {
+	var rootNode ipld.Node
+	lc := ipld.LinkContext{Ctx: ctx}
+	np, err := chooser(root, lc)
+	if err == nil {
+		rootNode, err = ls.Load(lc, root, np)
+	}
+	if err != nil {
+		status <- exchange.EventData{Event: exchange.FailureEvent, State: err}
+		return
+	}
+	prog.LastBlock.Link = root
+	err = prog.WalkAdv(rootNode, s, func(prog traversal.Progress, _ ipld.Node, _ traversal.VisitReason) error {
 		status <- exchange.EventData{Event: exchange.ProgressEvent, State: prog.LastBlock.Link}
 		return nil
 	})
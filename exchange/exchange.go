@@ -24,11 +24,41 @@ type EventData struct {
 	State State
 }
 
+// Progress is the State of a ProgressEvent from exchanges receiving a block
+// at a time.
+type Progress struct {
+	// Link is the block just received.
+	Link ipld.Link
+	// Bytes is the size of all the blocks the request has received so far.
+	Bytes uint64
+}
+
+// Received is the size of the blocks received so far.
+func (p Progress) Received() uint64 {
+	return p.Bytes
+}
+
+type sessionRootKey struct{}
+
+// WithSessionRoot records in ctx the root a session is retrieving, which the
+// requests it makes, such as those for subtrees of the dag, are part of.
+func WithSessionRoot(ctx context.Context, root ipld.Link) context.Context {
+	return context.WithValue(ctx, sessionRootKey{}, root)
+}
+
+// SessionRoot returns the root recorded in ctx by WithSessionRoot.
+func SessionRoot(ctx context.Context) (ipld.Link, bool) {
+	root, ok := ctx.Value(sessionRootKey{}).(ipld.Link)
+	return root, ok
+}
+
 type Exchange interface {
 	// Code is the identifier for this exchange protocol
 	Code() multicodec.Code
 
-	// RequestData based on root, selector, and routing parameters
+	// RequestData based on root, selector, and routing parameters.
+	// The returned channel must end with either a SuccessEvent or a FailureEvent,
+	// and is closed once the exchange is done with the request.
 	RequestData(ctx context.Context, request ipld.Link, selector ipld.Node, routingProvider interface{}, routingPayload interface{}) <-chan EventData
 
 	// Close completes use of this exchange
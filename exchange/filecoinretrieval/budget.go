@@ -0,0 +1,113 @@
+package filecoinretrieval
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ErrOverBudget is returned when a payment requested by a provider would exceed
+// the configured retrieval budget.
+type ErrOverBudget struct {
+	// Requested is the total that would have been spent including the payment.
+	Requested abi.TokenAmount
+	// Limit is the budget that would have been exceeded.
+	Limit abi.TokenAmount
+	// PerRetrieval is set if the limit is that of a single retrieval rather
+	// than the session as a whole.
+	PerRetrieval bool
+}
+
+func (e *ErrOverBudget) Error() string {
+	scope := "session"
+	if e.PerRetrieval {
+		scope = "retrieval"
+	}
+	return fmt.Sprintf("payment of %s attoFIL would exceed %s budget of %s attoFIL", e.Requested, scope, e.Limit)
+}
+
+// SpendReport is a summary of payments made for retrievals, in attoFIL.
+type SpendReport struct {
+	Total      abi.TokenAmount
+	ByProvider map[peer.ID]abi.TokenAmount
+	ByRoot     map[cid.Cid]abi.TokenAmount
+}
+
+// A Ledger limits and accounts for the funds paid to providers.
+// A limit without a value (abi.TokenAmount{}) is unlimited.
+type Ledger struct {
+	lk              sync.Mutex
+	max             abi.TokenAmount
+	maxPerRetrieval abi.TokenAmount
+	spent           SpendReport
+}
+
+// NewLedger creates a ledger with a total budget and a budget for any single retrieval.
+func NewLedger(max, maxPerRetrieval abi.TokenAmount) *Ledger {
+	return &Ledger{
+		max:             max,
+		maxPerRetrieval: maxPerRetrieval,
+		spent: SpendReport{
+			Total:      big.Zero(),
+			ByProvider: make(map[peer.ID]abi.TokenAmount),
+			ByRoot:     make(map[cid.Cid]abi.TokenAmount),
+		},
+	}
+}
+
+// Reserve accounts for paying amount to provider towards the retrieval of root,
+// of which retrievalTotal will then have been paid. It fails with ErrOverBudget
+// without accounting for anything if a limit would be exceeded.
+func (l *Ledger) Reserve(provider peer.ID, root cid.Cid, amount, retrievalTotal abi.TokenAmount) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.maxPerRetrieval.Int != nil && retrievalTotal.GreaterThan(l.maxPerRetrieval) {
+		return &ErrOverBudget{Requested: retrievalTotal, Limit: l.maxPerRetrieval, PerRetrieval: true}
+	}
+	total := big.Add(l.spent.Total, amount)
+	if l.max.Int != nil && total.GreaterThan(l.max) {
+		return &ErrOverBudget{Requested: total, Limit: l.max}
+	}
+	l.spent.Total = total
+	l.spent.ByProvider[provider] = addTo(l.spent.ByProvider[provider], amount)
+	l.spent.ByRoot[root] = addTo(l.spent.ByRoot[root], amount)
+	return nil
+}
+
+// Release reverts a reservation whose payment was not made.
+func (l *Ledger) Release(provider peer.ID, root cid.Cid, amount abi.TokenAmount) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.spent.Total = big.Sub(l.spent.Total, amount)
+	l.spent.ByProvider[provider] = big.Sub(l.spent.ByProvider[provider], amount)
+	l.spent.ByRoot[root] = big.Sub(l.spent.ByRoot[root], amount)
+}
+
+// Report returns a copy of what has been spent so far.
+func (l *Ledger) Report() SpendReport {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	report := SpendReport{
+		Total:      l.spent.Total,
+		ByProvider: make(map[peer.ID]abi.TokenAmount, len(l.spent.ByProvider)),
+		ByRoot:     make(map[cid.Cid]abi.TokenAmount, len(l.spent.ByRoot)),
+	}
+	for p, a := range l.spent.ByProvider {
+		report.ByProvider[p] = a
+	}
+	for r, a := range l.spent.ByRoot {
+		report.ByRoot[r] = a
+	}
+	return report
+}
+
+func addTo(a, b abi.TokenAmount) abi.TokenAmount {
+	if a.Int == nil {
+		return b
+	}
+	return big.Add(a, b)
+}
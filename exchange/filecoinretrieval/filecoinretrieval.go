@@ -9,11 +9,13 @@ import (
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	rmnet "github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-state-types/builtin/v8/paych"
 	"github.com/filecoin-project/index-provider/metadata"
 	"github.com/ipfs-shipyard/w3rc/exchange"
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
@@ -26,14 +28,35 @@ import (
 var log = logging.Logger("filecoin_retrieval")
 
 type transfer struct {
-	ctx          context.Context //lint:ignore U1000 implementation in progress
+	ctx          context.Context
+	provider     peer.ID
 	proposal     retrievalmarket.DealProposal
 	pchRequired  bool
 	pchAddr      address.Address
 	pchLane      uint64
 	nonce        uint64
-	totalPayment abi.TokenAmount //lint:ignore U1000 implementation in progress
-	events       chan exchange.EventData
+	totalPayment abi.TokenAmount
+	// lk guards events, which are sent both on data transfer events and on
+	// cancellation, until events is closed and set to nil.
+	lk     sync.Mutex
+	events chan exchange.EventData
+	// done is closed along with events.
+	done chan struct{}
+	// root is what payments are accounted to, which is the root of the session
+	// where the request is for a part of its dag.
+	root cid.Cid
+}
+
+// owed is the most the miner can be paid for sending received bytes.
+func (tf *transfer) owed(received uint64) abi.TokenAmount {
+	owed := big.Zero()
+	if tf.proposal.PricePerByte.Int != nil {
+		owed = big.Mul(tf.proposal.PricePerByte, big.NewIntUnsigned(received))
+	}
+	if tf.proposal.UnsealPrice.Int != nil {
+		owed = big.Add(owed, tf.proposal.UnsealPrice)
+	}
+	return owed
 }
 
 type Event datatransfer.Event
@@ -54,8 +77,48 @@ type PaymentAPI interface {
 	CreateVoucher(ctx context.Context, payCh address.Address, vouch paych.SignedVoucher) (*VoucherCreateResult, error)
 }
 
+// A Querier asks a storage provider for the terms under which it will serve a retrieval.
+type Querier interface {
+	Query(ctx context.Context, p peer.ID, q retrievalmarket.Query) (retrievalmarket.QueryResponse, error)
+}
+
+type networkQuerier struct {
+	net rmnet.RetrievalMarketNetwork
+}
+
+// NewNetworkQuerier makes retrieval queries over the retrieval market query protocol.
+func NewNetworkQuerier(h host.Host) Querier {
+	return &networkQuerier{rmnet.NewFromLibp2pHost(h)}
+}
+
+func (nq *networkQuerier) Query(ctx context.Context, p peer.ID, q retrievalmarket.Query) (retrievalmarket.QueryResponse, error) {
+	s, err := nq.net.NewQueryStream(p)
+	if err != nil {
+		return retrievalmarket.QueryResponseUndefined, err
+	}
+	defer s.Close()
+
+	// the query stream is not context aware, so unblock reads on cancellation.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
+
+	if err := s.WriteQuery(q); err != nil {
+		return retrievalmarket.QueryResponseUndefined, err
+	}
+	return s.ReadQueryResponse()
+}
+
 type FilecoinExchange struct {
 	paymentAPI   PaymentAPI
+	querier      Querier
+	ledger       *Ledger
 	dataTransfer datatransfer.Manager
 	host         host.Host
 	transfers    map[datatransfer.ChannelID]*transfer
@@ -63,7 +126,26 @@ type FilecoinExchange struct {
 	cancel       datatransfer.Unsubscribe
 }
 
-func NewFilecoinExchange(node PaymentAPI, h host.Host, dataTransfer datatransfer.Manager) *FilecoinExchange {
+// An Option configures a FilecoinExchange
+type Option func(*FilecoinExchange)
+
+// WithLedger sets the ledger payments are limited by and accounted in.
+// By default, payments are accounted without limit.
+func WithLedger(l *Ledger) Option {
+	return func(fe *FilecoinExchange) {
+		fe.ledger = l
+	}
+}
+
+// WithQuerier sets how retrieval terms are queried from storage providers.
+// By default, queries are made over the libp2p host.
+func WithQuerier(q Querier) Option {
+	return func(fe *FilecoinExchange) {
+		fe.querier = q
+	}
+}
+
+func NewFilecoinExchange(node PaymentAPI, h host.Host, dataTransfer datatransfer.Manager, opts ...Option) *FilecoinExchange {
 	err := dataTransfer.RegisterVoucherResultType(&retrievalmarket.DealResponse{})
 	if err != nil {
 		log.Warnf("failed to register deal response voucher: %s", err)
@@ -76,19 +158,32 @@ func NewFilecoinExchange(node PaymentAPI, h host.Host, dataTransfer datatransfer
 		dataTransfer: dataTransfer,
 		transfers:    make(map[datatransfer.ChannelID]*transfer),
 	}
+	for _, opt := range opts {
+		opt(&fex)
+	}
+	if fex.querier == nil {
+		fex.querier = NewNetworkQuerier(h)
+	}
+	if fex.ledger == nil {
+		fex.ledger = NewLedger(abi.TokenAmount{}, abi.TokenAmount{})
+	}
 	unsub := fex.dataTransfer.SubscribeToEvents(fex.subscriber)
 	fex.cancel = unsub
 
 	return &fex
 }
 
-//lint:ignore U1000 implementation in progress
 func finishWithError(tf *transfer, err error) {
 	tf.events <- exchange.EventData{Event: exchange.FailureEvent, State: err}
+	finish(tf)
+}
+
+func finish(tf *transfer) {
 	close(tf.events)
+	tf.events = nil
+	close(tf.done)
 }
 
-//lint:ignore U1000 implementation in progress
 func (fe *FilecoinExchange) subscriber(event datatransfer.Event, channelState datatransfer.ChannelState) {
 	// Copy chanid so it can be used later in the callback
 	fe.transfersLk.RLock()
@@ -98,6 +193,8 @@ func (fe *FilecoinExchange) subscriber(event datatransfer.Event, channelState da
 		return
 	}
 	fe.transfersLk.RUnlock()
+	tf.lk.Lock()
+	defer tf.lk.Unlock()
 	if tf.events == nil {
 		return
 	}
@@ -126,12 +223,24 @@ func (fe *FilecoinExchange) subscriber(event datatransfer.Event, channelState da
 			case retrievalmarket.DealStatusAccepted:
 				log.Info("deal accepted")
 
-			// Respond with a payment voucher when funds are requested
-			case retrievalmarket.DealStatusFundsNeeded:
+			// Respond with a payment voucher when funds are requested, either for
+			// unsealing or for data sent.
+			case retrievalmarket.DealStatusFundsNeeded, retrievalmarket.DealStatusFundsNeededUnseal:
 				if tf.pchRequired {
 					log.Infof("sending payment voucher (nonce: %v, amount: %v)", tf.nonce, resType.PaymentOwed)
 
-					tf.totalPayment = big.Add(tf.totalPayment, resType.PaymentOwed)
+					// the miner is owed no more than the agreed price of what it has
+					// sent, and of unsealing.
+					total := big.Add(tf.totalPayment, resType.PaymentOwed)
+					if owed := tf.owed(channelState.Received()); total.GreaterThan(owed) {
+						finishWithError(tf, fmt.Errorf("miner requested %s in total, but is owed %s for %d bytes", total, owed, channelState.Received()))
+						return
+					}
+					if err := fe.ledger.Reserve(tf.provider, tf.root, resType.PaymentOwed, total); err != nil {
+						finishWithError(tf, err)
+						return
+					}
+					tf.totalPayment = total
 
 					vres, err := fe.paymentAPI.CreateVoucher(tf.ctx, tf.pchAddr, paych.SignedVoucher{
 						ChannelAddr: tf.pchAddr,
@@ -140,11 +249,13 @@ func (fe *FilecoinExchange) subscriber(event datatransfer.Event, channelState da
 						Amount:      tf.totalPayment,
 					})
 					if err != nil {
+						fe.ledger.Release(tf.provider, tf.root, resType.PaymentOwed)
 						finishWithError(tf, err)
 						return
 					}
 
 					if big.Cmp(vres.Shortfall, big.NewInt(0)) > 0 {
+						fe.ledger.Release(tf.provider, tf.root, resType.PaymentOwed)
 						finishWithError(tf, fmt.Errorf("not enough funds remaining in payment channel (shortfall = %s)", vres.Shortfall))
 						return
 					}
@@ -162,8 +273,6 @@ func (fe *FilecoinExchange) subscriber(event datatransfer.Event, channelState da
 				} else {
 					finishWithError(tf, fmt.Errorf("the miner requested payment even though this transaction was determined to be zero cost"))
 				}
-			case retrievalmarket.DealStatusFundsNeededUnseal:
-				finishWithError(tf, fmt.Errorf("received unexpected payment request for unsealing data"))
 			case retrievalmarket.DealStatusRejected:
 				log.Warnf("deal rejected: %s", resType.Message)
 				finishWithError(tf, fmt.Errorf("deal rejected: %s", resType.Message))
@@ -176,8 +285,7 @@ func (fe *FilecoinExchange) subscriber(event datatransfer.Event, channelState da
 	case datatransfer.DataReceived:
 		// Ignore this
 	case datatransfer.FinishTransfer:
-		close(tf.events)
-		tf.events = nil
+		finish(tf)
 	case datatransfer.Cancel:
 		finishWithError(tf, fmt.Errorf("data transfer canceled"))
 	default:
@@ -190,80 +298,135 @@ func (fe *FilecoinExchange) Code() multicodec.Code {
 }
 
 func singleTerminalError(err error) <-chan exchange.EventData {
-	resultChan := make(chan exchange.EventData)
+	resultChan := make(chan exchange.EventData, 1)
 	resultChan <- exchange.EventData{Event: exchange.FailureEvent, State: err}
 	close(resultChan)
 	return resultChan
 }
 
 func (fe *FilecoinExchange) RequestData(ctx context.Context, root ipld.Link, selector ipld.Node, routingProvider interface{}, routingPayload interface{}) <-chan exchange.EventData {
-
-	var tf transfer
-
 	ai, ok := routingProvider.(peer.AddrInfo)
 	if !ok {
 		return singleTerminalError(fmt.Errorf("routing provider is not in expected format"))
 	}
+	filData, ok := routingPayload.(*metadata.GraphsyncFilecoinV1)
+	if !ok {
+		return singleTerminalError(fmt.Errorf("invalid routing payload"))
+	}
+	rootLink, ok := root.(cidlink.Link)
+	if !ok {
+		return singleTerminalError(fmt.Errorf("unsupported link type: %T", root))
+	}
 
+	tf := &transfer{
+		ctx:      ctx,
+		provider: ai.ID,
+		root:     rootLink.Cid,
+		events:   make(chan exchange.EventData),
+		done:     make(chan struct{}),
+	}
+	if l, ok := exchange.SessionRoot(ctx); ok {
+		if cl, ok := l.(cidlink.Link); ok {
+			tf.root = cl.Cid
+		}
+	}
+	// querying the miner and setting up payment may take long, even on chain,
+	// so the request is returned before they are done.
+	go fe.retrieve(tf, ai, rootLink.Cid, selector, filData)
+	return tf.events
+}
+
+// retrieve agrees terms for tf with the miner, opens its data transfer and
+// follows it until it ends.
+func (fe *FilecoinExchange) retrieve(tf *transfer, ai peer.AddrInfo, payloadCid cid.Cid, selector ipld.Node, filData *metadata.GraphsyncFilecoinV1) {
+	ctx := tf.ctx
 	fe.host.Peerstore().AddAddrs(ai.ID, ai.Addrs, peerstore.TempAddrTTL)
 	miner := ai.ID
 
-	filData, ok := routingPayload.(*metadata.GraphsyncFilecoinV1)
-	if !ok {
-		return singleTerminalError(fmt.Errorf("invalid routing payload"))
+	// ask the miner for its current terms for this piece
+	ask, err := fe.querier.Query(ctx, miner, retrievalmarket.NewQueryV1(payloadCid, &filData.PieceCID))
+	if err != nil {
+		finishWithError(tf, fmt.Errorf("failed to query miner: %w", err))
+		return
 	}
-	if !filData.FastRetrieval && !filData.VerifiedDeal {
-		return singleTerminalError(fmt.Errorf("err not implemented"))
+	if ask.Status != retrievalmarket.QueryResponseAvailable {
+		finishWithError(tf, fmt.Errorf("miner will not serve retrieval: %s", ask.Message))
+		return
 	}
 
-	// params hardcoded for free retrieval request
 	params, err := retrievalmarket.NewParamsV1(
-		big.NewInt(0),
-		0,
-		0,
+		ask.MinPricePerByte,
+		ask.MaxPaymentInterval,
+		ask.MaxPaymentIntervalIncrease,
 		selector,
 		&filData.PieceCID,
-		big.NewInt(0),
+		ask.UnsealPrice,
 	)
-
 	if err != nil {
-		return singleTerminalError(err)
+		finishWithError(tf, err)
+		return
 	}
 
 	tf.proposal = retrievalmarket.DealProposal{
-		PayloadCID: root.(cidlink.Link).Cid,
+		PayloadCID: payloadCid,
 		ID:         retrievalmarket.DealID(rand.Int63n(1000000) + 100000),
 		Params:     params,
 	}
 
 	log.Infof("starting retrieval with miner: %s", miner)
 
-	// Stats
-
 	tf.pchRequired = !(tf.proposal.PricePerByte.Int != nil && tf.proposal.PricePerByte.IsZero()) || !(tf.proposal.UnsealPrice.Int != nil && tf.proposal.UnsealPrice.IsZero())
 
 	if tf.pchRequired {
+		if fe.paymentAPI == nil {
+			finishWithError(tf, fmt.Errorf("miner requires payment, but no payment api is configured"))
+			return
+		}
+		tf.totalPayment = big.Zero()
 		// Get the payment channel and create a lane for this retrieval
-		tf.pchAddr, err = fe.paymentAPI.GetPaychWithMinFunds(ctx, address.Address{})
+		tf.pchAddr, err = fe.paymentAPI.GetPaychWithMinFunds(ctx, ask.PaymentAddress)
 		if err != nil {
-			return singleTerminalError(fmt.Errorf("failed to get payment channel: %w", err))
+			finishWithError(tf, fmt.Errorf("failed to get payment channel: %w", err))
+			return
 		}
 		tf.pchLane, err = fe.paymentAPI.AllocateLane(ctx, tf.pchAddr)
 		if err != nil {
-			return singleTerminalError(fmt.Errorf("failed to allocate lane: %w", err))
+			finishWithError(tf, fmt.Errorf("failed to allocate lane: %w", err))
+			return
 		}
 	}
 
+	// events for the channel wait until it is known as a transfer.
 	fe.transfersLk.Lock()
-	defer fe.transfersLk.Unlock()
 	chid, err := fe.dataTransfer.OpenPullDataChannel(ctx, miner, &tf.proposal, tf.proposal.PayloadCID, selector)
 	if err != nil {
-		return singleTerminalError(err)
+		fe.transfersLk.Unlock()
+		finishWithError(tf, err)
+		return
 	}
-	tf.ctx = ctx
-	tf.events = make(chan exchange.EventData)
-	fe.transfers[chid] = &tf
-	return tf.events
+	fe.transfers[chid] = tf
+	fe.transfersLk.Unlock()
+	fe.watch(tf, chid)
+}
+
+// watch ends the transfer on chid once its context is cancelled, as the data
+// transfer runs on regardless once its channel is open.
+func (fe *FilecoinExchange) watch(tf *transfer, chid datatransfer.ChannelID) {
+	select {
+	case <-tf.done:
+	case <-tf.ctx.Done():
+		tf.lk.Lock()
+		if tf.events != nil {
+			finishWithError(tf, tf.ctx.Err())
+		}
+		tf.lk.Unlock()
+		if err := fe.dataTransfer.CloseDataTransferChannel(context.Background(), chid); err != nil {
+			log.Debugf("failed to close data transfer channel %s: %s", chid, err)
+		}
+	}
+	fe.transfersLk.Lock()
+	delete(fe.transfers, chid)
+	fe.transfersLk.Unlock()
 }
 
 // cancel subscription to data transfer.
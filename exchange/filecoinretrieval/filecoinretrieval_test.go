@@ -0,0 +1,450 @@
+package filecoinretrieval_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/index-provider/metadata"
+	"github.com/ipfs-shipyard/w3rc/exchange"
+	"github.com/ipfs-shipyard/w3rc/exchange/filecoinretrieval"
+	mockpaymentapi "github.com/ipfs-shipyard/w3rc/exchange/filecoinretrieval/mock"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// fakeDataTransfer records the calls a FilecoinExchange makes, and lets the
+// test deliver data transfer events to it.
+type fakeDataTransfer struct {
+	datatransfer.Manager
+
+	lk         sync.Mutex
+	subscriber datatransfer.Subscriber
+	proposal   *retrievalmarket.DealProposal
+	payments   []*retrievalmarket.DealPayment
+	closed     []datatransfer.ChannelID
+	// opened is closed once a data transfer channel is opened.
+	opened chan struct{}
+}
+
+func (f *fakeDataTransfer) RegisterVoucherResultType(datatransfer.VoucherResult) error { return nil }
+
+func (f *fakeDataTransfer) SubscribeToEvents(s datatransfer.Subscriber) datatransfer.Unsubscribe {
+	f.subscriber = s
+	return func() {}
+}
+
+func (f *fakeDataTransfer) OpenPullDataChannel(_ context.Context, to peer.ID, voucher datatransfer.Voucher, _ cid.Cid, _ ipld.Node) (datatransfer.ChannelID, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.proposal = voucher.(*retrievalmarket.DealProposal)
+	select {
+	case <-f.opened:
+	default:
+		close(f.opened)
+	}
+	return testChannel(to), nil
+}
+
+func (f *fakeDataTransfer) SendVoucher(_ context.Context, _ datatransfer.ChannelID, voucher datatransfer.Voucher) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.payments = append(f.payments, voucher.(*retrievalmarket.DealPayment))
+	return nil
+}
+
+func (f *fakeDataTransfer) CloseDataTransferChannel(_ context.Context, chid datatransfer.ChannelID) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.closed = append(f.closed, chid)
+	return nil
+}
+
+func (f *fakeDataTransfer) closedChannels() []datatransfer.ChannelID {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return append([]datatransfer.ChannelID(nil), f.closed...)
+}
+
+func testChannel(p peer.ID) datatransfer.ChannelID {
+	return datatransfer.ChannelID{Responder: p, ID: 1}
+}
+
+type fakeChannelState struct {
+	datatransfer.ChannelState
+	chid     datatransfer.ChannelID
+	status   datatransfer.Status
+	result   datatransfer.VoucherResult
+	received uint64
+}
+
+func (f fakeChannelState) ChannelID() datatransfer.ChannelID             { return f.chid }
+func (f fakeChannelState) Status() datatransfer.Status                   { return f.status }
+func (f fakeChannelState) LastVoucherResult() datatransfer.VoucherResult { return f.result }
+func (f fakeChannelState) Received() uint64                              { return f.received }
+
+type fakeQuerier struct {
+	response retrievalmarket.QueryResponse
+	// hold, if set, delays answers until it is closed.
+	hold chan struct{}
+}
+
+func (f *fakeQuerier) Query(ctx context.Context, _ peer.ID, _ retrievalmarket.Query) (retrievalmarket.QueryResponse, error) {
+	if f.hold != nil {
+		select {
+		case <-f.hold:
+		case <-ctx.Done():
+			return retrievalmarket.QueryResponseUndefined, ctx.Err()
+		}
+	}
+	return f.response, nil
+}
+
+func testPayload(t *testing.T) (cid.Cid, *metadata.GraphsyncFilecoinV1) {
+	mh, err := multihash.Sum([]byte("payload"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := cid.NewCidV1(uint64(multicodec.Raw), mh)
+	mh, err = multihash.Sum([]byte("piece"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload, &metadata.GraphsyncFilecoinV1{PieceCID: cid.NewCidV1(uint64(multicodec.FilCommitmentUnsealed), mh)}
+}
+
+func paidAsk(t *testing.T) retrievalmarket.QueryResponse {
+	payTo, err := address.NewIDAddress(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return retrievalmarket.QueryResponse{
+		Status:                     retrievalmarket.QueryResponseAvailable,
+		PaymentAddress:             payTo,
+		MinPricePerByte:            abi.NewTokenAmount(2),
+		MaxPaymentInterval:         100,
+		MaxPaymentIntervalIncrease: 100,
+		UnsealPrice:                abi.NewTokenAmount(10),
+	}
+}
+
+// retrieve starts a retrieval, delivers the given deal responses, each once
+// the miner has sent received bytes, followed by completion, and returns the
+// final exchange event.
+func retrieve(ctx context.Context, t *testing.T, fex *filecoinretrieval.FilecoinExchange, dt *fakeDataTransfer, received uint64, responses ...retrievalmarket.DealResponse) exchange.EventData {
+	mn := mocknet.New()
+	defer mn.Close()
+	miner, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, md := testPayload(t)
+	provider := peer.AddrInfo{ID: miner.ID(), Addrs: miner.Addrs()}
+	evs := fex.RequestData(ctx, cidlink.Link{Cid: payload}, selectorparse.CommonSelector_ExploreAllRecursively, provider, md)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		// the channel is opened once terms are agreed with the miner.
+		select {
+		case <-dt.opened:
+		case <-stop:
+			return
+		}
+		chid := testChannel(miner.ID())
+		for i := range responses {
+			dt.subscriber(datatransfer.Event{Code: datatransfer.NewVoucherResult}, fakeChannelState{chid: chid, status: datatransfer.Ongoing, result: &responses[i], received: received})
+		}
+		dt.subscriber(datatransfer.Event{Code: datatransfer.FinishTransfer}, fakeChannelState{chid: chid, status: datatransfer.Completed})
+	}()
+
+	var last exchange.EventData
+	for ev := range evs {
+		last = ev
+		if ev.Event == exchange.FailureEvent {
+			break
+		}
+	}
+	return last
+}
+
+func newExchange(t *testing.T, api filecoinretrieval.PaymentAPI, ask retrievalmarket.QueryResponse, opts ...filecoinretrieval.Option) (*filecoinretrieval.FilecoinExchange, *fakeDataTransfer) {
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt := &fakeDataTransfer{opened: make(chan struct{})}
+	opts = append(opts, filecoinretrieval.WithQuerier(&fakeQuerier{response: ask}))
+	fex := filecoinretrieval.NewFilecoinExchange(api, h, dt, opts...)
+	return fex, dt
+}
+
+func TestPaidRetrieval(t *testing.T) {
+	api := mockpaymentapi.New(abi.NewTokenAmount(1000))
+	ask := paidAsk(t)
+	fex, dt := newExchange(t, api, ask)
+
+	last := retrieve(context.Background(), t, fex, dt, 200,
+		retrievalmarket.DealResponse{Status: retrievalmarket.DealStatusFundsNeededUnseal, PaymentOwed: abi.NewTokenAmount(10)},
+		retrievalmarket.DealResponse{Status: retrievalmarket.DealStatusFundsNeeded, PaymentOwed: abi.NewTokenAmount(200)},
+		retrievalmarket.DealResponse{Status: retrievalmarket.DealStatusFundsNeeded, PaymentOwed: abi.NewTokenAmount(200)},
+	)
+	if last.Event != exchange.SuccessEvent {
+		t.Fatalf("expected successful retrieval, got %v (%v)", last.Event, last.State)
+	}
+
+	if !dt.proposal.PricePerByte.Equals(ask.MinPricePerByte) || !dt.proposal.UnsealPrice.Equals(ask.UnsealPrice) {
+		t.Fatalf("proposal does not match ask: %+v", dt.proposal.Params)
+	}
+	if dt.proposal.PaymentInterval != ask.MaxPaymentInterval {
+		t.Fatalf("expected payment interval %d, got %d", ask.MaxPaymentInterval, dt.proposal.PaymentInterval)
+	}
+
+	if len(dt.payments) != 3 {
+		t.Fatalf("expected 3 payments, got %d", len(dt.payments))
+	}
+	want := []int64{10, 210, 410}
+	for i, p := range dt.payments {
+		if !p.PaymentVoucher.Amount.Equals(big.NewInt(want[i])) {
+			t.Fatalf("payment %d: expected cumulative amount %d, got %s", i, want[i], p.PaymentVoucher.Amount)
+		}
+		if p.PaymentVoucher.Nonce != uint64(i) {
+			t.Fatalf("payment %d: unexpected nonce %d", i, p.PaymentVoucher.Nonce)
+		}
+	}
+	if vouchers := api.Vouchers(dt.payments[0].PaymentChannel); len(vouchers) != 3 {
+		t.Fatalf("expected payment api to record 3 vouchers, got %d", len(vouchers))
+	}
+}
+
+func TestPaidRetrievalShortfall(t *testing.T) {
+	api := mockpaymentapi.New(abi.NewTokenAmount(100))
+	fex, dt := newExchange(t, api, paidAsk(t))
+
+	last := retrieve(context.Background(), t, fex, dt, 100,
+		retrievalmarket.DealResponse{Status: retrievalmarket.DealStatusFundsNeeded, PaymentOwed: abi.NewTokenAmount(200)},
+	)
+	if last.Event != exchange.FailureEvent {
+		t.Fatalf("expected retrieval to fail, got %v", last.Event)
+	}
+	if len(dt.payments) != 0 {
+		t.Fatalf("expected no payment to be sent, got %d", len(dt.payments))
+	}
+}
+
+func TestPaidRetrievalOverAsked(t *testing.T) {
+	api := mockpaymentapi.New(abi.NewTokenAmount(1000))
+	fex, dt := newExchange(t, api, paidAsk(t))
+
+	// 100 bytes at 2 per byte, with unsealing at 10, come to 210.
+	last := retrieve(context.Background(), t, fex, dt, 100,
+		retrievalmarket.DealResponse{Status: retrievalmarket.DealStatusFundsNeededUnseal, PaymentOwed: abi.NewTokenAmount(10)},
+		retrievalmarket.DealResponse{Status: retrievalmarket.DealStatusFundsNeeded, PaymentOwed: abi.NewTokenAmount(200)},
+		retrievalmarket.DealResponse{Status: retrievalmarket.DealStatusFundsNeeded, PaymentOwed: abi.NewTokenAmount(200)},
+	)
+	if last.Event != exchange.FailureEvent {
+		t.Fatalf("expected retrieval to fail, got %v", last.Event)
+	}
+	if len(dt.payments) != 2 {
+		t.Fatalf("expected only the payments owed to be sent, got %d", len(dt.payments))
+	}
+}
+
+func TestPaidRetrievalWithoutPaymentAPI(t *testing.T) {
+	fex, dt := newExchange(t, nil, paidAsk(t))
+
+	last := retrieve(context.Background(), t, fex, dt, 0)
+	if last.Event != exchange.FailureEvent {
+		t.Fatalf("expected retrieval to fail, got %v", last.Event)
+	}
+	if dt.proposal != nil {
+		t.Fatal("expected no data transfer to be opened")
+	}
+}
+
+func TestRetrievalBudget(t *testing.T) {
+	fundsNeeded := func(amount int64) retrievalmarket.DealResponse {
+		return retrievalmarket.DealResponse{Status: retrievalmarket.DealStatusFundsNeeded, PaymentOwed: abi.NewTokenAmount(amount)}
+	}
+	tests := map[string]struct {
+		ledger       *filecoinretrieval.Ledger
+		payments     []retrievalmarket.DealResponse
+		wantPaid     int
+		perRetrieval bool
+	}{
+		"WithinBudget": {
+			ledger:   filecoinretrieval.NewLedger(abi.NewTokenAmount(300), abi.NewTokenAmount(300)),
+			payments: []retrievalmarket.DealResponse{fundsNeeded(100), fundsNeeded(200)},
+			wantPaid: 2,
+		},
+		"OverRetrievalBudget": {
+			ledger:       filecoinretrieval.NewLedger(abi.TokenAmount{}, abi.NewTokenAmount(250)),
+			payments:     []retrievalmarket.DealResponse{fundsNeeded(100), fundsNeeded(200)},
+			wantPaid:     1,
+			perRetrieval: true,
+		},
+		"OverSessionBudget": {
+			ledger:   filecoinretrieval.NewLedger(abi.NewTokenAmount(50), abi.TokenAmount{}),
+			payments: []retrievalmarket.DealResponse{fundsNeeded(100)},
+			wantPaid: 0,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			api := mockpaymentapi.New(abi.NewTokenAmount(1000))
+			fex, dt := newExchange(t, api, paidAsk(t), filecoinretrieval.WithLedger(tt.ledger))
+
+			last := retrieve(context.Background(), t, fex, dt, 150, tt.payments...)
+			if len(dt.payments) != tt.wantPaid {
+				t.Fatalf("expected %d payments, got %d", tt.wantPaid, len(dt.payments))
+			}
+			report := tt.ledger.Report()
+			if tt.wantPaid == len(tt.payments) {
+				if last.Event != exchange.SuccessEvent {
+					t.Fatalf("expected successful retrieval, got %v (%v)", last.Event, last.State)
+				}
+				if !report.Total.Equals(abi.NewTokenAmount(300)) {
+					t.Fatalf("expected 300 spent, got %s", report.Total)
+				}
+				if len(report.ByProvider) != 1 || len(report.ByRoot) != 1 {
+					t.Fatalf("expected spend of a single provider and root, got %v", report)
+				}
+				return
+			}
+			overBudget, ok := last.State.(*filecoinretrieval.ErrOverBudget)
+			if last.Event != exchange.FailureEvent || !ok {
+				t.Fatalf("expected over budget failure, got %v (%v)", last.Event, last.State)
+			}
+			if overBudget.PerRetrieval != tt.perRetrieval {
+				t.Fatalf("unexpected budget exceeded: %s", overBudget)
+			}
+			if tt.wantPaid == 0 && !report.Total.IsZero() {
+				t.Fatalf("expected nothing spent, got %s", report.Total)
+			}
+		})
+	}
+}
+
+func TestRetrievalSpendBySessionRoot(t *testing.T) {
+	ledger := filecoinretrieval.NewLedger(abi.TokenAmount{}, abi.TokenAmount{})
+	api := mockpaymentapi.New(abi.NewTokenAmount(1000))
+	fex, dt := newExchange(t, api, paidAsk(t), filecoinretrieval.WithLedger(ledger))
+
+	// the request is narrowed to a subtree of the dag the session retrieves.
+	mh, err := multihash.Sum([]byte("session root"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := cid.NewCidV1(uint64(multicodec.DagCbor), mh)
+	ctx := exchange.WithSessionRoot(context.Background(), cidlink.Link{Cid: root})
+
+	last := retrieve(ctx, t, fex, dt, 100,
+		retrievalmarket.DealResponse{Status: retrievalmarket.DealStatusFundsNeeded, PaymentOwed: abi.NewTokenAmount(100)},
+	)
+	if last.Event != exchange.SuccessEvent {
+		t.Fatalf("expected successful retrieval, got %v (%v)", last.Event, last.State)
+	}
+	report := ledger.Report()
+	if len(report.ByRoot) != 1 || !report.ByRoot[root].Equals(abi.NewTokenAmount(100)) {
+		t.Fatalf("expected spend accounted to the session root, got %v", report.ByRoot)
+	}
+	if payload, _ := testPayload(t); dt.proposal.PayloadCID != payload {
+		t.Fatalf("expected the subtree to be requested, got %s", dt.proposal.PayloadCID)
+	}
+}
+
+func TestRetrievalCancelled(t *testing.T) {
+	api := mockpaymentapi.New(abi.NewTokenAmount(1000))
+	fex, dt := newExchange(t, api, paidAsk(t))
+	mn := mocknet.New()
+	defer mn.Close()
+	miner, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, md := testPayload(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	evs := fex.RequestData(ctx, cidlink.Link{Cid: payload}, selectorparse.CommonSelector_ExploreAllRecursively, peer.AddrInfo{ID: miner.ID(), Addrs: miner.Addrs()}, md)
+	<-dt.opened
+	cancel()
+
+	// the miner sends nothing more, so only cancellation ends the request.
+	var last exchange.EventData
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case ev, ok := <-evs:
+			if !ok {
+				done = true
+				break
+			}
+			last = ev
+		case <-timeout:
+			t.Fatal("expected the request to end once cancelled")
+		}
+	}
+	if err, _ := last.State.(error); last.Event != exchange.FailureEvent || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request to fail as cancelled, got %v (%v)", last.Event, last.State)
+	}
+	for start := time.Now(); len(dt.closedChannels()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected the data transfer channel to be closed")
+		}
+	}
+	if closed := dt.closedChannels(); len(closed) != 1 || closed[0] != testChannel(miner.ID()) {
+		t.Fatalf("unexpected channels closed %v", closed)
+	}
+}
+
+func TestRequestDataReturnsBeforeQuery(t *testing.T) {
+	mn := mocknet.New()
+	defer mn.Close()
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	miner, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt := &fakeDataTransfer{opened: make(chan struct{})}
+	// the miner does not answer its query until the request is cancelled.
+	querier := &fakeQuerier{response: paidAsk(t), hold: make(chan struct{})}
+	defer close(querier.hold)
+	fex := filecoinretrieval.NewFilecoinExchange(mockpaymentapi.New(abi.NewTokenAmount(1000)), h, dt, filecoinretrieval.WithQuerier(querier))
+
+	payload, md := testPayload(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	evs := fex.RequestData(ctx, cidlink.Link{Cid: payload}, selectorparse.CommonSelector_ExploreAllRecursively, peer.AddrInfo{ID: miner.ID(), Addrs: miner.Addrs()}, md)
+	cancel()
+
+	select {
+	case ev := <-evs:
+		if err, _ := ev.State.(error); ev.Event != exchange.FailureEvent || !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the request to fail as cancelled, got %v (%v)", ev.Event, ev.State)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the request to end once cancelled")
+	}
+	if _, ok := <-evs; ok {
+		t.Fatal("expected no further events")
+	}
+	if dt.proposal != nil {
+		t.Fatal("expected no data transfer to be opened")
+	}
+}
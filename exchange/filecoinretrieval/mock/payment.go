@@ -0,0 +1,116 @@
+package mockpaymentapi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v8/paych"
+	"github.com/ipfs-shipyard/w3rc/exchange/filecoinretrieval"
+)
+
+var _ filecoinretrieval.PaymentAPI = (*MockPaymentAPI)(nil)
+
+// A MockPaymentAPI is an in-memory PaymentAPI. Each payment channel it opens is
+// funded with the same fixed amount, and vouchers are accepted until the sum of
+// the latest voucher on every lane exceeds those funds.
+type MockPaymentAPI struct {
+	lk       sync.Mutex
+	funds    abi.TokenAmount
+	channels map[address.Address]*channel
+	byDest   map[address.Address]address.Address
+}
+
+type channel struct {
+	dest     address.Address
+	lanes    uint64
+	vouchers []*paych.SignedVoucher
+}
+
+// New creates a mock payment api funding each channel with funds.
+func New(funds abi.TokenAmount) *MockPaymentAPI {
+	return &MockPaymentAPI{
+		funds:    funds,
+		channels: make(map[address.Address]*channel),
+		byDest:   make(map[address.Address]address.Address),
+	}
+}
+
+// GetPaychWithMinFunds returns the channel to dest, creating it if needed.
+func (m *MockPaymentAPI) GetPaychWithMinFunds(_ context.Context, dest address.Address) (address.Address, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if ch, ok := m.byDest[dest]; ok {
+		return ch, nil
+	}
+	ch, err := address.NewIDAddress(uint64(1000 + len(m.channels)))
+	if err != nil {
+		return address.Undef, err
+	}
+	m.channels[ch] = &channel{dest: dest}
+	m.byDest[dest] = ch
+	return ch, nil
+}
+
+// AllocateLane allocates a new lane in a channel.
+func (m *MockPaymentAPI) AllocateLane(_ context.Context, payCh address.Address) (uint64, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	ch, ok := m.channels[payCh]
+	if !ok {
+		return 0, fmt.Errorf("unknown payment channel %s", payCh)
+	}
+	lane := ch.lanes
+	ch.lanes++
+	return lane, nil
+}
+
+// CreateVoucher records a voucher for the cumulative amount on its lane, or
+// reports a shortfall if the channel funds would be exceeded.
+func (m *MockPaymentAPI) CreateVoucher(_ context.Context, payCh address.Address, vouch paych.SignedVoucher) (*filecoinretrieval.VoucherCreateResult, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	ch, ok := m.channels[payCh]
+	if !ok {
+		return nil, fmt.Errorf("unknown payment channel %s", payCh)
+	}
+	if vouch.Lane >= ch.lanes {
+		return nil, fmt.Errorf("lane %d not allocated", vouch.Lane)
+	}
+	redeemed := big.Zero()
+	for lane, amount := range ch.laneAmounts() {
+		if lane != vouch.Lane {
+			redeemed = big.Add(redeemed, amount)
+		}
+	}
+	total := big.Add(redeemed, vouch.Amount)
+	if total.GreaterThan(m.funds) {
+		return &filecoinretrieval.VoucherCreateResult{Shortfall: big.Sub(total, m.funds)}, nil
+	}
+	v := vouch
+	ch.vouchers = append(ch.vouchers, &v)
+	return &filecoinretrieval.VoucherCreateResult{Voucher: &v, Shortfall: big.Zero()}, nil
+}
+
+// Vouchers returns the vouchers created for a channel, in order.
+func (m *MockPaymentAPI) Vouchers(payCh address.Address) []*paych.SignedVoucher {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	ch, ok := m.channels[payCh]
+	if !ok {
+		return nil
+	}
+	return append([]*paych.SignedVoucher{}, ch.vouchers...)
+}
+
+// laneAmounts is the amount of the latest voucher on each lane.
+func (ch *channel) laneAmounts() map[uint64]abi.TokenAmount {
+	amounts := make(map[uint64]abi.TokenAmount)
+	for _, v := range ch.vouchers {
+		amounts[v.Lane] = v.Amount
+	}
+	return amounts
+}
@@ -0,0 +1,319 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ipfs-shipyard/w3rc/exchange"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+)
+
+// Content types of trustless gateway responses.
+const (
+	ContentTypeCar = "application/vnd.ipld.car"
+	ContentTypeRaw = "application/vnd.ipld.raw"
+)
+
+// maxBlockSize bounds the size of a raw block read from a gateway.
+const maxBlockSize = 2 << 20
+
+// NewGatewayExchange creates an exchange fetching data from trustless HTTP gateways.
+// If client is nil, http.DefaultClient is used.
+func NewGatewayExchange(client *http.Client, lsys *ipld.LinkSystem) *GatewayExchange {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &GatewayExchange{
+		client: client,
+		lsys:   lsys,
+	}
+}
+
+// GatewayExchange retrieves blocks and CARs over HTTP, verifying every block
+// against its CID before it is written to the link system.
+type GatewayExchange struct {
+	client *http.Client
+	lsys   *ipld.LinkSystem
+}
+
+func (*GatewayExchange) Code() multicodec.Code {
+	return multicodec.TransportIpfsGatewayHttp
+}
+
+func singleTerminalError(err error) <-chan exchange.EventData {
+	resultChan := make(chan exchange.EventData, 1)
+	resultChan <- exchange.EventData{Event: exchange.FailureEvent, State: err}
+	close(resultChan)
+	return resultChan
+}
+
+func (ge *GatewayExchange) RequestData(ctx context.Context, root ipld.Link, selector ipld.Node, routingProvider interface{}, routingPayload interface{}) <-chan exchange.EventData {
+	ai, ok := routingProvider.(peer.AddrInfo)
+	if !ok {
+		return singleTerminalError(fmt.Errorf("routing provider is not in expected format"))
+	}
+	base, err := gatewayURL(ai)
+	if err != nil {
+		return singleTerminalError(err)
+	}
+	rootLink, ok := root.(cidlink.Link)
+	if !ok {
+		return singleTerminalError(fmt.Errorf("unsupported link type: %T", root))
+	}
+
+	respChan := make(chan exchange.EventData)
+	go ge.fetch(ctx, base, rootLink.Cid, newQuery(rootLink.Cid, selector), respChan)
+	return respChan
+}
+
+// A query is the part of a dag a trustless gateway request fetches: the blocks
+// along path, and those in scope where it ends.
+type query struct {
+	path  []string
+	scope string
+}
+
+// raw is true when the query is for the root block alone, which can then be
+// fetched without a CAR.
+func (q query) raw() bool {
+	return len(q.path) == 0 && q.scope == "block"
+}
+
+// newQuery maps a selector to a gateway query fetching at least what it
+// selects. A path of fields leading to a match or to everything below it maps
+// to the same path and a block or full scope; other selectors fetch the full
+// dag below what path of fields they start with.
+func newQuery(root cid.Cid, selector ipld.Node) query {
+	// gateways resolve paths through dag-pb nodes as UnixFS, so plain fields
+	// map to path segments only in other dags.
+	fields := root.Prefix().Codec != uint64(multicodec.DagPb)
+	var q query
+	for {
+		switch {
+		case selector == nil || datamodel.DeepEqual(selector, selectorparse.CommonSelector_MatchPoint):
+			q.scope = "block"
+			return q
+		case datamodel.DeepEqual(selector, selectorparse.CommonSelector_ExploreAllRecursively),
+			datamodel.DeepEqual(selector, selectorparse.CommonSelector_MatchAllRecursively):
+			q.scope = "all"
+			return q
+		}
+		unixfs := false
+		if next, ok := interpretAsUnixFS(selector); ok {
+			selector, unixfs = next, true
+		}
+		seg, next, ok := exploreField(selector)
+		if !ok || !(fields || unixfs) {
+			q.scope = "all"
+			return q
+		}
+		q.path = append(q.path, seg)
+		selector = next
+	}
+}
+
+// interpretAsUnixFS returns the selector under an ExploreInterpretAs with the
+// unixfs ADL.
+func interpretAsUnixFS(selector ipld.Node) (ipld.Node, bool) {
+	as, err := selector.LookupByString(ipldselector.SelectorKey_ExploreInterpretAs)
+	if err != nil {
+		return nil, false
+	}
+	adl, err := as.LookupByString(ipldselector.SelectorKey_As)
+	if err != nil {
+		return nil, false
+	}
+	if name, err := adl.AsString(); err != nil || name != "unixfs" {
+		return nil, false
+	}
+	next, err := as.LookupByString(ipldselector.SelectorKey_Next)
+	return next, err == nil
+}
+
+// exploreField returns the field and the selector applied under it when
+// selector explores a single field that can be a path segment.
+func exploreField(selector ipld.Node) (string, ipld.Node, bool) {
+	ef, err := selector.LookupByString(ipldselector.SelectorKey_ExploreFields)
+	if err != nil {
+		return "", nil, false
+	}
+	fields, err := ef.LookupByString(ipldselector.SelectorKey_Fields)
+	if err != nil || fields.Length() != 1 {
+		return "", nil, false
+	}
+	field, next, err := fields.MapIterator().Next()
+	if err != nil {
+		return "", nil, false
+	}
+	seg, err := field.AsString()
+	if err != nil || seg == "" || strings.Contains(seg, "/") {
+		return "", nil, false
+	}
+	return seg, next, true
+}
+
+func (ge *GatewayExchange) fetch(ctx context.Context, base *url.URL, root cid.Cid, q query, status chan exchange.EventData) {
+	defer close(status)
+	status <- exchange.EventData{Event: exchange.StartEvent, State: nil}
+
+	if err := ge.doFetch(ctx, base, root, q, status); err != nil {
+		status <- exchange.EventData{Event: exchange.FailureEvent, State: err}
+		return
+	}
+	status <- exchange.EventData{Event: exchange.SuccessEvent, State: cidlink.Link{Cid: root}}
+}
+
+func (ge *GatewayExchange) doFetch(ctx context.Context, base *url.URL, root cid.Cid, q query, status chan exchange.EventData) error {
+	raw := q.raw()
+	reqURL := *base
+	reqURL.Path = strings.TrimSuffix(reqURL.Path, "/") + "/ipfs/" + root.String()
+	for _, seg := range q.path {
+		reqURL.Path += "/" + seg
+	}
+	accept := ContentTypeCar
+	if raw {
+		accept = ContentTypeRaw
+		reqURL.RawQuery = url.Values{"format": []string{"raw"}}.Encode()
+	} else {
+		reqURL.RawQuery = url.Values{"format": []string{"car"}, "dag-scope": []string{q.scope}}.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", accept)
+	resp, err := ge.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gateway responded with %s", resp.Status)
+	}
+	if ct, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || ct != accept {
+		return fmt.Errorf("unexpected content type %q from gateway", resp.Header.Get("Content-Type"))
+	}
+
+	if raw {
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxBlockSize+1))
+		if err != nil {
+			return err
+		}
+		if len(data) > maxBlockSize {
+			return fmt.Errorf("block from gateway is larger than %d bytes", maxBlockSize)
+		}
+		hashed, err := root.Prefix().Sum(data)
+		if err != nil {
+			return err
+		}
+		if !hashed.Equals(root) {
+			return fmt.Errorf("mismatch in content integrity, expected: %s, got: %s", root, hashed)
+		}
+		var received uint64
+		return ge.store(ctx, root, data, &received, status)
+	}
+
+	// the block reader hashes each block and rejects any that does not match its CID.
+	br, err := car.NewBlockReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	if len(br.Roots) != 1 || !br.Roots[0].Equals(root) {
+		return fmt.Errorf("car from gateway has roots %v, expected %s", br.Roots, root)
+	}
+	var received uint64
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ge.store(ctx, blk.Cid(), blk.RawData(), &received, status); err != nil {
+			return err
+		}
+	}
+}
+
+// store writes a block, adding its size to received.
+func (ge *GatewayExchange) store(ctx context.Context, c cid.Cid, data []byte, received *uint64, status chan exchange.EventData) error {
+	w, commit, err := ge.lsys.StorageWriteOpener(ipld.LinkContext{Ctx: ctx})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	lnk := cidlink.Link{Cid: c}
+	if err := commit(lnk); err != nil {
+		return err
+	}
+	*received += uint64(len(data))
+	status <- exchange.EventData{Event: exchange.ProgressEvent, State: exchange.Progress{Link: lnk, Bytes: *received}}
+	return nil
+}
+
+// gatewayURL finds the first address of the provider that can be reached over http(s).
+func gatewayURL(ai peer.AddrInfo) (*url.URL, error) {
+	for _, addr := range ai.Addrs {
+		if u, err := toURL(addr); err == nil {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("no http address for provider %s", ai.ID)
+}
+
+func toURL(addr multiaddr.Multiaddr) (*url.URL, error) {
+	var host, port, scheme string
+	tls := false
+	multiaddr.ForEach(addr, func(c multiaddr.Component) bool {
+		switch c.Protocol().Code {
+		case multiaddr.P_IP4, multiaddr.P_IP6, multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6:
+			host = c.Value()
+		case multiaddr.P_TCP:
+			port = c.Value()
+		case multiaddr.P_TLS:
+			tls = true
+		case multiaddr.P_HTTP:
+			scheme = "http"
+			if tls {
+				scheme = "https"
+			}
+		case multiaddr.P_HTTPS:
+			scheme = "https"
+		}
+		return true
+	})
+	if host == "" || scheme == "" {
+		return nil, fmt.Errorf("not an http address: %s", addr)
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return &url.URL{Scheme: scheme, Host: host}, nil
+}
+
+// Close releases idle connections held by the http client.
+func (ge *GatewayExchange) Close() {
+	ge.client.CloseIdleConnections()
+}
@@ -0,0 +1,280 @@
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipfs-shipyard/w3rc/exchange"
+	"github.com/ipfs-shipyard/w3rc/exchange/gateway"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p-core/peer"
+	p2ptestutil "github.com/libp2p/go-libp2p-testing/netutil"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/multiformats/go-multicodec"
+)
+
+var linkProto = cidlink.LinkPrototype{Prefix: cid.Prefix{
+	Version:  1,
+	Codec:    uint64(multicodec.DagCbor),
+	MhType:   uint64(multicodec.Sha2_256),
+	MhLength: -1,
+}}
+
+func newLinkSystem(store *memstore.Store) ipld.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(store)
+	lsys.SetWriteStorage(store)
+	return lsys
+}
+
+func buildDag(t *testing.T, lsys *ipld.LinkSystem) cid.Cid {
+	leaf, err := lsys.Store(ipld.LinkContext{}, linkProto, basicnode.NewString("leaf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := qp.BuildMap(basicnode.Prototype.Any, 1, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "leaf", qp.Link(leaf))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnk, err := lsys.Store(ipld.LinkContext{}, linkProto, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lnk.(cidlink.Link).Cid
+}
+
+// gatewaySelector selects what a trustless gateway serves for a path and
+// dag-scope.
+func gatewaySelector(path []string, scope string) ipld.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.Matcher()
+	if scope == "all" {
+		sel = ssb.ExploreRecursive(ipldselector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		next, field := sel, path[i]
+		sel = ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert(field, next)
+		})
+	}
+	return sel.Node()
+}
+
+// serveGateway answers trustless gateway requests from lsys, sending each
+// request it answers on queries if that is set. If tamper is set, blocks are
+// served with altered content.
+func serveGateway(t *testing.T, lsys *ipld.LinkSystem, tamper bool, queries chan<- *http.Request) (*httptest.Server, peer.AddrInfo) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if queries != nil {
+			queries <- r
+		}
+		segs := strings.Split(strings.TrimPrefix(r.URL.Path, "/ipfs/"), "/")
+		c, err := cid.Decode(segs[0])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Query().Get("format") {
+		case "car":
+			var buf bytes.Buffer
+			if _, err := car.TraverseV1(r.Context(), lsys, c, gatewaySelector(segs[1:], r.URL.Query().Get("dag-scope")), &buf); err != nil {
+				t.Logf("failed to write car: %s", err)
+			}
+			data := buf.Bytes()
+			if tamper {
+				data[len(data)-1]++
+			}
+			w.Header().Set("Content-Type", gateway.ContentTypeCar)
+			_, _ = w.Write(data)
+		case "raw":
+			data, err := lsys.LoadRaw(ipld.LinkContext{}, cidlink.Link{Cid: c})
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if tamper {
+				data = append(data, 0)
+			}
+			w.Header().Set("Content-Type", gateway.ContentTypeRaw)
+			_, _ = w.Write(data)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+
+	tcpAddr, err := manet.FromNetAddr(srv.Listener.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := p2ptestutil.RandTestBogusIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, peer.AddrInfo{
+		ID:    p.ID(),
+		Addrs: []multiaddr.Multiaddr{tcpAddr.Encapsulate(multiaddr.StringCast("/http"))},
+	}
+}
+
+func drain(evs <-chan exchange.EventData) exchange.EventData {
+	var last exchange.EventData
+	for ev := range evs {
+		last = ev
+	}
+	return last
+}
+
+func TestGatewayCar(t *testing.T) {
+	source := memstore.Store{}
+	srcLsys := newLinkSystem(&source)
+	root := buildDag(t, &srcLsys)
+	srv, provider := serveGateway(t, &srcLsys, false, nil)
+	defer srv.Close()
+
+	dest := memstore.Store{}
+	destLsys := newLinkSystem(&dest)
+	ge := gateway.NewGatewayExchange(srv.Client(), &destLsys)
+
+	last := drain(ge.RequestData(context.Background(), cidlink.Link{Cid: root}, selectorparse.CommonSelector_ExploreAllRecursively, provider, nil))
+	if last.Event != exchange.SuccessEvent {
+		t.Fatalf("expected success, got %v (%v)", last.Event, last.State)
+	}
+	if len(dest.Bag) != 2 {
+		t.Fatalf("expected 2 blocks stored, got %d", len(dest.Bag))
+	}
+}
+
+func TestGatewayRaw(t *testing.T) {
+	source := memstore.Store{}
+	srcLsys := newLinkSystem(&source)
+	root := buildDag(t, &srcLsys)
+	srv, provider := serveGateway(t, &srcLsys, false, nil)
+	defer srv.Close()
+
+	dest := memstore.Store{}
+	destLsys := newLinkSystem(&dest)
+	ge := gateway.NewGatewayExchange(srv.Client(), &destLsys)
+
+	last := drain(ge.RequestData(context.Background(), cidlink.Link{Cid: root}, selectorparse.CommonSelector_MatchPoint, provider, nil))
+	if last.Event != exchange.SuccessEvent {
+		t.Fatalf("expected success, got %v (%v)", last.Event, last.State)
+	}
+	if len(dest.Bag) != 1 {
+		t.Fatalf("expected only the root block stored, got %d", len(dest.Bag))
+	}
+}
+
+func TestGatewayRejectsTamperedBlock(t *testing.T) {
+	source := memstore.Store{}
+	srcLsys := newLinkSystem(&source)
+	root := buildDag(t, &srcLsys)
+	srv, provider := serveGateway(t, &srcLsys, true, nil)
+	defer srv.Close()
+
+	dest := memstore.Store{}
+	destLsys := newLinkSystem(&dest)
+	ge := gateway.NewGatewayExchange(srv.Client(), &destLsys)
+
+	last := drain(ge.RequestData(context.Background(), cidlink.Link{Cid: root}, nil, provider, nil))
+	if last.Event != exchange.FailureEvent {
+		t.Fatalf("expected failure, got %v", last.Event)
+	}
+	if len(dest.Bag) != 0 {
+		t.Fatalf("expected nothing stored, got %d blocks", len(dest.Bag))
+	}
+}
+
+func TestGatewayPathScope(t *testing.T) {
+	source := memstore.Store{}
+	srcLsys := newLinkSystem(&source)
+	root := buildDag(t, &srcLsys)
+	queries := make(chan *http.Request, 1)
+	srv, provider := serveGateway(t, &srcLsys, false, queries)
+	defer srv.Close()
+
+	dest := memstore.Store{}
+	destLsys := newLinkSystem(&dest)
+	ge := gateway.NewGatewayExchange(srv.Client(), &destLsys)
+
+	last := drain(ge.RequestData(context.Background(), cidlink.Link{Cid: root}, gatewaySelector([]string{"leaf"}, "block"), provider, nil))
+	if last.Event != exchange.SuccessEvent {
+		t.Fatalf("expected success, got %v (%v)", last.Event, last.State)
+	}
+	r := <-queries
+	if r.URL.Path != "/ipfs/"+root.String()+"/leaf" || r.URL.Query().Get("dag-scope") != "block" {
+		t.Fatalf("expected the path with a block scope to be requested, got %s", r.URL)
+	}
+	if len(dest.Bag) != 2 {
+		t.Fatalf("expected the blocks along the path stored, got %d", len(dest.Bag))
+	}
+}
+
+func TestGatewayRejectsTamperedCar(t *testing.T) {
+	source := memstore.Store{}
+	srcLsys := newLinkSystem(&source)
+	root := buildDag(t, &srcLsys)
+	srv, provider := serveGateway(t, &srcLsys, true, nil)
+	defer srv.Close()
+
+	dest := memstore.Store{}
+	destLsys := newLinkSystem(&dest)
+	ge := gateway.NewGatewayExchange(srv.Client(), &destLsys)
+
+	last := drain(ge.RequestData(context.Background(), cidlink.Link{Cid: root}, selectorparse.CommonSelector_ExploreAllRecursively, provider, nil))
+	if last.Event != exchange.FailureEvent {
+		t.Fatalf("expected failure, got %v", last.Event)
+	}
+	if len(dest.Bag) != 1 {
+		t.Fatalf("expected only the untampered root stored, got %d blocks", len(dest.Bag))
+	}
+}
+
+func TestGatewayRejectsCarForOtherRoot(t *testing.T) {
+	source := memstore.Store{}
+	srcLsys := newLinkSystem(&source)
+	root := buildDag(t, &srcLsys)
+	srv, provider := serveGateway(t, &srcLsys, false, nil)
+	defer srv.Close()
+
+	// a car for another dag is made up of valid blocks, but not the one asked for.
+	other, err := srcLsys.Store(ipld.LinkContext{}, linkProto, basicnode.NewString("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", gateway.ContentTypeCar)
+		if _, err := car.TraverseV1(r.Context(), &srcLsys, other.(cidlink.Link).Cid, selectorparse.CommonSelector_ExploreAllRecursively, w); err != nil {
+			t.Logf("failed to write car: %s", err)
+		}
+	})
+
+	dest := memstore.Store{}
+	destLsys := newLinkSystem(&dest)
+	ge := gateway.NewGatewayExchange(srv.Client(), &destLsys)
+
+	last := drain(ge.RequestData(context.Background(), cidlink.Link{Cid: root}, selectorparse.CommonSelector_ExploreAllRecursively, provider, nil))
+	if last.Event != exchange.FailureEvent {
+		t.Fatalf("expected failure, got %v", last.Event)
+	}
+	if len(dest.Bag) != 0 {
+		t.Fatalf("expected nothing stored, got %d blocks", len(dest.Bag))
+	}
+}
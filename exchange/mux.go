@@ -16,32 +16,41 @@ type MuxEvent struct {
 	EventData
 }
 
+// ExchangeMux dispatches transport requests to the registered exchange for
+// their codec, and merges the resulting events into a single stream.
 type ExchangeMux struct {
 	knownCodecs map[multicodec.Code]Exchange
 	mux         chan MuxEvent
-	wg          sync.WaitGroup
-	started     sync.Once
+
+	lk sync.Mutex
+	// cancels end the requests still running, each on its own.
+	cancels map[*planning.TransportRequest]context.CancelFunc
 }
 
 func DefaultMux() *ExchangeMux {
 	em := ExchangeMux{
 		knownCodecs: make(map[multicodec.Code]Exchange),
 		mux:         make(chan MuxEvent),
-		wg:          sync.WaitGroup{},
+		cancels:     make(map[*planning.TransportRequest]context.CancelFunc),
 	}
-	em.wg.Add(1)
 	return &em
 }
 
-func (e *ExchangeMux) start() {
-	e.wg.Done()
-}
-
-func (e *ExchangeMux) forward(tr *planning.TransportRequest, c <-chan EventData) {
+func (e *ExchangeMux) forward(ctx context.Context, tr *planning.TransportRequest, c <-chan EventData) {
 	for n := range c {
-		e.mux <- MuxEvent{tr, n}
+		select {
+		case e.mux <- MuxEvent{tr, n}:
+		case <-ctx.Done():
+			// keep draining so the exchange is not blocked once the subscriber is gone.
+		}
+	}
+	e.lk.Lock()
+	cancel := e.cancels[tr]
+	delete(e.cancels, tr)
+	e.lk.Unlock()
+	if cancel != nil {
+		cancel()
 	}
-	e.wg.Done()
 }
 
 func (e *ExchangeMux) Register(ex Exchange) error {
@@ -54,18 +63,33 @@ func (e *ExchangeMux) Add(ctx context.Context, tr *planning.TransportRequest) er
 	if !ok {
 		return ErrUnknownCodec
 	}
-	evs := ex.RequestData(ctx, tr.Root, tr.Selector, tr.RoutingProvider, tr.RoutingPayload)
-	e.wg.Add(1)
-	e.started.Do(e.start)
-	go e.forward(tr, evs)
+	reqCtx, cancel := context.WithCancel(ctx)
+	e.lk.Lock()
+	e.cancels[tr] = cancel
+	e.lk.Unlock()
+	evs := ex.RequestData(reqCtx, tr.Root, tr.Selector, tr.RoutingProvider, tr.RoutingPayload)
+	go e.forward(ctx, tr, evs)
 
 	return nil
 }
 
+// Cancel ends a request added to the mux, leaving the others running. Its
+// exchange still ends the request with a FailureEvent, which is forwarded as
+// usual. Cancel is false if the request was not running.
+func (e *ExchangeMux) Cancel(tr *planning.TransportRequest) bool {
+	e.lk.Lock()
+	cancel, ok := e.cancels[tr]
+	delete(e.cancels, tr)
+	e.lk.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// Subscribe returns the merged stream of events for all requests added to the mux.
+// The stream is not closed: each request ends with either a SuccessEvent or a
+// FailureEvent, and subscribers are expected to track requests they have added.
 func (e *ExchangeMux) Subscribe() chan MuxEvent {
-	go func() {
-		e.wg.Wait()
-		close(e.mux)
-	}()
 	return e.mux
 }
@@ -0,0 +1,301 @@
+package w3rc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs-shipyard/w3rc/exchange"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+// readAhead is how far past a read the blocks of a file are fetched, so that
+// reading through a file takes few requests.
+const readAhead = 1 << 20
+
+// ErrNotFile is returned when a byte range is asked of a node that is not a
+// UnixFS file.
+var ErrNotFile = errors.New("not a unixfs file")
+
+// fileNode is the part of a UnixFS file held by a single block: the bytes in
+// the block itself, followed by those of each child in turn.
+type fileNode struct {
+	data     []byte
+	children []fileChild
+}
+
+type fileChild struct {
+	cid  cid.Cid
+	size int64
+}
+
+func (fn fileNode) size() int64 {
+	size := int64(len(fn.data))
+	for _, ch := range fn.children {
+		size += ch.size
+	}
+	return size
+}
+
+func decodeFileNode(n ipld.Node) (fileNode, error) {
+	if n.Kind() == datamodel.Kind_Bytes {
+		b, err := n.AsBytes()
+		return fileNode{data: b}, err
+	}
+	pbn, ok := n.(dagpb.PBNode)
+	if !ok || !pbn.FieldData().Exists() {
+		return fileNode{}, ErrNotFile
+	}
+	ud, err := data.DecodeUnixFSData(pbn.FieldData().Must().Bytes())
+	if err != nil {
+		return fileNode{}, err
+	}
+	if t := ud.FieldDataType().Int(); t != data.Data_File && t != data.Data_Raw {
+		return fileNode{}, ErrNotFile
+	}
+	var fn fileNode
+	if ud.FieldData().Exists() {
+		fn.data = ud.FieldData().Must().Bytes()
+	}
+	links, sizes := pbn.FieldLinks(), ud.FieldBlockSizes()
+	if links.Length() != sizes.Length() {
+		return fileNode{}, fmt.Errorf("malformed unixfs file: %d links, %d block sizes", links.Length(), sizes.Length())
+	}
+	for i := int64(0); i < links.Length(); i++ {
+		cl, ok := links.Lookup(i).FieldHash().Link().(cidlink.Link)
+		if !ok {
+			return fileNode{}, fmt.Errorf("malformed unixfs file: unsupported link")
+		}
+		fn.children = append(fn.children, fileChild{cid: cl.Cid, size: sizes.Lookup(i).Int()})
+	}
+	return fn, nil
+}
+
+// fetchFileNode loads the file block at c, fetching it first if need be.
+func (s *simpleSession) fetchFileNode(ctx context.Context, c cid.Cid) (fileNode, error) {
+	if err := s.fetch(ctx, c, selectorparse.CommonSelector_MatchPoint, nil); err != nil {
+		return fileNode{}, err
+	}
+	return s.loadFileNode(ctx, c)
+}
+
+// loadFileNode loads the file block at c from the session link system.
+func (s *simpleSession) loadFileNode(ctx context.Context, c cid.Cid) (fileNode, error) {
+	lnk := cidlink.Link{Cid: c}
+	lc := ipld.LinkContext{Ctx: ctx}
+	np, err := unixfsChooser(lnk, lc)
+	if err != nil {
+		return fileNode{}, err
+	}
+	n, err := s.ls.Load(lc, lnk, np)
+	if err != nil {
+		return fileNode{}, err
+	}
+	return decodeFileNode(n)
+}
+
+type fileSpan struct {
+	cid        cid.Cid
+	start, end int64
+}
+
+// fetchRange fetches the blocks of the UnixFS file at c holding the bytes from
+// start up to end. The file is fetched a level of its dag at a time: the
+// children wholly within the range are requested in full, along with the
+// blocks of those at its edges, which are then narrowed in turn.
+func (s *simpleSession) fetchRange(ctx context.Context, c cid.Cid, start, end int64) error {
+	spans := []fileSpan{{c, start, end}}
+	for len(spans) > 0 {
+		sp := spans[0]
+		spans = spans[1:]
+		fn, err := s.fetchFileNode(ctx, sp.cid)
+		if err != nil {
+			return err
+		}
+		var full, edges []int64
+		off := int64(len(fn.data))
+		for i, ch := range fn.children {
+			cs, ce := off, off+ch.size
+			off = ce
+			if ce <= sp.start || cs >= sp.end {
+				continue
+			}
+			if cs >= sp.start && ce <= sp.end {
+				full = append(full, int64(i))
+				continue
+			}
+			edges = append(edges, int64(i))
+			spans = append(spans, fileSpan{ch.cid, max64(sp.start, cs) - cs, min64(sp.end, ce) - cs})
+		}
+		if len(full) == 0 && len(edges) == 0 {
+			continue
+		}
+		if err := s.fetch(ctx, sp.cid, rangeSelector(full, edges), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeSelector selects the dags of the consecutive children full of a file
+// block, and the blocks of the children edges.
+func rangeSelector(full, edges []int64) datamodel.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	hash := func(next builder.SelectorSpec) builder.SelectorSpec {
+		return ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+			efsb.Insert("Hash", next)
+		})
+	}
+	var members []builder.SelectorSpec
+	if len(full) > 0 {
+		all := ssb.ExploreRecursive(ipldselector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+		members = append(members, ssb.ExploreRange(full[0], full[len(full)-1]+1, hash(all)))
+	}
+	for _, i := range edges {
+		members = append(members, ssb.ExploreIndex(i, hash(ssb.Matcher())))
+	}
+	links := members[0]
+	if len(members) > 1 {
+		links = ssb.ExploreUnion(members...)
+	}
+	return ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("Links", links)
+	}).Node()
+}
+
+func (s *simpleSession) GetRange(ctx context.Context, root cid.Cid, path string, start, end int64) (io.ReadSeeker, error) {
+	ctx = exchange.WithSessionRoot(ctx, cidlink.Link{Cid: root})
+	getCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.fetchPath(getCtx, root, path, selectorparse.CommonSelector_MatchPoint)
+	c, within, err := s.walkPath(getCtx, root, path)
+	if err != nil {
+		return nil, err
+	}
+	if within.Len() > 0 {
+		// files are the whole of a block.
+		return nil, ErrNotFile
+	}
+	fn, err := s.fetchFileNode(getCtx, c)
+	if err != nil {
+		return nil, err
+	}
+	fr := &fileReader{ctx: ctx, s: s, root: c, size: fn.size(), off: start}
+	if end < 0 || end > fr.size {
+		end = fr.size
+	}
+	if start < end {
+		if err := s.fetchRange(getCtx, c, start, end); err != nil {
+			return nil, err
+		}
+		fr.start, fr.end = start, end
+	}
+	return fr, nil
+}
+
+// fileReader reads a UnixFS file from the session link system, fetching the
+// blocks under each read that are not yet held.
+type fileReader struct {
+	ctx  context.Context
+	s    *simpleSession
+	root cid.Cid
+	size int64
+	off  int64
+	// start and end are the range most recently fetched.
+	start, end int64
+}
+
+func (fr *fileReader) Read(p []byte) (int, error) {
+	if fr.off >= fr.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > fr.size-fr.off {
+		p = p[:fr.size-fr.off]
+	}
+	ctx, cancel := context.WithCancel(fr.ctx)
+	defer cancel()
+	if fr.off < fr.start || fr.off+int64(len(p)) > fr.end {
+		end := min64(fr.off+max64(int64(len(p)), readAhead), fr.size)
+		if err := fr.s.fetchRange(ctx, fr.root, fr.off, end); err != nil {
+			return 0, err
+		}
+		fr.start, fr.end = fr.off, end
+	}
+	n, err := fr.readAt(ctx, fr.root, p, fr.off)
+	fr.off += int64(n)
+	return n, err
+}
+
+// readAt copies the bytes of the file block at c from off into p.
+func (fr *fileReader) readAt(ctx context.Context, c cid.Cid, p []byte, off int64) (int, error) {
+	fn, err := fr.s.loadFileNode(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	if off < int64(len(fn.data)) {
+		n = copy(p, fn.data[off:])
+	}
+	at := int64(len(fn.data))
+	for _, ch := range fn.children {
+		if n == len(p) {
+			break
+		}
+		if pos := off + int64(n); pos < at+ch.size {
+			want := min64(int64(len(p)-n), at+ch.size-pos)
+			read, err := fr.readAt(ctx, ch.cid, p[n:n+int(want)], pos-at)
+			n += read
+			if err != nil {
+				return n, err
+			}
+			// a short child would shift every byte after it.
+			if int64(read) < want {
+				return n, fmt.Errorf("malformed unixfs file: %s is smaller than its block size", ch.cid)
+			}
+		}
+		at += ch.size
+	}
+	return n, nil
+}
+
+func (fr *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += fr.off
+	case io.SeekEnd:
+		offset += fr.size
+	default:
+		return fr.off, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return fr.off, fmt.Errorf("negative offset %d", offset)
+	}
+	fr.off = offset
+	return offset, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
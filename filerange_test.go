@@ -0,0 +1,162 @@
+package w3rc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multicodec"
+)
+
+var rawProto = cidlink.LinkPrototype{Prefix: cid.Prefix{
+	Version:  1,
+	Codec:    uint64(multicodec.Raw),
+	MhType:   uint64(multicodec.Sha2_256),
+	MhLength: -1,
+}}
+
+var dagpbProto = cidlink.LinkPrototype{Prefix: cid.Prefix{
+	Version:  1,
+	Codec:    uint64(multicodec.DagPb),
+	MhType:   uint64(multicodec.Sha2_256),
+	MhLength: -1,
+}}
+
+// buildFile stores content as a balanced UnixFS file of chunk sized leaves,
+// with up to width links per node, returning its root.
+func buildFile(t *testing.T, lsys *ipld.LinkSystem, content []byte, chunk, width int) cid.Cid {
+	type sized struct {
+		lnk  ipld.Link
+		size uint64
+	}
+	var level []sized
+	for off := 0; off < len(content); off += chunk {
+		end := off + chunk
+		if end > len(content) {
+			end = len(content)
+		}
+		lnk, err := lsys.Store(ipld.LinkContext{}, rawProto, basicnode.NewBytes(content[off:end]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		level = append(level, sized{lnk, uint64(end - off)})
+	}
+	for len(level) > 1 {
+		var next []sized
+		for i := 0; i < len(level); i += width {
+			group := level[i:]
+			if len(group) > width {
+				group = group[:width]
+			}
+			sizes := make([]uint64, 0, len(group))
+			total := uint64(0)
+			for _, child := range group {
+				sizes = append(sizes, child.size)
+				total += child.size
+			}
+			ud, err := builder.BuildUnixFS(func(b *builder.Builder) {
+				builder.FileSize(b, total)
+				builder.BlockSizes(b, sizes)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := qp.BuildMap(dagpb.Type.PBNode, 2, func(ma datamodel.MapAssembler) {
+				qp.MapEntry(ma, "Links", qp.List(int64(len(group)), func(la datamodel.ListAssembler) {
+					for _, child := range group {
+						entry, _ := builder.BuildUnixFSDirectoryEntry("", int64(child.size), child.lnk)
+						qp.ListEntry(la, qp.Node(entry))
+					}
+				}))
+				qp.MapEntry(ma, "Data", qp.Bytes(data.EncodeUnixFSData(ud)))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			lnk, err := lsys.Store(ipld.LinkContext{}, dagpbProto, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next = append(next, sized{lnk, total})
+		}
+		level = next
+	}
+	return level[0].lnk.(cidlink.Link).Cid
+}
+
+func TestGetRange(t *testing.T) {
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(content)
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root := buildFile(t, &srcLsys, content, 256, 16)
+
+	dest := &syncStore{}
+	router := &testRouter{providers: []string{"a"}}
+	sess := newTestSession(dest, router, &selectorExchange{source: source, dest: dest})
+	ctx := context.Background()
+
+	rs, err := sess.GetRange(ctx, root, "", 1000, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range router.finds {
+		if c != root {
+			t.Fatalf("expected providers to be found only for the root, got a lookup for %s", c)
+		}
+	}
+	// the leaves holding the range, and the blocks above them.
+	fetched := len(dest.bag.Bag)
+	if fetched > 10 {
+		t.Fatalf("expected only the range to be fetched, got %d of %d blocks", fetched, len(source.bag.Bag))
+	}
+	// the reader starts at the range.
+	got := make([]byte, 1000)
+	if _, err := io.ReadFull(rs, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content[1000:2000]) {
+		t.Fatal("unexpected range content")
+	}
+
+	// reading elsewhere fetches what is needed as it goes.
+	rs, err = sess.GetRange(ctx, root, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.Seek(-100, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := io.ReadAll(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tail, content[len(content)-100:]) {
+		t.Fatal("unexpected tail content")
+	}
+	if len(dest.bag.Bag) > 2*fetched {
+		t.Fatalf("expected only the read ranges to be fetched, got %d of %d blocks", len(dest.bag.Bag), len(source.bag.Bag))
+	}
+
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	all, err := io.ReadAll(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(all, content) {
+		t.Fatal("unexpected file content")
+	}
+}
@@ -0,0 +1,46 @@
+package namesys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const dnslinkPrefix = "dnslink="
+
+// DNSLink resolves domain names through the dnslink TXT records of
+// _dnslink.<domain>, or else of the domain itself.
+type DNSLink struct {
+	// LookupTXT, if set, replaces the system resolver.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+// Resolve implements Resolver.
+func (d *DNSLink) Resolve(ctx context.Context, name string) (string, error) {
+	lookup := d.LookupTXT
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupTXT
+	}
+	var lastErr error
+	for _, domain := range []string{"_dnslink." + name, name} {
+		txts, err := lookup(ctx, domain)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				lastErr = err
+			}
+			continue
+		}
+		for _, txt := range txts {
+			if v := strings.TrimSpace(txt); strings.HasPrefix(v, dnslinkPrefix) {
+				return strings.TrimPrefix(v, dnslinkPrefix), nil
+			}
+		}
+	}
+	if lastErr != nil {
+		return "", lastErr
+	}
+	return "", fmt.Errorf("%s: %w", name, ErrNotFound)
+}
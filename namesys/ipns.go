@@ -0,0 +1,83 @@
+package namesys
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	ipns "github.com/ipfs/go-ipns"
+	pb "github.com/ipfs/go-ipns/pb"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// DefaultIPNSEndpoint is the delegated routing endpoint IPNS records are
+// fetched from when no other is configured.
+const DefaultIPNSEndpoint = "https://delegated-ipfs.dev"
+
+const (
+	ipnsPath          = "/routing/v1/ipns/"
+	contentTypeRecord = "application/vnd.ipfs.ipns-record"
+	// maxRecordSize is the largest IPNS record accepted, as in the IPNS spec.
+	maxRecordSize = 10 << 10
+)
+
+// IPNS resolves IPNS keys to the values of their records, as fetched from an
+// endpoint of the delegated routing v1 HTTP API. Records are verified against
+// the key before their value is used.
+type IPNS struct {
+	httpc   *http.Client
+	baseURL string
+}
+
+// NewIPNS makes an IPNS resolver fetching records from the endpoint at url.
+func NewIPNS(url string) (*IPNS, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid ipns endpoint %q", url)
+	}
+	return &IPNS{
+		httpc:   http.DefaultClient,
+		baseURL: strings.TrimSuffix(url, "/"),
+	}, nil
+}
+
+// Resolve implements Resolver. name is a peer id, in either its multihash or
+// its cid form.
+func (i *IPNS) Resolve(ctx context.Context, name string) (string, error) {
+	pid, err := peer.Decode(name)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, i.baseURL+ipnsPath+peer.ToCid(pid).String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", contentTypeRecord)
+	resp, err := i.httpc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", fmt.Errorf("%s: %w", name, ErrNotFound)
+	default:
+		return "", fmt.Errorf("ipns lookup of %s: %s", name, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRecordSize))
+	if err != nil {
+		return "", err
+	}
+	if err := (ipns.Validator{}).Validate(ipns.RecordKey(pid), data); err != nil {
+		return "", fmt.Errorf("ipns record of %s: %w", name, err)
+	}
+	var entry pb.IpnsEntry
+	if err := proto.Unmarshal(data, &entry); err != nil {
+		return "", err
+	}
+	return string(entry.GetValue()), nil
+}
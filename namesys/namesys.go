@@ -0,0 +1,118 @@
+// Package namesys resolves the mutable names found in /ipns/ paths, DNSLink
+// domains and IPNS keys, to the immutable paths they point to.
+package namesys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+)
+
+// MaxDepth bounds how many names are followed while resolving a path, as a
+// name may point to another.
+const MaxDepth = 32
+
+// ErrNotFound is returned when a name has no record.
+var ErrNotFound = errors.New("name not found")
+
+// ErrTooDeep is returned when resolving a path follows more than MaxDepth names.
+var ErrTooDeep = errors.New("too many names followed")
+
+// A Resolver looks up the value of a name, as a path under /ipfs/ or /ipns/.
+type Resolver interface {
+	Resolve(ctx context.Context, name string) (string, error)
+}
+
+// Map is a Resolver answering from a fixed set of names, as for tests.
+type Map map[string]string
+
+// Resolve implements Resolver.
+func (m Map) Resolve(_ context.Context, name string) (string, error) {
+	if v, ok := m[name]; ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("%s: %w", name, ErrNotFound)
+}
+
+// NewResolver resolves domain names through DNSLink, and other names as IPNS
+// keys through the delegated routing endpoint at ipnsURL.
+func NewResolver(ipnsURL string) (Resolver, error) {
+	ipns, err := NewIPNS(ipnsURL)
+	if err != nil {
+		return nil, err
+	}
+	return &multiResolver{dnslink: &DNSLink{}, ipns: ipns}, nil
+}
+
+type multiResolver struct {
+	dnslink Resolver
+	ipns    Resolver
+}
+
+func (m *multiResolver) Resolve(ctx context.Context, name string) (string, error) {
+	if strings.Contains(name, ".") {
+		return m.dnslink.Resolve(ctx, name)
+	}
+	return m.ipns.Resolve(ctx, name)
+}
+
+// ResolvePath resolves a content path to its root cid and the path remaining
+// under it. p may be a cid, optionally followed by a path, or a path under
+// /ipfs/ or /ipns/. Names under /ipns/ are looked up with r until an /ipfs/
+// path is reached.
+func ResolvePath(ctx context.Context, r Resolver, p string) (cid.Cid, datamodel.Path, error) {
+	rest := ""
+	for depth := 0; ; depth++ {
+		ns, name, tail := splitPath(p)
+		if tail != "" {
+			rest = joinPath(tail, rest)
+		}
+		switch ns {
+		case "ipfs":
+			c, err := cid.Decode(name)
+			if err != nil {
+				return cid.Undef, datamodel.Path{}, err
+			}
+			return c, datamodel.ParsePath(rest), nil
+		case "ipns":
+			if depth >= MaxDepth {
+				return cid.Undef, datamodel.Path{}, ErrTooDeep
+			}
+			v, err := r.Resolve(ctx, name)
+			if err != nil {
+				return cid.Undef, datamodel.Path{}, err
+			}
+			p = v
+		default:
+			return cid.Undef, datamodel.Path{}, fmt.Errorf("unsupported namespace %q", ns)
+		}
+	}
+}
+
+// splitPath splits a path into its namespace, the name within it, and the
+// remaining path. Paths without a namespace are taken to be under /ipfs/.
+func splitPath(p string) (ns, name, rest string) {
+	if !strings.HasPrefix(p, "/") {
+		p = "/ipfs/" + p
+	}
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 3)
+	ns = parts[0]
+	if len(parts) > 1 {
+		name = parts[1]
+	}
+	if len(parts) > 2 {
+		rest = strings.Trim(parts[2], "/")
+	}
+	return ns, name, rest
+}
+
+func joinPath(a, b string) string {
+	if b == "" {
+		return a
+	}
+	return a + "/" + b
+}
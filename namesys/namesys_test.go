@@ -0,0 +1,147 @@
+package namesys_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/ipfs-shipyard/w3rc/namesys"
+	"github.com/ipfs/go-cid"
+	ipns "github.com/ipfs/go-ipns"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+func testCid(s string) cid.Cid {
+	mh, _ := multihash.Encode([]byte(s), multihash.IDENTITY)
+	return cid.NewCidV1(uint64(multicodec.Raw), mh)
+}
+
+func TestResolvePath(t *testing.T) {
+	root := testCid("root")
+	r := namesys.Map{
+		"example.com":      "/ipns/docs.example.com/v1",
+		"docs.example.com": "/ipfs/" + root.String() + "/site",
+		"loop.example.com": "/ipns/loop.example.com",
+	}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		path string
+		rest string
+	}{
+		{root.String(), ""},
+		{root.String() + "/a/b", "a/b"},
+		{"/ipfs/" + root.String() + "/a/", "a"},
+		{"/ipns/docs.example.com", "site"},
+		{"/ipns/example.com/docs/index.html", "site/v1/docs/index.html"},
+	} {
+		c, rest, err := namesys.ResolvePath(ctx, r, tc.path)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.path, err)
+		}
+		if c != root || rest.String() != tc.rest {
+			t.Fatalf("%s: expected %s/%s, got %s/%s", tc.path, root, tc.rest, c, rest)
+		}
+	}
+
+	if _, _, err := namesys.ResolvePath(ctx, r, "/ipns/missing.example.com"); !errors.Is(err, namesys.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if _, _, err := namesys.ResolvePath(ctx, r, "/ipns/loop.example.com"); !errors.Is(err, namesys.ErrTooDeep) {
+		t.Fatalf("expected too deep, got %v", err)
+	}
+}
+
+func TestDNSLink(t *testing.T) {
+	root := testCid("root")
+	d := &namesys.DNSLink{LookupTXT: func(_ context.Context, name string) ([]string, error) {
+		switch name {
+		case "_dnslink.example.com":
+			return []string{"v=spf1 -all", "dnslink=/ipfs/" + root.String()}, nil
+		case "bare.example.com":
+			return []string{"dnslink=/ipns/example.com"}, nil
+		}
+		return nil, nil
+	}}
+	ctx := context.Background()
+
+	if v, err := d.Resolve(ctx, "example.com"); err != nil || v != "/ipfs/"+root.String() {
+		t.Fatalf("unexpected resolution %q, %v", v, err)
+	}
+	if v, err := d.Resolve(ctx, "bare.example.com"); err != nil || v != "/ipns/example.com" {
+		t.Fatalf("unexpected resolution %q, %v", v, err)
+	}
+	if _, err := d.Resolve(ctx, "missing.example.com"); !errors.Is(err, namesys.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestIPNS(t *testing.T) {
+	root := testCid("root")
+	sk, pk, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := ipns.Create(sk, []byte("/ipfs/"+root.String()), 1, time.Now().Add(time.Hour), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := proto.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a record of another key must not be accepted.
+	other, _, _ := crypto.GenerateEd25519Key(nil)
+	forged, _ := ipns.Create(other, []byte("/ipfs/"+testCid("forged").String()), 1, time.Now().Add(time.Hour), time.Minute)
+	forgedRecord, _ := proto.Marshal(forged)
+
+	forge := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/routing/v1/ipns/"+peer.ToCid(pid).String() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.ipfs.ipns-record")
+		if forge {
+			_, _ = w.Write(forgedRecord)
+			return
+		}
+		_, _ = w.Write(record)
+	}))
+	defer srv.Close()
+
+	r, err := namesys.NewIPNS(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, name := range []string{pid.String(), peer.ToCid(pid).String()} {
+		v, err := r.Resolve(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != "/ipfs/"+root.String() {
+			t.Fatalf("unexpected value %q", v)
+		}
+	}
+
+	forge = true
+	if _, err := r.Resolve(ctx, pid.String()); err == nil {
+		t.Fatal("expected a record signed by another key to be rejected")
+	}
+	self, _ := peer.IDFromPrivateKey(other)
+	if _, err := r.Resolve(ctx, self.String()); !errors.Is(err, namesys.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
@@ -8,7 +8,14 @@ import (
 	datatransfer "github.com/filecoin-project/go-data-transfer/impl"
 	dtnetwork "github.com/filecoin-project/go-data-transfer/network"
 	gstransport "github.com/filecoin-project/go-data-transfer/transport/graphsync"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	"github.com/ipfs-shipyard/w3rc/exchange/filecoinretrieval"
+	"github.com/ipfs-shipyard/w3rc/namesys"
+	"github.com/ipfs-shipyard/w3rc/planning"
+	"github.com/ipfs-shipyard/w3rc/reputation"
 	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	gsimpl "github.com/ipfs/go-graphsync/impl"
 	gsnet "github.com/ipfs/go-graphsync/network"
 	"github.com/ipld/go-ipld-prime"
@@ -21,7 +28,26 @@ type config struct {
 	ds   datastore.Batching
 	dt   datatransferi.Manager
 
-	indexerURL string
+	indexerURL    string
+	indexerURLs   []string
+	routingV1URLs []string
+	readerPrivacy bool
+	routers       []contentrouting.Routing
+	paymentAPI    filecoinretrieval.PaymentAPI
+	resolver      namesys.Resolver
+	newScheduler  func() planning.Scheduler
+	reputations   *reputation.Store
+	hedgeAfter    time.Duration
+	splitWays     int
+
+	dht bool
+
+	cacheRouting        bool
+	routingCache        []contentrouting.CacheOption
+	persistRoutingCache bool
+
+	maxSpend             abi.TokenAmount
+	maxSpendPerRetrieval abi.TokenAmount
 }
 
 // An Option allows opening a Session with configured options.
@@ -51,6 +77,27 @@ func WithHost(h host.Host) Option {
 	}
 }
 
+// WithPaymentAPI sets the payment channel api used to pay for filecoin retrievals.
+// Without one, only free retrievals can be made.
+func WithPaymentAPI(api filecoinretrieval.PaymentAPI) Option {
+	return func(c *config) error {
+		c.paymentAPI = api
+		return nil
+	}
+}
+
+// WithBudget limits the total amount paid for retrievals over the life of the
+// session, and the amount paid for any single retrieval, both in attoFIL.
+// Payments that would exceed either limit fail the retrieval with a
+// filecoinretrieval.ErrOverBudget. A limit of abi.TokenAmount{} is unlimited.
+func WithBudget(maxTotal, maxPerRetrieval abi.TokenAmount) Option {
+	return func(c *config) error {
+		c.maxSpend = maxTotal
+		c.maxSpendPerRetrieval = maxPerRetrieval
+		return nil
+	}
+}
+
 // WithIndexer sets a URL of the indexer to use.
 func WithIndexer(url string) Option {
 	return func(c *config) error {
@@ -59,6 +106,130 @@ func WithIndexer(url string) Option {
 	}
 }
 
+// WithIndexers adds indexers to query alongside any other configured routing.
+// Results from all indexers are merged as they arrive.
+func WithIndexers(urls ...string) Option {
+	return func(c *config) error {
+		c.indexerURLs = append(c.indexerURLs, urls...)
+		return nil
+	}
+}
+
+// WithRoutingV1 adds endpoints of the delegated routing v1 HTTP API to query
+// alongside any other configured routing.
+func WithRoutingV1(urls ...string) Option {
+	return func(c *config) error {
+		c.routingV1URLs = append(c.routingV1URLs, urls...)
+		return nil
+	}
+}
+
+// WithReaderPrivacy makes lookups against indexers double-hashed, so that
+// indexers do not learn which content the session retrieves.
+func WithReaderPrivacy() Option {
+	return func(c *config) error {
+		c.readerPrivacy = true
+		return nil
+	}
+}
+
+// WithDHT also finds providers through the libp2p Kademlia DHT, joined as a
+// client on the session host. Providers found there are fetched over bitswap.
+func WithDHT() Option {
+	return func(c *config) error {
+		c.dht = true
+		return nil
+	}
+}
+
+// WithRouter adds a content router to query alongside any other configured routing.
+func WithRouter(r contentrouting.Routing) Option {
+	return func(c *config) error {
+		c.routers = append(c.routers, r)
+		return nil
+	}
+}
+
+// WithResolver sets how names in /ipns/ paths are resolved. By default,
+// domains are resolved through DNSLink, and IPNS records are fetched from the
+// first routing v1 endpoint configured, or else from namesys.DefaultIPNSEndpoint.
+func WithResolver(r namesys.Resolver) Option {
+	return func(c *config) error {
+		c.resolver = r
+		return nil
+	}
+}
+
+// WithScheduler sets how each retrieval chooses among the providers found for
+// it, such as by policy with planning.NewPolicyScheduler. newScheduler is
+// called for every retrieval, as a scheduler plans one at a time.
+// By default, a planning.SimpleScheduler weighing providers by their
+// reputations is used.
+func WithScheduler(newScheduler func() planning.Scheduler) Option {
+	return func(c *config) error {
+		c.newScheduler = newScheduler
+		return nil
+	}
+}
+
+// WithReputations sets where the session keeps how well providers have served
+// it, such as to share with the interpreters of a scheduler given to
+// WithScheduler. By default, reputations are kept in the session datastore.
+func WithReputations(r *reputation.Store) Option {
+	return func(c *config) error {
+		c.reputations = r
+		return nil
+	}
+}
+
+// WithHedging starts further providers for a retrieval only once those already
+// started have gone without progress for after, then races them, cancelling
+// the rest once one completes. It applies to the default scheduler, which
+// otherwise starts another provider every tick until one completes.
+func WithHedging(after time.Duration) Option {
+	return func(c *config) error {
+		c.hedgeAfter = after
+		return nil
+	}
+}
+
+// WithSplitting splits the retrieval of a dag among up to ways providers at
+// once. Once the top of the dag is fetched, each provider started fetches its
+// own share of the subtrees under it, taking another as it finishes. Dags are
+// only split under selectors exploring everything recursively. Providers are
+// started as the scheduler plans them, so splitting gains little alongside
+// WithHedging.
+func WithSplitting(ways int) Option {
+	return func(c *config) error {
+		c.splitWays = ways
+		return nil
+	}
+}
+
+// WithRoutingCache reuses the providers found for a cid for ttl, and remembers
+// cids without providers for negativeTTL, holding at most maxEntries cids.
+func WithRoutingCache(ttl, negativeTTL time.Duration, maxEntries int) Option {
+	return func(c *config) error {
+		c.cacheRouting = true
+		c.routingCache = append(c.routingCache,
+			contentrouting.WithCacheTTL(ttl),
+			contentrouting.WithNegativeCacheTTL(negativeTTL),
+			contentrouting.WithCacheSize(maxEntries))
+		return nil
+	}
+}
+
+// WithPersistentRoutingCache keeps the routing cache in the session datastore,
+// so that later sessions over the same datastore start from it. The cache uses
+// default limits unless WithRoutingCache is also given.
+func WithPersistentRoutingCache() Option {
+	return func(c *config) error {
+		c.cacheRouting = true
+		c.persistRoutingCache = true
+		return nil
+	}
+}
+
 func apply(cfg *config, opts ...Option) error {
 	for _, opt := range opts {
 		if err := opt(cfg); err != nil {
@@ -78,7 +249,30 @@ func applyDefaults(lsys ipld.LinkSystem, cfg *config) error {
 		cfg.host = host
 	}
 	if cfg.ds == nil {
-		cfg.ds = datastore.NewMapDatastore()
+		cfg.ds = dssync.MutexWrap(datastore.NewMapDatastore())
+	}
+	if cfg.reputations == nil {
+		cfg.reputations = reputation.New(cfg.ds)
+	}
+	if cfg.newScheduler == nil {
+		opts := []planning.SchedulerOption{planning.WithReputations(cfg.reputations)}
+		if cfg.hedgeAfter > 0 {
+			opts = append(opts, planning.WithHedging(cfg.hedgeAfter))
+		}
+		cfg.newScheduler = func() planning.Scheduler {
+			return planning.NewSimpleScheduler(opts...)
+		}
+	}
+	if cfg.resolver == nil {
+		endpoint := namesys.DefaultIPNSEndpoint
+		if len(cfg.routingV1URLs) > 0 {
+			endpoint = cfg.routingV1URLs[0]
+		}
+		r, err := namesys.NewResolver(endpoint)
+		if err != nil {
+			return err
+		}
+		cfg.resolver = r
 	}
 	if cfg.dt == nil {
 		gsNet := gsnet.NewFromLibp2pHost(cfg.host)
@@ -0,0 +1,242 @@
+package w3rc
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ipfs-shipyard/w3rc/exchange"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipfs/go-unixfsnode/hamt"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+// Scope is how much of the dag at the end of a path GetPath fetches.
+type Scope uint8
+
+// These are valid scopes
+const (
+	// ScopeBlock fetches only the block at the end of the path.
+	ScopeBlock Scope = iota
+	// ScopeEntity fetches the UnixFS entity at the end of the path: all of a
+	// file, or the blocks of a directory, including any HAMT shards, without
+	// its entries. Other nodes are fetched as for ScopeBlock.
+	ScopeEntity
+	// ScopeAll fetches the full dag under the end of the path.
+	ScopeAll
+)
+
+// unixfsChooser loads dag-pb blocks in the form UnixFS reification expects.
+var unixfsChooser = dagpb.AddSupportToChooser(basicnode.Chooser)
+
+// withUnixFS lets selectors over lsys interpret nodes as UnixFS.
+func withUnixFS(lsys ipld.LinkSystem) ipld.LinkSystem {
+	known := make(map[string]linking.NodeReifier, len(lsys.KnownReifiers)+1)
+	for name, reify := range lsys.KnownReifiers {
+		known[name] = reify
+	}
+	if _, ok := known["unixfs"]; !ok {
+		known["unixfs"] = unixfsnode.Reify
+	}
+	lsys.KnownReifiers = known
+	return lsys
+}
+
+// PathSelector returns a selector following path from the root, and applying
+// leaf where it ends. Each segment is looked up in the node interpreted as
+// UnixFS, so that it names an entry of a UnixFS directory, including one
+// sharded over HAMT blocks, or else a field of the data model. Along with
+// Resolve, it lets a path be fetched with Get or GetStream.
+func PathSelector(path datamodel.Path, leaf datamodel.Node) datamodel.Node {
+	sel := selectorOrDefault(leaf)
+	segs := path.Segments()
+	for i := len(segs) - 1; i >= 0; i-- {
+		next, field := sel, segs[i].String()
+		sel = fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+			na.AssembleEntry(ipldselector.SelectorKey_ExploreInterpretAs).CreateMap(2, func(na fluent.MapAssembler) {
+				na.AssembleEntry(ipldselector.SelectorKey_As).AssignString("unixfs")
+				na.AssembleEntry(ipldselector.SelectorKey_Next).CreateMap(1, func(na fluent.MapAssembler) {
+					na.AssembleEntry(ipldselector.SelectorKey_ExploreFields).CreateMap(1, func(na fluent.MapAssembler) {
+						na.AssembleEntry(ipldselector.SelectorKey_Fields).CreateMap(1, func(na fluent.MapAssembler) {
+							na.AssembleEntry(field).AssignNode(next)
+						})
+					})
+				})
+			})
+		})
+	}
+	return sel
+}
+
+func (s *simpleSession) GetPath(ctx context.Context, root cid.Cid, path string, scope Scope) (ipld.Node, error) {
+	ctx = exchange.WithSessionRoot(ctx, cidlink.Link{Cid: root})
+	getCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	leaf := selectorparse.CommonSelector_MatchPoint
+	if scope == ScopeAll {
+		leaf = selectorparse.CommonSelector_ExploreAllRecursively
+	}
+	s.fetchPath(getCtx, root, path, leaf)
+	c, within, err := s.walkPath(getCtx, root, path)
+	if err != nil {
+		return nil, err
+	}
+	var n ipld.Node
+	if err := s.withBlocks(getCtx, c, func(nd ipld.Node) error {
+		n = nd
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	switch scope {
+	case ScopeAll:
+		if err := s.fetch(getCtx, c, selectorparse.CommonSelector_ExploreAllRecursively, nil); err != nil {
+			return nil, err
+		}
+	case ScopeEntity:
+		if err := s.fetchEntity(getCtx, c, n); err != nil {
+			return nil, err
+		}
+	}
+	// the node loads further blocks, such as HAMT shards, after getCtx ends.
+	n, err = loadUnixFS(ctx, &s.ls, c)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range within.Segments() {
+		if n, err = n.LookupBySegment(seg); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// fetchPath fetches the blocks along path under root, and those leaf selects
+// where it ends, with one selector where the providers support it. Walking the
+// path then loads from local storage, fetching block by block only what this
+// did not get.
+func (s *simpleSession) fetchPath(ctx context.Context, root cid.Cid, path string, leaf datamodel.Node) {
+	if err := s.fetch(ctx, root, PathSelector(datamodel.ParsePath(path), leaf), nil); err != nil {
+		log.Debugf("fetching path %q under %s with a selector: %s", path, root, err)
+	}
+}
+
+// walkPath fetches the blocks along path under root, returning the cid of the
+// block the path ends in, and the path left within that block where it ends
+// at a node other than the root of a block.
+func (s *simpleSession) walkPath(ctx context.Context, root cid.Cid, path string) (cid.Cid, datamodel.Path, error) {
+	c := root
+	segs := datamodel.ParsePath(path).Segments()
+	var within []datamodel.PathSegment
+	for len(segs) > 0 {
+		err := s.withBlocks(ctx, c, func(n ipld.Node) error {
+			// fields are followed within the block until one links to another.
+			for i, seg := range segs {
+				entry, err := n.LookupBySegment(seg)
+				if err != nil {
+					return fmt.Errorf("resolving %q: %w", seg, err)
+				}
+				if entry.Kind() != datamodel.Kind_Link {
+					n = entry
+					continue
+				}
+				lnk, err := entry.AsLink()
+				if err != nil {
+					return err
+				}
+				cl, ok := lnk.(cidlink.Link)
+				if !ok {
+					return fmt.Errorf("unsupported link %s", lnk)
+				}
+				c, segs = cl.Cid, segs[i+1:]
+				return nil
+			}
+			within, segs = segs, nil
+			return nil
+		})
+		if err != nil {
+			return cid.Undef, datamodel.Path{}, err
+		}
+	}
+	return c, datamodel.NewPathNocopy(within), nil
+}
+
+// fetchEntity fetches the rest of the UnixFS entity n at c.
+func (s *simpleSession) fetchEntity(ctx context.Context, c cid.Cid, n ipld.Node) error {
+	switch n.(type) {
+	case hamt.UnixFSHAMTShard:
+		// walking the directory loads every shard of it.
+		return s.withBlocks(ctx, c, func(n ipld.Node) error {
+			itr := n.MapIterator()
+			for !itr.Done() {
+				if _, _, err := itr.Next(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	default:
+		if n.Kind() == datamodel.Kind_Bytes {
+			// a file is the whole of the dag under it.
+			return s.fetch(ctx, c, selectorparse.CommonSelector_ExploreAllRecursively, nil)
+		}
+		return nil
+	}
+}
+
+// withBlocks calls fn with the UnixFS node at c, fetching the blocks it needs
+// one at a time: whenever fn fails for want of a block, the block is fetched
+// and fn is tried again. Only the blocks fn looks at are fetched, such as the
+// HAMT shards along the way to a directory entry.
+func (s *simpleSession) withBlocks(ctx context.Context, c cid.Cid, fn func(ipld.Node) error) error {
+	for {
+		var missing datamodel.Link
+		lsys := s.ls
+		lsys.StorageReadOpener = func(lc linking.LinkContext, l datamodel.Link) (io.Reader, error) {
+			r, err := s.ls.StorageReadOpener(lc, l)
+			if err != nil {
+				missing = l
+			}
+			return r, err
+		}
+		n, err := loadUnixFS(ctx, &lsys, c)
+		if err == nil {
+			err = fn(n)
+		}
+		if err == nil || missing == nil {
+			return err
+		}
+		cl, ok := missing.(cidlink.Link)
+		if !ok {
+			return err
+		}
+		if err := s.fetch(ctx, cl.Cid, selectorparse.CommonSelector_MatchPoint, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// loadUnixFS loads the node at c, interpreted as UnixFS where it is so.
+func loadUnixFS(ctx context.Context, lsys *ipld.LinkSystem, c cid.Cid) (ipld.Node, error) {
+	lnk := cidlink.Link{Cid: c}
+	lc := ipld.LinkContext{Ctx: ctx}
+	np, err := unixfsChooser(lnk, lc)
+	if err != nil {
+		return nil, err
+	}
+	n, err := lsys.Load(lc, lnk, np)
+	if err != nil {
+		return nil, err
+	}
+	return unixfsnode.Reify(lc, n, lsys)
+}
@@ -0,0 +1,306 @@
+package w3rc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs-shipyard/w3rc/exchange"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	"github.com/ipfs/go-unixfsnode/file"
+	"github.com/ipfs/go-unixfsnode/hamt"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/multiformats/go-multicodec"
+)
+
+// selectorExchange copies the blocks the requested selector reaches from a
+// source store into the session store, as a transport would.
+type selectorExchange struct {
+	source *syncStore
+	dest   *syncStore
+	// delay is how long requests to each provider take.
+	delay map[string]time.Duration
+	// fails makes requests to a provider for these roots fail at once.
+	fails map[string][]cid.Cid
+
+	lk       sync.Mutex
+	requests map[string][]ipld.Link
+}
+
+func (se *selectorExchange) Code() multicodec.Code { return multicodec.TransportBitswap }
+
+func (se *selectorExchange) RequestData(ctx context.Context, root ipld.Link, selector ipld.Node, provider interface{}, _ interface{}) <-chan exchange.EventData {
+	p, _ := provider.(string)
+	se.lk.Lock()
+	if se.requests == nil {
+		se.requests = make(map[string][]ipld.Link)
+	}
+	se.requests[p] = append(se.requests[p], root)
+	se.lk.Unlock()
+
+	evs := make(chan exchange.EventData, 1)
+	go func() {
+		defer close(evs)
+		evs <- exchange.EventData{Event: exchange.StartEvent}
+		if containsKey(se.fails[p], root.Binary()) {
+			evs <- exchange.EventData{Event: exchange.FailureEvent, State: errors.New("provider went away")}
+			return
+		}
+		select {
+		case <-time.After(se.delay[p]):
+		case <-ctx.Done():
+			evs <- exchange.EventData{Event: exchange.FailureEvent, State: ctx.Err()}
+			return
+		}
+		lsys := newLinkSystem(se.source)
+		lsys.StorageReadOpener = func(lc linking.LinkContext, l datamodel.Link) (io.Reader, error) {
+			key := string(l.(cidlink.Link).Cid.Bytes())
+			blk, err := se.source.Get(lc.Ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if err := se.dest.Put(lc.Ctx, key, blk); err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(blk), nil
+		}
+		sel, err := ipldselector.CompileSelector(selector)
+		if err == nil {
+			var np datamodel.NodePrototype
+			var n ipld.Node
+			lc := ipld.LinkContext{Ctx: ctx}
+			if np, err = unixfsChooser(root, lc); err == nil {
+				n, err = lsys.Load(lc, root, np)
+			}
+			if err == nil {
+				prog := traversal.Progress{Cfg: &traversal.Config{Ctx: ctx, LinkSystem: withUnixFS(lsys), LinkTargetNodePrototypeChooser: unixfsChooser}}
+				err = prog.WalkAdv(n, sel, func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil })
+			}
+		}
+		if err != nil {
+			evs <- exchange.EventData{Event: exchange.FailureEvent, State: err}
+			return
+		}
+		evs <- exchange.EventData{Event: exchange.SuccessEvent, State: root}
+	}()
+	return evs
+}
+
+func (se *selectorExchange) requested(provider string) []ipld.Link {
+	se.lk.Lock()
+	defer se.lk.Unlock()
+	return se.requests[provider]
+}
+
+func (se *selectorExchange) Close() {}
+
+// buildUnixFS stores a directory holding a sharded directory of many files,
+// one of which is content, returning the root and the cid of content.
+func buildUnixFS(t *testing.T, lsys *ipld.LinkSystem, content []byte) (cid.Cid, cid.Cid) {
+	entries := make([]dagpb.PBLink, 0, 100)
+	var target ipld.Link
+	for i := 0; i < 100; i++ {
+		body := []byte(fmt.Sprintf("file %d", i))
+		name := fmt.Sprintf("%d.txt", i)
+		if i == 42 {
+			body, name = content, "file.txt"
+		}
+		lnk, size, err := builder.BuildUnixFSFile(bytes.NewReader(body), "size-64", lsys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 42 {
+			target = lnk
+		}
+		entry, err := builder.BuildUnixFSDirectoryEntry(name, int64(size), lnk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	shardLnk, size, err := builder.BuildUnixFSShardedDirectory(16, hamt.HashMurmur3, entries, lsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirEntry, err := builder.BuildUnixFSDirectoryEntry("sub", int64(size), shardLnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootLnk, _, err := builder.BuildUnixFSDirectory([]dagpb.PBLink{dirEntry}, lsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rootLnk.(cidlink.Link).Cid, target.(cidlink.Link).Cid
+}
+
+func TestGetPath(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 30)
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, target := buildUnixFS(t, &srcLsys, content)
+
+	for _, tc := range []struct {
+		scope Scope
+		whole bool
+	}{
+		{ScopeBlock, false},
+		{ScopeEntity, true},
+		{ScopeAll, true},
+	} {
+		dest := &syncStore{}
+		sess := newTestSession(dest, &testRouter{providers: []string{"a"}}, &selectorExchange{source: source, dest: dest})
+
+		n, err := sess.GetPath(context.Background(), root, "sub/file.txt", tc.scope)
+		if err != nil {
+			t.Fatalf("scope %d: %s", tc.scope, err)
+		}
+		if len(dest.bag.Bag) >= len(source.bag.Bag)/2 {
+			t.Fatalf("scope %d: expected only the path to be fetched, got %d of %d blocks", tc.scope, len(dest.bag.Bag), len(source.bag.Bag))
+		}
+		if has, _ := dest.Has(context.Background(), string(target.Bytes())); !has {
+			t.Fatalf("scope %d: expected the file root to be fetched", tc.scope)
+		}
+		lbn, ok := n.(file.LargeBytesNode)
+		if !ok {
+			t.Fatalf("scope %d: expected a file, got %T", tc.scope, n)
+		}
+		rs, err := lbn.AsLargeBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rs)
+		if tc.whole && (err != nil || !bytes.Equal(got, content)) {
+			t.Fatalf("scope %d: unexpected content %q (%v)", tc.scope, got, err)
+		}
+		if !tc.whole && err == nil {
+			t.Fatalf("scope %d: expected the file body not to be fetched", tc.scope)
+		}
+	}
+
+	dest := &syncStore{}
+	sess := newTestSession(dest, &testRouter{providers: []string{"a"}}, &selectorExchange{source: source, dest: dest})
+	if _, err := sess.GetPath(context.Background(), root, "sub/missing.txt", ScopeBlock); err == nil {
+		t.Fatal("expected an error for a missing entry")
+	}
+}
+
+func TestGetPathRoutesByRoot(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, _ := buildUnixFS(t, &srcLsys, []byte("content"))
+
+	dest := &syncStore{}
+	router := &testRouter{providers: []string{"a"}}
+	ex := &selectorExchange{source: source, dest: dest}
+	sess := newTestSession(dest, router, ex)
+	if _, err := sess.GetPath(context.Background(), root, "sub/file.txt", ScopeBlock); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range router.finds {
+		if c != root {
+			t.Fatalf("expected providers to be found only for the root, got a lookup for %s", c)
+		}
+	}
+	if got := ex.requested("a"); len(got) != 1 {
+		t.Fatalf("expected the path to be fetched in one request, got %d", len(got))
+	}
+}
+
+func TestPathSelectorUnixFS(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 30)
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, target := buildUnixFS(t, &srcLsys, content)
+
+	dest := &syncStore{}
+	sess := newTestSession(dest, &testRouter{providers: []string{"a"}}, &selectorExchange{source: source, dest: dest})
+	sel := PathSelector(datamodel.ParsePath("sub/file.txt"), selectorparse.CommonSelector_ExploreAllRecursively)
+	if _, err := sess.Get(context.Background(), root, sel); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := dest.Has(context.Background(), string(target.Bytes())); !has {
+		t.Fatal("expected the file at the end of the path to be fetched")
+	}
+	if len(dest.bag.Bag) >= len(source.bag.Bag)/2 {
+		t.Fatalf("expected only the path to be fetched, got %d of %d blocks", len(dest.bag.Bag), len(source.bag.Bag))
+	}
+}
+
+func TestGetPathDagCbor(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	leaf, err := srcLsys.Store(ipld.LinkContext{}, linkProto, basicnode.NewString("leaf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := qp.BuildMap(basicnode.Prototype.Any, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "name", qp.String("child"))
+		qp.MapEntry(ma, "data", qp.Map(1, func(ma datamodel.MapAssembler) {
+			qp.MapEntry(ma, "leaf", qp.Link(leaf))
+		}))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	childLnk, err := srcLsys.Store(ipld.LinkContext{}, linkProto, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fields on the way to the child are within the root block.
+	root, err := qp.BuildMap(basicnode.Prototype.Any, 1, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "meta", qp.Map(1, func(ma datamodel.MapAssembler) {
+			qp.MapEntry(ma, "child", qp.Link(childLnk))
+		}))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootLnk, err := srcLsys.Store(ipld.LinkContext{}, linkProto, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCid := rootLnk.(cidlink.Link).Cid
+
+	for path, want := range map[string]string{
+		"meta/child/name":      "child",
+		"meta/child/data/leaf": "leaf",
+	} {
+		dest := &syncStore{}
+		sess := newTestSession(dest, &testRouter{providers: []string{"a"}}, &selectorExchange{source: source, dest: dest})
+		n, err := sess.GetPath(context.Background(), rootCid, path, ScopeBlock)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if got, err := n.AsString(); err != nil || got != want {
+			t.Fatalf("%s: expected %q, got %v (%v)", path, want, n, err)
+		}
+	}
+
+	dest := &syncStore{}
+	sess := newTestSession(dest, &testRouter{providers: []string{"a"}}, &selectorExchange{source: source, dest: dest})
+	n, err := sess.GetPath(context.Background(), rootCid, "meta/child/data", ScopeBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Kind() != datamodel.Kind_Map {
+		t.Fatalf("expected the map within the child block, got %v", n)
+	}
+	if len(dest.bag.Bag) != 2 {
+		t.Fatalf("expected only the root and child blocks fetched, got %d", len(dest.bag.Bag))
+	}
+}
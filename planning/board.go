@@ -1,6 +1,11 @@
 package planning
 
-import "sync"
+import (
+	"sync"
+	"time"
+
+	"github.com/multiformats/go-multicodec"
+)
 
 // Board keeps track of the state machine of transfers.
 // requests transition from possible->pending->{failed, complete}
@@ -10,6 +15,12 @@ type Board struct {
 	Pending  []*TransportRequest
 	Failed   []*TransportRequest
 	Complete []*TransportRequest
+	// Reputations, if set, weigh providers by how they served before the
+	// requests on the board.
+	Reputations Reputations
+
+	// active is when each pending request began or last made progress.
+	active map[*TransportRequest]time.Time
 }
 
 // NewBoard initializes a new Board for planning requests
@@ -19,6 +30,7 @@ func NewBoard() *Board {
 		Pending:  make([]*TransportRequest, 0),
 		Failed:   make([]*TransportRequest, 0),
 		Complete: make([]*TransportRequest, 0),
+		active:   make(map[*TransportRequest]time.Time),
 	}
 }
 
@@ -35,6 +47,7 @@ func (b *Board) Reconcile(r *TransportRequest, success bool) {
 			break
 		}
 	}
+	delete(b.active, r)
 	if found {
 		if success {
 			b.Complete = append(b.Complete, r)
@@ -58,7 +71,30 @@ func (b *Board) Begin(r *TransportRequest) {
 	}
 	if found {
 		b.Pending = append(b.Pending, r)
+		b.active[r] = time.Now()
+	}
+}
+
+// Progress notes that a pending transport request has received data.
+func (b *Board) Progress(r *TransportRequest) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.active[r]; ok {
+		b.active[r] = time.Now()
+	}
+}
+
+// Stalled returns if no pending request has begun or made progress within
+// the last period, as is so when nothing is pending.
+func (b *Board) Stalled(period time.Duration) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, r := range b.Pending {
+		if time.Since(b.active[r]) < period {
+			return false
+		}
 	}
+	return true
 }
 
 // Active returns if there is active work ongoing or available from the board
@@ -80,14 +116,39 @@ func (b *Board) AddPossible(r *TransportRequest) {
 // weight increases for each successful transfer from that provider.
 // weight decreses by 5 for each unsuccessful transfer from that provider.
 // weight decreases by 1 for each in-progress transfer from that provider.
+// with reputations, weight moves by up to 2 either way of an unknown provider,
+// by its reputation.
 func (b *Board) HighestScore() *TransportRequest {
+	return b.highestScore(false)
+}
+
+// HighestHedge is HighestScore among the transfers that may race those
+// pending. Paid transfers are only started with nothing pending, so that a
+// hedge never pays for the same data twice.
+func (b *Board) HighestHedge() *TransportRequest {
+	return b.highestScore(true)
+}
+
+func (b *Board) highestScore(hedge bool) *TransportRequest {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	if len(b.Possible) == 0 {
+	possible := b.Possible
+	if hedge && len(b.Pending) > 0 {
+		possible = make([]*TransportRequest, 0, len(b.Possible))
+		for _, t := range b.Possible {
+			if !paid(t.Codec) {
+				possible = append(possible, t)
+			}
+		}
+	}
+	if len(possible) == 0 {
 		return nil
 	}
-	scores := make([]int, len(b.Possible))
-	for i, t := range b.Possible {
+	scores := make([]float64, len(possible))
+	for i, t := range possible {
+		if b.Reputations != nil {
+			scores[i] = 4*float64(b.Reputations.Reputation(t.RoutingProvider)) - 2
+		}
 		for _, g := range b.Complete {
 			if providersEqual(g.RoutingProvider, t.RoutingProvider) {
 				scores[i]++
@@ -112,7 +173,12 @@ func (b *Board) HighestScore() *TransportRequest {
 			maxIndex = i
 		}
 	}
-	return b.Possible[maxIndex]
+	return possible[maxIndex]
+}
+
+// paid is whether transfers over codec may cost money.
+func paid(codec multicodec.Code) bool {
+	return codec == multicodec.TransportGraphsyncFilecoinv1
 }
 
 func providersEqual(a, b interface{}) bool {
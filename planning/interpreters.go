@@ -0,0 +1,174 @@
+package planning
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/filecoin-project/index-provider/metadata"
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	"github.com/libp2p/go-libp2p-core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/multiformats/go-multicodec"
+)
+
+// Reputations tell how well providers have served retrievals before, from
+// 0 for never to 1 for always.
+type Reputations interface {
+	Reputation(provider interface{}) PolicyScore
+}
+
+var (
+	_ RoutingRecordInterpreter = (*FilecoinV1RecordInterpreter)(nil)
+	_ RoutingRecordInterpreter = (*BitswapRecordInterpreter)(nil)
+	_ RoutingRecordInterpreter = (*HTTPRecordInterpreter)(nil)
+)
+
+// FilecoinV1RecordInterpreter scores graphsync filecoin v1 records.
+// Their payload may be decoded metadata, or the metadata as bytes.
+type FilecoinV1RecordInterpreter struct {
+	// Reputations scores providers for PreferReputablePolicy, if set.
+	Reputations Reputations
+}
+
+// Interpret scores a record as free where the deal is verified and unsealed,
+// and as faster where it is unsealed.
+func (fri FilecoinV1RecordInterpreter) Interpret(record contentrouting.RoutingRecord, policies []Policy) (PolicyResults, error) {
+	if err := recordError(record); err != nil {
+		return nil, err
+	}
+
+	var fcmd *metadata.GraphsyncFilecoinV1
+	switch p := record.Payload().(type) {
+	case *metadata.GraphsyncFilecoinV1:
+		fcmd = p
+	case metadata.GraphsyncFilecoinV1:
+		fcmd = &p
+	case []byte:
+		var rm metadata.Metadata
+		if err := rm.UnmarshalBinary(p); err != nil {
+			return nil, err
+		}
+		if md, ok := rm.Get(multicodec.TransportGraphsyncFilecoinv1).(*metadata.GraphsyncFilecoinV1); ok {
+			fcmd = md
+		}
+	default:
+		return nil, fmt.Errorf("filecoin v1 routing record payload has unexpected type: %T", p)
+	}
+	if fcmd == nil {
+		return nil, fmt.Errorf("not graphsync retrievable")
+	}
+
+	results := newStandardResults(record, fri.Reputations)
+	if fcmd.VerifiedDeal && fcmd.FastRetrieval {
+		results.free = 1
+	}
+	// without fast retrieval, the piece may need unsealing, which takes hours.
+	if fcmd.FastRetrieval {
+		results.fast = 0.5
+	}
+	return results, nil
+}
+
+// BitswapRecordInterpreter scores bitswap records.
+type BitswapRecordInterpreter struct {
+	// Reputations scores providers for PreferReputablePolicy, if set.
+	Reputations Reputations
+}
+
+// Interpret scores bitswap as free, and as slower than a gateway, since it
+// takes a round trip for each level of a DAG.
+func (bi BitswapRecordInterpreter) Interpret(record contentrouting.RoutingRecord, policies []Policy) (PolicyResults, error) {
+	if err := recordError(record); err != nil {
+		return nil, err
+	}
+	if record.Protocol() != multicodec.TransportBitswap {
+		return nil, fmt.Errorf("not a bitswap record: %s", record.Protocol())
+	}
+	results := newStandardResults(record, bi.Reputations)
+	results.free = 1
+	results.fast = 0.5
+	return results, nil
+}
+
+// HTTPRecordInterpreter scores trustless gateway records.
+type HTTPRecordInterpreter struct {
+	// Reputations scores providers for PreferReputablePolicy, if set.
+	Reputations Reputations
+}
+
+// Interpret scores gateways as free, and as fast, since a whole DAG comes in
+// one response.
+func (hi HTTPRecordInterpreter) Interpret(record contentrouting.RoutingRecord, policies []Policy) (PolicyResults, error) {
+	if err := recordError(record); err != nil {
+		return nil, err
+	}
+	if record.Protocol() != multicodec.TransportIpfsGatewayHttp {
+		return nil, fmt.Errorf("not a gateway record: %s", record.Protocol())
+	}
+	results := newStandardResults(record, hi.Reputations)
+	results.free = 1
+	results.fast = 1
+	return results, nil
+}
+
+// recordError is the error carried by a routing error record.
+func recordError(record contentrouting.RoutingRecord) error {
+	if record.Protocol() != contentrouting.RoutingErrorProtocol {
+		return nil
+	}
+	err, ok := record.Payload().(error)
+	if !ok {
+		return errors.New("routing record payload not match expected type: error")
+	}
+	return err
+}
+
+var _ PolicyResults = (*standardResults)(nil)
+
+// standardResults are the scores of a record for the standard policies.
+type standardResults struct {
+	free, fast, local, reputation PolicyScore
+}
+
+// newStandardResults scores the provider of record, leaving the scores of
+// its transport to the interpreter.
+func newStandardResults(record contentrouting.RoutingRecord, reputations Reputations) *standardResults {
+	results := &standardResults{}
+	if isLocal(record.Provider()) {
+		results.local = 1
+	}
+	if reputations != nil {
+		results.reputation = reputations.Reputation(record.Provider())
+	}
+	return results
+}
+
+// isLocal is true of providers with an address on a loopback or private
+// network.
+func isLocal(provider interface{}) bool {
+	ai, ok := provider.(peer.AddrInfo)
+	if !ok {
+		return false
+	}
+	for _, addr := range ai.Addrs {
+		if manet.IsIPLoopback(addr) || manet.IsPrivateAddr(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *standardResults) Score(name PolicyName) PolicyScore {
+	switch name {
+	case PreferFreePolicy:
+		return s.free
+	case PreferFastPolicy:
+		return s.fast
+	case PreferLocalPolicy:
+		return s.local
+	case PreferReputablePolicy:
+		return s.reputation
+	default:
+		return 0
+	}
+}
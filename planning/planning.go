@@ -1,19 +1,17 @@
 package planning
 
-// Note: this is a future-looking class for a more extensible planning policy.
-// It is not currently used.
-
 import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
-	"github.com/filecoin-project/index-provider/metadata"
 	"github.com/ipfs-shipyard/w3rc/contentrouting"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/multiformats/go-multicodec"
 )
 
@@ -45,34 +43,123 @@ type SinglePlanner interface {
 	GeneratePlan(ctx context.Context, targetRoot cid.Cid, targetSelector ipld.Node, potentialRequests <-chan PotentialRequest) <-chan TransportPlan
 }
 
+// ErrOverlappingRange is returned when an interpreter is registered for
+// multicodecs another interpreter is already registered for.
+var ErrOverlappingRange = errors.New("multicodec range overlaps a registered interpreter")
+
+// NewSimplePlanner creates a SimplePlanner turning scored records into plans
+// with singlePlanner.
 func NewSimplePlanner(singlePlanner SinglePlanner) *SimplePlanner {
-	return &SimplePlanner{singlePlanner}
+	return &SimplePlanner{singlePlanner: singlePlanner}
 }
 
+// A SimplePlanner scores routing records with the interpreter registered for
+// their transport, and leaves the choice among them to a SinglePlanner.
+// Records of transports without an interpreter are passed over.
 type SimplePlanner struct {
 	singlePlanner SinglePlanner
+
+	lk           sync.RWMutex
+	interpreters []interpreterRange
 }
 
-func (p *SimplePlanner) RegisterRecordInterpreter(minRange multicodec.Code, maxRange multicodec.Code, transportMultiplier PolicyWeight, interpreter RoutingRecordInterpreter) error {
+type interpreterRange struct {
+	min, max    multicodec.Code
+	multiplier  PolicyWeight
+	interpreter RoutingRecordInterpreter
+}
 
-	// what to do here -- record in some kind of map
-	// make sure there is not conflict of ranges
-	panic("not implemented")
+// RegisterRecordInterpreter interprets records of transports from minRange to
+// maxRange inclusive with interpreter, their weighted scores scaled by
+// transportMultiplier. Ranges of different interpreters may not overlap.
+func (p *SimplePlanner) RegisterRecordInterpreter(minRange multicodec.Code, maxRange multicodec.Code, transportMultiplier PolicyWeight, interpreter RoutingRecordInterpreter) error {
+	if minRange > maxRange {
+		return fmt.Errorf("invalid multicodec range %s to %s", minRange, maxRange)
+	}
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, ir := range p.interpreters {
+		if minRange <= ir.max && ir.min <= maxRange {
+			return fmt.Errorf("%w: %s to %s", ErrOverlappingRange, ir.min, ir.max)
+		}
+	}
+	p.interpreters = append(p.interpreters, interpreterRange{minRange, maxRange, transportMultiplier, interpreter})
+	return nil
+}
 
+func (p *SimplePlanner) interpreterFor(code multicodec.Code) (interpreterRange, bool) {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+	for _, ir := range p.interpreters {
+		if code >= ir.min && code <= ir.max {
+			return ir, true
+		}
+	}
+	return interpreterRange{}, false
 }
 
+// PlanRequests scores each of routingResults by policyPreference, and plans
+// a request for root+selector from them with the single planner.
+// Only a single plan is made, of a single request.
 func (p *SimplePlanner) PlanRequests(ctx context.Context, root cid.Cid, selector ipld.Node, policyPreference PolicyPreferences, routingResults <-chan contentrouting.RoutingRecord) <-chan TransportPlan {
-	// what to do here (initial implementation, only supports a single request per transfer
-	// consume content routing channel
-	// for each record, identify the routing record interpreter
-	// interpret it and score
-	// pass the weigted routing record to the single planner
-	// for the initial implementation, we can just pass the single planner result as the return value, as we aren't generating
-	// multiple request iterations
-	panic("not implemented")
-
+	// scoring ends along with planning.
+	planCtx, cancel := context.WithCancel(ctx)
+	potential := make(chan PotentialRequest)
+	go func() {
+		defer close(potential)
+		policies := policyPreference.Policies()
+		for {
+			var record contentrouting.RoutingRecord
+			var more bool
+			select {
+			case <-planCtx.Done():
+				return
+			case record, more = <-routingResults:
+				if !more {
+					return
+				}
+			}
+			if record.Protocol() == contentrouting.RoutingErrorProtocol {
+				log.Warnf("got error routing record: %s", record.Payload())
+				continue
+			}
+			ir, ok := p.interpreterFor(record.Protocol())
+			if !ok {
+				log.Debugf("no interpreter for %s records", record.Protocol())
+				continue
+			}
+			results, err := ir.interpreter.Interpret(record, policies)
+			if err != nil {
+				log.Debugf("could not interpret %s record: %s", record.Protocol(), err)
+				continue
+			}
+			select {
+			case potential <- PotentialRequest{policyPreference.WeightedScore(results, ir.multiplier), record}:
+			case <-planCtx.Done():
+				return
+			}
+		}
+	}()
+
+	plans := p.singlePlanner.GeneratePlan(planCtx, root, selector, potential)
+	out := make(chan TransportPlan)
+	go func() {
+		defer close(out)
+		defer cancel()
+		for plan := range plans {
+			select {
+			case out <- plan:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
 }
 
+// NewSimpleSinglePlanner creates a SinglePlanner choosing the first request
+// scoring at least minPolicyScore, or else the best scoring request seen
+// within maxWaitTime.
 func NewSimpleSinglePlanner(minPolicyScore PolicyScore, maxWaitTime time.Duration) SinglePlanner {
 	return &simpleSinglePlanner{minPolicyScore, maxWaitTime}
 }
@@ -83,62 +170,42 @@ type simpleSinglePlanner struct {
 }
 
 func (sp *simpleSinglePlanner) GeneratePlan(ctx context.Context, targetRoot cid.Cid, targetSelector ipld.Node, potentialRequests <-chan PotentialRequest) <-chan TransportPlan {
-	// for here, just read values until either max time is reached or min policy score is met,
-	// then generate a transport plan with a single request
-	// generate the transport request frim targetRoot & targetSelector + routing record
-	panic("not implemented")
-
-}
-
-var _ RoutingRecordInterpreter = (*FilecoinV1RecordInterpreter)(nil)
-
-type FilecoinV1RecordInterpreter struct {
-}
-
-func (fri FilecoinV1RecordInterpreter) Interpret(record contentrouting.RoutingRecord, policies []Policy) (PolicyResults, error) {
-
-	// decode the record (or error) -- use metadata from filecoin
-	// check for free or paid policy
-	// return PolicyResults that when given "prefer_free" returns 1 if retrieval is free or zero if its paid
-
-	if record.Protocol() == contentrouting.RoutingErrorProtocol {
-		err, ok := record.Payload().(error)
-		if !ok {
-			return nil, errors.New("routing record payload not match expected type: error")
+	plan := make(chan TransportPlan, 1)
+	go func() {
+		defer close(plan)
+		timer := time.NewTimer(sp.maxWaitTime)
+		defer timer.Stop()
+		var best *PotentialRequest
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				break wait
+			case pr, more := <-potentialRequests:
+				if !more {
+					break wait
+				}
+				if best == nil || pr.PolicyScore > best.PolicyScore {
+					best = &pr
+				}
+				if best.PolicyScore >= sp.minPolicyScore {
+					break wait
+				}
+			}
 		}
-		return nil, err
-	}
-
-	data, ok := record.Payload().([]byte)
-	if !ok {
-		return nil, errors.New("filecoin v1 routing record payload does not match expected type: []byte")
-	}
-
-	var rm metadata.Metadata
-	if err := rm.UnmarshalBinary(data); err != nil {
-		return nil, err
-	}
-
-	if md := rm.Get(multicodec.TransportGraphsyncFilecoinv1); md != nil {
-		fcmd := md.(*metadata.GraphsyncFilecoinV1)
-		return &simplePolicyResults{isFree: fcmd.VerifiedDeal && fcmd.FastRetrieval}, nil
-	}
-	return nil, fmt.Errorf("not graphsync retrievable")
-}
-
-var _ PolicyResults = (*simplePolicyResults)(nil)
-
-type simplePolicyResults struct {
-	isFree bool
-}
-
-// TODO: separating policies in their own package means we cannot use the PreferFree policy here due to cyclic dependency.
-// Consider restructuring packages.
-var preferFreePolicyName = PolicyName("prefer_free")
-
-func (s simplePolicyResults) Score(name PolicyName) PolicyScore {
-	if s.isFree && name == preferFreePolicyName {
-		return 1
-	}
-	return 0
+		if best == nil {
+			plan <- TransportPlan{Error: ErrNoTransport}
+			return
+		}
+		plan <- TransportPlan{TransportRequests: []*TransportRequest{{
+			Codec:           best.Protocol(),
+			Root:            cidlink.Link{Cid: targetRoot},
+			Selector:        targetSelector,
+			RoutingProvider: best.Provider(),
+			RoutingPayload:  best.Payload(),
+		}}}
+	}()
+	return plan
 }
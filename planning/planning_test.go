@@ -1,12 +1,17 @@
 package planning
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/filecoin-project/index-provider/metadata"
 	"github.com/ipfs-shipyard/w3rc/contentrouting"
 	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
 )
@@ -16,6 +21,7 @@ var _ contentrouting.RoutingRecord = (*testRoutingRecord)(nil)
 type testRoutingRecord struct {
 	request  cid.Cid
 	protocol multicodec.Code
+	provider interface{}
 	payload  []byte
 }
 
@@ -28,7 +34,7 @@ func (t testRoutingRecord) Protocol() multicodec.Code {
 }
 
 func (t testRoutingRecord) Provider() interface{} {
-	return nil
+	return t.provider
 }
 
 func (t testRoutingRecord) Payload() interface{} {
@@ -82,7 +88,7 @@ func TestFilecoinV1RecordInterpreter_Interpret(t *testing.T) {
 				FastRetrieval: true,
 			}),
 			wantPolicyResults: map[PolicyName]PolicyScore{
-				preferFreePolicyName: PolicyScore(0),
+				PreferFreePolicy: PolicyScore(0),
 			},
 		},
 		"FreeFilecoinV1ExchangeScoreIsOneForPreferFreePolicy": {
@@ -92,9 +98,36 @@ func TestFilecoinV1RecordInterpreter_Interpret(t *testing.T) {
 				FastRetrieval: true,
 			}),
 			wantPolicyResults: map[PolicyName]PolicyScore{
-				preferFreePolicyName: PolicyScore(1),
+				PreferFreePolicy: PolicyScore(1),
 			},
 		},
+		"DecodedFilecoinV1MetadataIsScored": {
+			givenRecord: &decodedRoutingRecord{
+				testRoutingRecord: testRoutingRecord{protocol: multicodec.TransportGraphsyncFilecoinv1},
+				payload:           &metadata.GraphsyncFilecoinV1{PieceCID: generateCid(t), VerifiedDeal: true, FastRetrieval: true},
+			},
+			wantPolicyResults: map[PolicyName]PolicyScore{
+				PreferFreePolicy: PolicyScore(1),
+				PreferFastPolicy: PolicyScore(0.5),
+			},
+		},
+		"SealedFilecoinV1ExchangeIsSlow": {
+			givenRecord: &decodedRoutingRecord{
+				testRoutingRecord: testRoutingRecord{protocol: multicodec.TransportGraphsyncFilecoinv1},
+				payload:           &metadata.GraphsyncFilecoinV1{PieceCID: generateCid(t), VerifiedDeal: true},
+			},
+			wantPolicyResults: map[PolicyName]PolicyScore{
+				PreferFreePolicy: PolicyScore(0),
+				PreferFastPolicy: PolicyScore(0),
+			},
+		},
+		"BitswapMetadataIsError": {
+			givenRecord: &decodedRoutingRecord{
+				testRoutingRecord: testRoutingRecord{protocol: multicodec.TransportBitswap},
+				payload:           &metadata.Bitswap{},
+			},
+			wantErr: "filecoin v1 routing record payload has unexpected type: *metadata.Bitswap",
+		},
 	}
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -122,6 +155,289 @@ func TestFilecoinV1RecordInterpreter_Interpret(t *testing.T) {
 	}
 }
 
+type testPolicy PolicyName
+
+func (p testPolicy) Name() PolicyName { return PolicyName(p) }
+
+func newTestPlanner(t *testing.T, minScore PolicyScore) (*SimplePlanner, PolicyPreferences) {
+	planner := NewSimplePlanner(NewSimpleSinglePlanner(minScore, 100*time.Millisecond))
+	if err := planner.RegisterRecordInterpreter(multicodec.TransportGraphsyncFilecoinv1, multicodec.TransportGraphsyncFilecoinv1, 1, FilecoinV1RecordInterpreter{}); err != nil {
+		t.Fatal(err)
+	}
+	var prefs PolicyPreferences
+	prefs.AddPolicy(1, testPolicy(PreferFreePolicy))
+	return planner, prefs
+}
+
+func sendRecords(records ...contentrouting.RoutingRecord) <-chan contentrouting.RoutingRecord {
+	ch := make(chan contentrouting.RoutingRecord, len(records))
+	for _, r := range records {
+		ch <- r
+	}
+	close(ch)
+	return ch
+}
+
+func TestRegisterRecordInterpreter(t *testing.T) {
+	planner, _ := newTestPlanner(t, 1)
+	err := planner.RegisterRecordInterpreter(multicodec.TransportBitswap, multicodec.TransportGraphsyncFilecoinv1, 1, FilecoinV1RecordInterpreter{})
+	if !errors.Is(err, ErrOverlappingRange) {
+		t.Fatalf("expected overlapping range error, got %v", err)
+	}
+	if err := planner.RegisterRecordInterpreter(multicodec.TransportBitswap, multicodec.TransportBitswap, 1, FilecoinV1RecordInterpreter{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanRequests(t *testing.T) {
+	paid := generateFilecoinV1RoutingRecord(t, &metadata.GraphsyncFilecoinV1{PieceCID: generateCid(t), FastRetrieval: true}).(*testRoutingRecord)
+	paid.provider = "paid"
+	free := generateFilecoinV1RoutingRecord(t, &metadata.GraphsyncFilecoinV1{PieceCID: generateCid(t), VerifiedDeal: true, FastRetrieval: true}).(*testRoutingRecord)
+	free.provider = "free"
+	unknown := &testRoutingRecord{protocol: multicodec.TransportBitswap, provider: "unknown"}
+
+	tests := map[string]struct {
+		minScore PolicyScore
+		records  []contentrouting.RoutingRecord
+		want     string
+	}{
+		"BestIsChosen":          {minScore: 2, records: []contentrouting.RoutingRecord{paid, free, unknown}, want: "free"},
+		"FirstGoodEnoughIsUsed": {minScore: 0, records: []contentrouting.RoutingRecord{paid, free}, want: "paid"},
+		"UninterpretedIsPassed": {minScore: 1, records: []contentrouting.RoutingRecord{unknown}},
+		"NoRecordsIsError":      {minScore: 1},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			planner, prefs := newTestPlanner(t, tt.minScore)
+			plan, ok := <-planner.PlanRequests(context.Background(), generateCid(t), nil, prefs, sendRecords(tt.records...))
+			if !ok {
+				t.Fatal("expected a plan")
+			}
+			if tt.want == "" {
+				if !errors.Is(plan.Error, ErrNoTransport) {
+					t.Fatalf("expected no transport, got %v", plan.Error)
+				}
+				return
+			}
+			if plan.Error != nil || len(plan.TransportRequests) != 1 {
+				t.Fatalf("unexpected plan %+v", plan)
+			}
+			if got := plan.TransportRequests[0].RoutingProvider; got != tt.want {
+				t.Fatalf("expected a request to %s, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPolicySchedulerFailover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	paid := generateFilecoinV1RoutingRecord(t, &metadata.GraphsyncFilecoinV1{PieceCID: generateCid(t), FastRetrieval: true}).(*testRoutingRecord)
+	paid.provider = "paid"
+	free := generateFilecoinV1RoutingRecord(t, &metadata.GraphsyncFilecoinV1{PieceCID: generateCid(t), VerifiedDeal: true, FastRetrieval: true}).(*testRoutingRecord)
+	free.provider = "free"
+
+	planner, prefs := newTestPlanner(t, 1)
+	scheduler := NewPolicyScheduler(planner, prefs)
+	plans := scheduler.Schedule(ctx, generateCid(t), nil, sendRecords(paid, free))
+	for _, want := range []string{"free", "paid"} {
+		plan, ok := <-plans
+		if !ok || plan.Error != nil || len(plan.TransportRequests) != 1 {
+			t.Fatalf("unexpected plan %+v", plan)
+		}
+		req := plan.TransportRequests[0]
+		if req.RoutingProvider != want {
+			t.Fatalf("expected a request to %s, got %v", want, req.RoutingProvider)
+		}
+		scheduler.Begin(req)
+		scheduler.Reconcile(req, false)
+	}
+	if plan, ok := <-plans; ok {
+		t.Fatalf("expected no more plans, got %+v", plan)
+	}
+}
+
+// decodedRoutingRecord is a record with a payload other than bytes.
+type decodedRoutingRecord struct {
+	testRoutingRecord
+	payload interface{}
+}
+
+func (d decodedRoutingRecord) Payload() interface{} {
+	return d.payload
+}
+
+type testReputations map[string]PolicyScore
+
+func (r testReputations) Reputation(provider interface{}) PolicyScore {
+	return r[fmt.Sprint(provider)]
+}
+
+func TestStandardInterpreters(t *testing.T) {
+	local := peer.AddrInfo{ID: "local", Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")}}
+	remote := peer.AddrInfo{ID: "remote", Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/1.2.3.4/tcp/4001")}}
+	reputations := testReputations{local.String(): 0.25}
+
+	tests := map[string]struct {
+		interpreter RoutingRecordInterpreter
+		record      contentrouting.RoutingRecord
+		want        standardResults
+		wantErr     bool
+	}{
+		"Bitswap": {
+			interpreter: BitswapRecordInterpreter{Reputations: reputations},
+			record:      &decodedRoutingRecord{testRoutingRecord{protocol: multicodec.TransportBitswap, provider: remote}, &metadata.Bitswap{}},
+			want:        standardResults{free: 1, fast: 0.5},
+		},
+		"LocalBitswap": {
+			interpreter: BitswapRecordInterpreter{Reputations: reputations},
+			record:      &decodedRoutingRecord{testRoutingRecord{protocol: multicodec.TransportBitswap, provider: local}, nil},
+			want:        standardResults{free: 1, fast: 0.5, local: 1, reputation: 0.25},
+		},
+		"Gateway": {
+			interpreter: HTTPRecordInterpreter{},
+			record:      &testRoutingRecord{protocol: multicodec.TransportIpfsGatewayHttp, provider: remote},
+			want:        standardResults{free: 1, fast: 1},
+		},
+		"GatewayGivenBitswap": {
+			interpreter: HTTPRecordInterpreter{},
+			record:      &testRoutingRecord{protocol: multicodec.TransportBitswap, provider: remote},
+			wantErr:     true,
+		},
+		"BitswapGivenError": {
+			interpreter: BitswapRecordInterpreter{},
+			record:      &contentrouting.RoutingError{Error: errors.New("fish")},
+			wantErr:     true,
+		},
+	}
+	policies := []PolicyName{PreferFreePolicy, PreferFastPolicy, PreferLocalPolicy, PreferReputablePolicy}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tt.interpreter.Interpret(tt.record, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range policies {
+				if got.Score(p) != tt.want.Score(p) {
+					t.Fatalf("unexpected score for %s: want %v, got %v", p, tt.want.Score(p), got.Score(p))
+				}
+			}
+		})
+	}
+}
+
+func TestPlanRequestsAcrossTransports(t *testing.T) {
+	planner := NewSimplePlanner(NewSimpleSinglePlanner(10, 100*time.Millisecond))
+	for _, code := range []multicodec.Code{multicodec.TransportBitswap, multicodec.TransportIpfsGatewayHttp} {
+		var interpreter RoutingRecordInterpreter = BitswapRecordInterpreter{}
+		if code == multicodec.TransportIpfsGatewayHttp {
+			interpreter = HTTPRecordInterpreter{}
+		}
+		if err := planner.RegisterRecordInterpreter(code, code, 1, interpreter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var prefs PolicyPreferences
+	prefs.AddPolicy(1, testPolicy(PreferFreePolicy))
+	prefs.AddPolicy(1, testPolicy(PreferFastPolicy))
+
+	records := sendRecords(
+		&testRoutingRecord{protocol: multicodec.TransportBitswap, provider: "bitswap"},
+		&testRoutingRecord{protocol: multicodec.TransportIpfsGatewayHttp, provider: "gateway"},
+	)
+	plan := <-planner.PlanRequests(context.Background(), generateCid(t), nil, prefs, records)
+	if plan.Error != nil || len(plan.TransportRequests) != 1 || plan.TransportRequests[0].RoutingProvider != "gateway" {
+		t.Fatalf("expected a request to the gateway, got %+v", plan)
+	}
+}
+
+func TestHighestScoreReputations(t *testing.T) {
+	board := NewBoard()
+	board.Reputations = testReputations{"known": 0.9, "unknown": 0.5, "failing": 0.1}
+	for _, p := range []string{"failing", "unknown", "known"} {
+		board.AddPossible(&TransportRequest{RoutingProvider: p})
+	}
+	if got := board.HighestScore().RoutingProvider; got != "known" {
+		t.Fatalf("expected the reputable provider, got %v", got)
+	}
+
+	// a failure in this session outweighs a good reputation.
+	board.Failed = append(board.Failed, &TransportRequest{RoutingProvider: "known"})
+	if got := board.HighestScore().RoutingProvider; got != "unknown" {
+		t.Fatalf("expected the unknown provider, got %v", got)
+	}
+}
+
+func TestHighestHedgeUnpaid(t *testing.T) {
+	board := NewBoard()
+	board.Reputations = testReputations{"paid": 0.9, "free": 0.1}
+	pending := &TransportRequest{Codec: multicodec.TransportBitswap, RoutingProvider: "stalled"}
+	paidReq := &TransportRequest{Codec: multicodec.TransportGraphsyncFilecoinv1, RoutingProvider: "paid"}
+	freeReq := &TransportRequest{Codec: multicodec.TransportBitswap, RoutingProvider: "free"}
+	for _, r := range []*TransportRequest{pending, paidReq, freeReq} {
+		board.AddPossible(r)
+	}
+	if got := board.HighestHedge(); got != paidReq {
+		t.Fatalf("expected the paid provider with nothing pending, got %v", got.RoutingProvider)
+	}
+
+	board.Begin(pending)
+	if got := board.HighestHedge(); got != freeReq {
+		t.Fatalf("expected only the free provider to race a pending request, got %v", got.RoutingProvider)
+	}
+	board.Begin(freeReq)
+	if got := board.HighestHedge(); got != nil {
+		t.Fatalf("expected no paid hedge, got %v", got.RoutingProvider)
+	}
+	if got := board.HighestScore(); got != paidReq {
+		t.Fatalf("expected the paid provider outside of hedging, got %v", got)
+	}
+}
+
+func TestSimpleSchedulerHedging(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records := sendRecords(
+		&testRoutingRecord{request: generateCid(t), protocol: multicodec.TransportBitswap, provider: "a"},
+		&testRoutingRecord{request: generateCid(t), protocol: multicodec.TransportBitswap, provider: "b"},
+	)
+	scheduler := NewSimpleScheduler(WithHedging(300 * time.Millisecond))
+	plans := scheduler.Schedule(ctx, generateCid(t), nil, records)
+
+	first := <-plans
+	if len(first.TransportRequests) != 1 {
+		t.Fatalf("unexpected plan %+v", first)
+	}
+	scheduler.Begin(first.TransportRequests[0])
+
+	// while the first request makes progress, no other is started.
+	progressing := time.After(600 * time.Millisecond)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+hold:
+	for {
+		select {
+		case plan := <-plans:
+			t.Fatalf("unexpected plan while progressing %+v", plan)
+		case <-ticker.C:
+			scheduler.(ProgressTracker).Progress(first.TransportRequests[0])
+		case <-progressing:
+			break hold
+		}
+	}
+
+	second := <-plans
+	if len(second.TransportRequests) != 1 || second.TransportRequests[0] == first.TransportRequests[0] {
+		t.Fatalf("expected another provider once stalled, got %+v", second)
+	}
+}
+
 func generateFilecoinV1RoutingRecord(t *testing.T, fv1d *metadata.GraphsyncFilecoinV1) contentrouting.RoutingRecord {
 	mbd, err := fv1d.MarshalBinary()
 	if err != nil {
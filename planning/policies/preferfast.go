@@ -0,0 +1,10 @@
+package policies
+
+import "github.com/ipfs-shipyard/w3rc/planning"
+
+// PreferFast prefers transports that deliver sooner.
+type PreferFast struct{}
+
+func (p PreferFast) Name() planning.PolicyName { return planning.PreferFastPolicy }
+
+var _ planning.Policy = PreferFast{}
@@ -2,8 +2,9 @@ package policies
 
 import "github.com/ipfs-shipyard/w3rc/planning"
 
+// PreferFree prefers retrievals that cost nothing.
 type PreferFree struct{}
 
-func (fp PreferFree) Name() planning.PolicyName { return "prefer_free" }
+func (fp PreferFree) Name() planning.PolicyName { return planning.PreferFreePolicy }
 
 var _ planning.Policy = PreferFree{}
@@ -0,0 +1,10 @@
+package policies
+
+import "github.com/ipfs-shipyard/w3rc/planning"
+
+// PreferLocal prefers providers on a loopback or private network.
+type PreferLocal struct{}
+
+func (p PreferLocal) Name() planning.PolicyName { return planning.PreferLocalPolicy }
+
+var _ planning.Policy = PreferLocal{}
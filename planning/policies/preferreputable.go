@@ -0,0 +1,10 @@
+package policies
+
+import "github.com/ipfs-shipyard/w3rc/planning"
+
+// PreferReputable prefers providers that have served retrievals well before.
+type PreferReputable struct{}
+
+func (p PreferReputable) Name() planning.PolicyName { return planning.PreferReputablePolicy }
+
+var _ planning.Policy = PreferReputable{}
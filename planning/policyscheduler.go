@@ -0,0 +1,208 @@
+package planning
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+)
+
+// NewPolicyScheduler creates a PolicyScheduler planning with planner by prefs.
+// The planner may be shared between schedulers.
+func NewPolicyScheduler(planner *SimplePlanner, prefs PolicyPreferences) Scheduler {
+	return &PolicyScheduler{
+		planner:  planner,
+		prefs:    prefs,
+		outcomes: make(map[*TransportRequest]bool),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// A PolicyScheduler plans a request at a time through a SimplePlanner. When
+// a request fails, it plans again among the records it has not yet tried,
+// until a request succeeds or routing has no more to offer.
+// PolicyScheduler only handles one Schedule call, like SimpleScheduler.
+type PolicyScheduler struct {
+	planner *SimplePlanner
+	prefs   PolicyPreferences
+
+	lk       sync.Mutex
+	outcomes map[*TransportRequest]bool
+	notify   chan struct{}
+}
+
+// Schedule begins planning the fetch of root+selector from potentialTransports.
+func (s *PolicyScheduler) Schedule(ctx context.Context, root cid.Cid, selector ipld.Node, potentialTransports <-chan contentrouting.RoutingRecord) <-chan TransportPlan {
+	plans := make(chan TransportPlan)
+	go s.background(ctx, root, selector, newRecordPool(potentialTransports), plans)
+	return plans
+}
+
+func (s *PolicyScheduler) background(ctx context.Context, root cid.Cid, selector ipld.Node, pool *recordPool, plans chan<- TransportPlan) {
+	defer close(plans)
+	var tried []*TransportRequest
+	for {
+		skip := append([]*TransportRequest(nil), tried...)
+		changed := pool.changed()
+		planCtx, cancel := context.WithCancel(ctx)
+		untried := pool.stream(planCtx, func(r contentrouting.RoutingRecord) bool {
+			for _, t := range skip {
+				if t.Codec == r.Protocol() && providersEqual(t.RoutingProvider, r.Provider()) {
+					return false
+				}
+			}
+			return true
+		})
+		plan, ok := <-s.planner.PlanRequests(planCtx, root, selector, s.prefs, untried)
+		cancel()
+		if !ok {
+			return
+		}
+		if plan.Error != nil {
+			// nothing was found in time, but routing may yet find more.
+			if pool.finished() {
+				return
+			}
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case plans <- plan:
+		case <-ctx.Done():
+			return
+		}
+		tried = append(tried, plan.TransportRequests...)
+		if succeeded, ok := s.wait(ctx, plan.TransportRequests); succeeded || !ok {
+			return
+		}
+	}
+}
+
+// wait blocks until every request is reconciled or one succeeds, returning
+// whether one did, or false for ok if ctx ends first.
+func (s *PolicyScheduler) wait(ctx context.Context, requests []*TransportRequest) (succeeded bool, ok bool) {
+	for {
+		s.lk.Lock()
+		failed := 0
+		for _, r := range requests {
+			success, done := s.outcomes[r]
+			if done && success {
+				s.lk.Unlock()
+				return true, true
+			}
+			if done {
+				failed++
+			}
+		}
+		s.lk.Unlock()
+		if failed == len(requests) {
+			return false, true
+		}
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return false, false
+		}
+	}
+}
+
+// Begin is called to tell the scheduler that a transport request has begun
+func (s *PolicyScheduler) Begin(r *TransportRequest) {}
+
+// Reconcile is called to tell that a transport request has finished
+func (s *PolicyScheduler) Reconcile(r *TransportRequest, success bool) {
+	s.lk.Lock()
+	s.outcomes[r] = success
+	s.lk.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// recordPool keeps the records routing finds, so that they can be gone over
+// again for each plan.
+type recordPool struct {
+	lk      sync.Mutex
+	records []contentrouting.RoutingRecord
+	done    bool
+	// updated is closed, and replaced, whenever records are added or done.
+	updated chan struct{}
+}
+
+// newRecordPool drains records into a pool, until routing closes it.
+func newRecordPool(records <-chan contentrouting.RoutingRecord) *recordPool {
+	p := &recordPool{updated: make(chan struct{})}
+	go func() {
+		for r := range records {
+			p.lk.Lock()
+			p.records = append(p.records, r)
+			close(p.updated)
+			p.updated = make(chan struct{})
+			p.lk.Unlock()
+		}
+		p.lk.Lock()
+		p.done = true
+		close(p.updated)
+		p.lk.Unlock()
+	}()
+	return p
+}
+
+// changed is closed when records are next added, or routing is done.
+func (p *recordPool) changed() <-chan struct{} {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.updated
+}
+
+func (p *recordPool) finished() bool {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.done
+}
+
+// stream sends each record kept, both those held and those yet to come, until
+// routing is done or ctx ends.
+func (p *recordPool) stream(ctx context.Context, keep func(contentrouting.RoutingRecord) bool) <-chan contentrouting.RoutingRecord {
+	out := make(chan contentrouting.RoutingRecord)
+	go func() {
+		defer close(out)
+		next := 0
+		for {
+			p.lk.Lock()
+			pending := p.records[next:]
+			done, updated := p.done, p.updated
+			p.lk.Unlock()
+			for _, r := range pending {
+				next++
+				if !keep(r) {
+					continue
+				}
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if len(pending) > 0 {
+				continue
+			}
+			if done {
+				return
+			}
+			select {
+			case <-updated:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
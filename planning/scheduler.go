@@ -24,24 +24,61 @@ type Scheduler interface {
 	Reconcile(r *TransportRequest, success bool)
 }
 
+// A SchedulerOption configures a SimpleScheduler.
+type SchedulerOption func(*SimpleScheduler)
+
+// WithReputations also weighs providers by how they have served before.
+func WithReputations(r Reputations) SchedulerOption {
+	return func(s *SimpleScheduler) {
+		s.board.Reputations = r
+	}
+}
+
+// A ProgressTracker is a Scheduler that is also told when data arrives for a
+// transport request it planned.
+type ProgressTracker interface {
+	Progress(r *TransportRequest)
+}
+
+// WithHedging holds back other providers while a pending request makes
+// progress. Only once no data has arrived for after are further providers
+// started alongside those pending, to race them. Paid transports are not
+// raced, as both requests would be paid for.
+func WithHedging(after time.Duration) SchedulerOption {
+	return func(s *SimpleScheduler) {
+		s.hedgeAfter = after
+	}
+}
+
+var _ ProgressTracker = (*SimpleScheduler)(nil)
+
 // NewSimpleScheduler creates an instance of a SimpleScheduler
-func NewSimpleScheduler() Scheduler {
-	return &SimpleScheduler{
+func NewSimpleScheduler(opts ...SchedulerOption) Scheduler {
+	s := &SimpleScheduler{
 		board: NewBoard(),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // A SimpleScheduler will attempt to generate a tansport plan based on a board tracking active requests
 type SimpleScheduler struct {
 	board    *Board
 	plan     chan TransportPlan
+	root     cid.Cid
 	selector ipld.Node
+	// hedgeAfter, if set, is how long pending requests may go without
+	// progress before another provider is started.
+	hedgeAfter time.Duration
 }
 
 // Schedule begins a schedule to get a cid+selector given a stream of potential routes.
 // SimpleScheduler only handles one Schedule call concurrently.
 func (s *SimpleScheduler) Schedule(ctx context.Context, root cid.Cid, selector ipld.Node, potentialTransports <-chan contentrouting.RoutingRecord) <-chan TransportPlan {
 	s.plan = make(chan TransportPlan)
+	s.root = root
 	s.selector = selector
 
 	go s.background(ctx, potentialTransports)
@@ -73,14 +110,14 @@ func (s *SimpleScheduler) background(ctx context.Context, potentialTransports <-
 
 			option := TransportRequest{
 				Codec:           newOption.Protocol(),
-				Root:            cidlink.Link{Cid: newOption.Request()},
-				Selector:        s.selector, // todo: sub-selectors
+				Root:            cidlink.Link{Cid: s.root}, // the record may be for a dag that root is within.
+				Selector:        s.selector,                // the session narrows this to the subtrees it is missing.
 				RoutingProvider: newOption.Provider(),
 				RoutingPayload:  newOption.Payload(),
 			}
 			s.board.AddPossible(&option)
 		case <-ticker.C:
-			s.emitNext()
+			s.emitNext(ctx)
 		}
 		if potentialTransports == nil && !s.board.Active() {
 			return
@@ -88,18 +125,33 @@ func (s *SimpleScheduler) background(ctx context.Context, potentialTransports <-
 	}
 }
 
-func (s *SimpleScheduler) emitNext() {
-	best := s.board.HighestScore()
+func (s *SimpleScheduler) emitNext(ctx context.Context) {
+	if s.hedgeAfter > 0 && !s.board.Stalled(s.hedgeAfter) {
+		return
+	}
+	var next TransportPlan
+	var best *TransportRequest
+	if s.hedgeAfter > 0 {
+		best = s.board.HighestHedge()
+	} else {
+		best = s.board.HighestScore()
+	}
 	if best != nil {
-		s.plan <- TransportPlan{
+		next = TransportPlan{
 			TransportRequests: []*TransportRequest{best},
 			Error:             nil,
 		}
 	} else if len(s.board.Pending) == 0 {
-		s.plan <- TransportPlan{
+		next = TransportPlan{
 			TransportRequests: nil,
 			Error:             ErrNoTransport,
 		}
+	} else {
+		return
+	}
+	select {
+	case s.plan <- next:
+	case <-ctx.Done():
 	}
 }
 
@@ -108,6 +160,11 @@ func (s *SimpleScheduler) Begin(r *TransportRequest) {
 	s.board.Begin(r)
 }
 
+// Progress is called to tell that data has arrived for a transport request
+func (s *SimpleScheduler) Progress(r *TransportRequest) {
+	s.board.Progress(r)
+}
+
 // Reconcile is called to tell that a transport request has finished
 func (s *SimpleScheduler) Reconcile(r *TransportRequest, success bool) {
 	s.board.Reconcile(r, success)
@@ -2,49 +2,81 @@ package planning
 
 import "github.com/ipfs-shipyard/w3rc/contentrouting"
 
-// Note: this is a future-looking class for a more extensible planning policy.
-// It is not currently used.
-
+// PolicyName identifies a policy, such as "prefer_free".
 type PolicyName string
 
+// The policies the standard interpreters score records by.
+const (
+	// PreferFreePolicy scores retrievals that cost nothing.
+	PreferFreePolicy PolicyName = "prefer_free"
+	// PreferFastPolicy scores transports by how soon they deliver.
+	PreferFastPolicy PolicyName = "prefer_fast"
+	// PreferLocalPolicy scores providers on a loopback or private network.
+	PreferLocalPolicy PolicyName = "prefer_local"
+	// PreferReputablePolicy scores providers by how they have served before.
+	PreferReputablePolicy PolicyName = "prefer_reputable"
+)
+
+// A Policy is a property of retrievals that some are preferred for.
 type Policy interface {
 	Name() PolicyName
 }
 
+// PolicyResults are how well a routing record satisfies each policy.
 type PolicyResults interface {
 	// must be in range from zero to 1, will get dropped otherwise
 	// should return zero for policies that are unrecognized
 	Score(PolicyName) PolicyScore
 }
 
+// PolicyWeight is how much a policy, or a transport, counts towards a score.
 type PolicyWeight float64
+
+// PolicyPreferences weigh the policies a record is scored by.
+// The zero value has no preferences, and scores every record as 0.
 type PolicyPreferences struct {
-	preferences map[PolicyWeight]Policy
+	preferences []weightedPolicy
 }
 
+type weightedPolicy struct {
+	weight PolicyWeight
+	policy Policy
+}
+
+// PolicyScore is how preferable a record is, the higher the better.
 type PolicyScore float64
 
+// WeightedScore sums the scores of results for each policy by its weight,
+// then scales the sum by the multiplier of the record's transport.
 func (p *PolicyPreferences) WeightedScore(results PolicyResults, transportMultipler PolicyWeight) PolicyScore {
 	score := PolicyScore(0)
-	for weight, policy := range p.preferences {
-		pscore := results.Score(policy.Name())
+	for _, wp := range p.preferences {
+		pscore := results.Score(wp.policy.Name())
 		if pscore < 0 || pscore > 1 {
 			continue
 		}
-		score += pscore * PolicyScore(weight)
+		score += pscore * PolicyScore(wp.weight)
 	}
 	score *= PolicyScore(transportMultipler)
 	return score
 }
 
+// AddPolicy weighs policy by weight, in place of any policy of the same name.
 func (p *PolicyPreferences) AddPolicy(weight PolicyWeight, policy Policy) {
-	p.preferences[weight] = policy
+	for i, wp := range p.preferences {
+		if wp.policy.Name() == policy.Name() {
+			p.preferences[i] = weightedPolicy{weight, policy}
+			return
+		}
+	}
+	p.preferences = append(p.preferences, weightedPolicy{weight, policy})
 }
 
+// Policies lists the policies preferences are given for.
 func (p *PolicyPreferences) Policies() []Policy {
 	policies := make([]Policy, 0, len(p.preferences))
-	for _, policy := range p.preferences {
-		policies = append(policies, policy)
+	for _, wp := range p.preferences {
+		policies = append(policies, wp.policy)
 	}
 	return policies
 }
@@ -54,6 +86,7 @@ type RoutingRecordInterpreter interface {
 	Interpret(record contentrouting.RoutingRecord, policies []Policy) (PolicyResults, error)
 }
 
+// PotentialRequest is a routing record along with its weighted score.
 type PotentialRequest struct {
 	PolicyScore
 	contentrouting.RoutingRecord
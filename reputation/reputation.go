@@ -0,0 +1,263 @@
+// Package reputation remembers how well providers have served retrievals, so
+// that later sessions over the same datastore can prefer those that served
+// well before.
+package reputation
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs-shipyard/w3rc/planning"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var log = logging.Logger("w3rc-reputation")
+
+// DefaultHalfLife is how long it takes by default for an outcome to count
+// for half as much.
+const DefaultHalfLife = 7 * 24 * time.Hour
+
+// sampleWeight is how much a new outcome moves the averaged time to first
+// byte and throughput.
+const sampleWeight = 0.25
+
+// speedWeight is how much how soon and how fast a provider delivers counts
+// towards its score, next to how often it succeeds.
+const speedWeight = 0.25
+
+// typicalTimeToFirstByte and typicalThroughput, in bytes per second, are the
+// speeds that count for half between the slowest and the fastest.
+const (
+	typicalTimeToFirstByte = time.Second
+	typicalThroughput      = 1 << 20
+)
+
+var keyPrefix = datastore.NewKey("/reputation")
+
+var _ planning.Reputations = (*Store)(nil)
+
+// An Option configures a Store.
+type Option func(*Store)
+
+// WithHalfLife sets how long it takes for an outcome to count for half as
+// much towards a reputation.
+func WithHalfLife(halfLife time.Duration) Option {
+	return func(s *Store) {
+		s.halfLife = halfLife
+	}
+}
+
+// Store keeps the reputation of each provider in a datastore.
+type Store struct {
+	ds       datastore.Batching
+	halfLife time.Duration
+	now      func() time.Time
+
+	// lk guards known, the reputations in ds, which are read once and then
+	// written through, so that scoring does not wait on the datastore.
+	lk     sync.Mutex
+	loaded bool
+	known  map[datastore.Key]Reputation
+	// putLk orders writes to ds.
+	putLk sync.Mutex
+}
+
+// New creates a Store keeping reputations in ds.
+func New(ds datastore.Batching, opts ...Option) *Store {
+	s := &Store{ds: ds, halfLife: DefaultHalfLife, now: time.Now, known: make(map[datastore.Key]Reputation)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Outcome is how a single request to a provider went.
+type Outcome struct {
+	Success bool
+	// TimeToFirstByte is how long the first data took to arrive, or zero if
+	// none did.
+	TimeToFirstByte time.Duration
+	// Bytes is how much data was received, where the transport tells.
+	Bytes    uint64
+	Duration time.Duration
+	// Err is why the request failed.
+	Err error
+}
+
+// Reputation is what is known of a provider, with older outcomes counting
+// for less.
+type Reputation struct {
+	Successes float64
+	Failures  float64
+	// TimeToFirstByte and Throughput, in bytes per second, are averages
+	// weighted towards recent outcomes, or zero where unknown.
+	TimeToFirstByte time.Duration
+	Throughput      float64
+	LastFailure     string    `json:",omitempty"`
+	LastFailureAt   time.Time `json:",omitempty"`
+	Updated         time.Time
+}
+
+// SuccessRate is the share of requests to the provider that succeeded, from
+// an even start, so that it is 0.5 for a provider not yet seen.
+func (r Reputation) SuccessRate() float64 {
+	return (r.Successes + 1) / (r.Successes + r.Failures + 2)
+}
+
+// Score rates the provider from 0 to 1, mostly by its success rate and then
+// by how soon and how fast it delivers, so that of providers as reliable the
+// faster are preferred. A provider not yet seen scores 0.5.
+func (r Reputation) Score() float64 {
+	return (1-speedWeight)*r.SuccessRate() + speedWeight*r.speed()
+}
+
+// speed is how soon and how fast the provider delivers, from 0 to 1, with
+// what is not yet measured counting as typical.
+func (r Reputation) speed() float64 {
+	first, rate := 0.5, 0.5
+	if r.TimeToFirstByte > 0 {
+		first = 1 / (1 + float64(r.TimeToFirstByte)/float64(typicalTimeToFirstByte))
+	}
+	if r.Throughput > 0 {
+		rate = r.Throughput / (r.Throughput + typicalThroughput)
+	}
+	return (first + rate) / 2
+}
+
+// decayed is r as of now, its outcomes counting for less as time has passed.
+func (r Reputation) decayed(now time.Time, halfLife time.Duration) Reputation {
+	if halfLife <= 0 || r.Updated.IsZero() || !now.After(r.Updated) {
+		return r
+	}
+	factor := math.Pow(0.5, float64(now.Sub(r.Updated))/float64(halfLife))
+	r.Successes *= factor
+	r.Failures *= factor
+	r.Updated = now
+	return r
+}
+
+// Get returns the reputation of provider, which is the zero Reputation for
+// a provider without any.
+func (s *Store) Get(ctx context.Context, provider interface{}) (Reputation, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if err := s.load(ctx); err != nil {
+		return Reputation{}, err
+	}
+	return s.known[key(provider)].decayed(s.now(), s.halfLife), nil
+}
+
+// Record adds the outcome of a request to the reputation of provider.
+func (s *Store) Record(ctx context.Context, provider interface{}, o Outcome) error {
+	k := key(provider)
+	s.lk.Lock()
+	if err := s.load(ctx); err != nil {
+		s.lk.Unlock()
+		return err
+	}
+	now := s.now()
+	r := s.known[k].decayed(now, s.halfLife)
+	r.Updated = now
+	if o.Success {
+		r.Successes++
+	} else {
+		r.Failures++
+		r.LastFailure, r.LastFailureAt = "unknown", now
+		if o.Err != nil {
+			r.LastFailure = o.Err.Error()
+		}
+	}
+	if o.TimeToFirstByte > 0 {
+		r.TimeToFirstByte = time.Duration(average(float64(r.TimeToFirstByte), float64(o.TimeToFirstByte)))
+	}
+	if o.Bytes > 0 && o.Duration > 0 {
+		r.Throughput = average(r.Throughput, float64(o.Bytes)/o.Duration.Seconds())
+	}
+	s.known[k] = r
+	s.lk.Unlock()
+	return s.persist(ctx, k)
+}
+
+// Reputation scores provider by Score, for the prefer_reputable policy.
+// Providers that cannot be looked up score as those not yet seen.
+func (s *Store) Reputation(provider interface{}) planning.PolicyScore {
+	r, err := s.Get(context.Background(), provider)
+	if err != nil {
+		log.Debugf("could not look up reputation of %v: %s", provider, err)
+	}
+	return planning.PolicyScore(r.Score())
+}
+
+// load reads the reputations in ds into known, the first time it is called.
+// lk must be held.
+func (s *Store) load(ctx context.Context) error {
+	if s.loaded {
+		return nil
+	}
+	res, err := s.ds.Query(ctx, query.Query{Prefix: keyPrefix.String()})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		var r Reputation
+		if err := json.Unmarshal(e.Value, &r); err != nil {
+			log.Debugf("skipping malformed reputation %s: %s", e.Key, err)
+			continue
+		}
+		s.known[datastore.NewKey(e.Key)] = r
+	}
+	s.loaded = true
+	return nil
+}
+
+// persist writes the reputation known for k to ds, outside lk. Whichever
+// write comes last writes the latest reputation.
+func (s *Store) persist(ctx context.Context, k datastore.Key) error {
+	s.putLk.Lock()
+	defer s.putLk.Unlock()
+	s.lk.Lock()
+	r := s.known[k]
+	s.lk.Unlock()
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.ds.Put(ctx, k, b)
+}
+
+func average(prev, sample float64) float64 {
+	if prev == 0 {
+		return sample
+	}
+	return prev + sampleWeight*(sample-prev)
+}
+
+// key identifies a provider by its peer id where it has one, or else by its
+// addresses, as gateways have no peer id.
+func key(provider interface{}) datastore.Key {
+	id := fmt.Sprint(provider)
+	if ai, ok := provider.(peer.AddrInfo); ok {
+		id = ai.ID.String()
+		if ai.ID == "" {
+			addrs := make([]string, 0, len(ai.Addrs))
+			for _, a := range ai.Addrs {
+				addrs = append(addrs, a.String())
+			}
+			id = strings.Join(addrs, ",")
+		}
+	}
+	return keyPrefix.ChildString(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(id)))
+}
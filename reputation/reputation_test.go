@@ -0,0 +1,93 @@
+package reputation
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func TestRecord(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+	now := time.Unix(1000000, 0)
+	s := New(ds, WithHalfLife(time.Hour))
+	s.now = func() time.Time { return now }
+
+	gateway := peer.AddrInfo{Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/dns4/example.com/tcp/443/https")}}
+	other := peer.AddrInfo{Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/dns4/example.org/tcp/443/https")}}
+	if got := s.Reputation(gateway); got != 0.5 {
+		t.Fatalf("expected an unknown provider to score 0.5, got %v", got)
+	}
+
+	if err := s.Record(ctx, gateway, Outcome{Success: true, TimeToFirstByte: 100 * time.Millisecond, Bytes: 2000, Duration: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Record(ctx, gateway, Outcome{Err: errors.New("gateway responded with 504")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Record(ctx, gateway, Outcome{Success: true, TimeToFirstByte: 500 * time.Millisecond, Bytes: 1000, Duration: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+
+	// reputations outlive the store, in its datastore.
+	s = New(ds, WithHalfLife(time.Hour))
+	s.now = func() time.Time { return now }
+	r, err := s.Get(ctx, gateway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Successes != 2 || r.Failures != 1 || r.SuccessRate() != 0.6 {
+		t.Fatalf("unexpected reputation %+v", r)
+	}
+	if r.TimeToFirstByte != 200*time.Millisecond || r.Throughput != 1750 {
+		t.Fatalf("unexpected averages %+v", r)
+	}
+	if r.LastFailure != "gateway responded with 504" || !r.LastFailureAt.Equal(now) {
+		t.Fatalf("unexpected last failure %+v", r)
+	}
+	if got := s.Reputation(other); got != 0.5 {
+		t.Fatalf("expected a provider at other addresses to be unknown, got %v", got)
+	}
+
+	// outcomes count for half as much after each half life.
+	now = now.Add(2 * time.Hour)
+	r, err = s.Get(ctx, gateway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(r.Successes-0.5) > 1e-9 || math.Abs(r.Failures-0.25) > 1e-9 {
+		t.Fatalf("unexpected decayed reputation %+v", r)
+	}
+}
+
+func TestScore(t *testing.T) {
+	ctx := context.Background()
+	s := New(datastore.NewMapDatastore())
+	fast := peer.AddrInfo{Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/dns4/fast.example.com/tcp/443/https")}}
+	slow := peer.AddrInfo{Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/dns4/slow.example.com/tcp/443/https")}}
+	failing := peer.AddrInfo{Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/dns4/failing.example.com/tcp/443/https")}}
+
+	if err := s.Record(ctx, fast, Outcome{Success: true, TimeToFirstByte: 50 * time.Millisecond, Bytes: 10 << 20, Duration: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Record(ctx, slow, Outcome{Success: true, TimeToFirstByte: 5 * time.Second, Bytes: 10 << 10, Duration: 10 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Record(ctx, failing, Outcome{Err: errors.New("timed out")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// of providers as reliable, the faster scores higher.
+	if s.Reputation(fast) <= s.Reputation(slow) {
+		t.Fatalf("expected the fast provider to score above the slow one, got %v and %v", s.Reputation(fast), s.Reputation(slow))
+	}
+	if s.Reputation(slow) <= 0.5 || s.Reputation(failing) >= 0.5 {
+		t.Fatalf("expected success to count before speed, got %v and %v", s.Reputation(slow), s.Reputation(failing))
+	}
+}
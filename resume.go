@@ -0,0 +1,78 @@
+package w3rc
+
+import (
+	"time"
+
+	"github.com/ipfs-shipyard/w3rc/planning"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+// maxResumeRequests bounds how many subtree requests a single scheduled transport
+// request is split into. Remaining subtrees are requested from the same provider
+// once the first batch completes.
+const maxResumeRequests = 32
+
+// an attempt tracks a transport request from the scheduler, which may be carried
+// out as several requests over the missing subtrees of the dag.
+type attempt struct {
+	request     *planning.TransportRequest
+	outstanding int
+	failed      bool
+	// started, firstByte and received measure the attempt for the reputation
+	// of its provider. received holds what each request has received.
+	started   time.Time
+	firstByte time.Time
+	received  map[*planning.TransportRequest]uint64
+}
+
+// subtreeSelector returns the selector to apply under any link reached by selector,
+// if there is one. This is only the case for unbounded recursive selectors
+// exploring everything, where every subtree is selected in the same way as the root.
+func subtreeSelector(selector datamodel.Node) (datamodel.Node, bool) {
+	if datamodel.DeepEqual(selector, selectorparse.CommonSelector_ExploreAllRecursively) ||
+		datamodel.DeepEqual(selector, selectorparse.CommonSelector_MatchAllRecursively) {
+		return selector, true
+	}
+	return nil, false
+}
+
+// narrow derives the requests needed to fetch the missing frontier of a dag with
+// the same transport and provider as tr. A nil frontier, one that includes the
+// root, or a selector that cannot be applied to subtrees, results in tr itself.
+func narrow(tr *planning.TransportRequest, frontier []MissingLink) []*planning.TransportRequest {
+	if len(frontier) == 0 || frontier[0].Path.Len() == 0 {
+		return []*planning.TransportRequest{tr}
+	}
+	sel, ok := subtreeSelector(tr.Selector)
+	if !ok {
+		return []*planning.TransportRequest{tr}
+	}
+	if len(frontier) > maxResumeRequests {
+		frontier = frontier[:maxResumeRequests]
+	}
+	reqs := make([]*planning.TransportRequest, 0, len(frontier))
+	for _, m := range frontier {
+		reqs = append(reqs, &planning.TransportRequest{
+			Codec:           tr.Codec,
+			Root:            m.Link,
+			Selector:        sel,
+			RoutingProvider: tr.RoutingProvider,
+			RoutingPayload:  tr.RoutingPayload,
+		})
+	}
+	return reqs
+}
+
+// sameFrontier is true when no progress has been made between two frontiers.
+func sameFrontier(a, b []MissingLink) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Link != b[i].Link {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,440 @@
+// Package server exposes retrieval through a w3rc Session over HTTP, in the
+// manner of a trustless IPFS gateway: /ipfs/{cid}[/path] is answered as a raw
+// block or a CAR where asked, and otherwise as the UnixFS file at the path.
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs-shipyard/w3rc"
+	"github.com/ipfs-shipyard/w3rc/namesys"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipfs/go-unixfsnode/directory"
+	"github.com/ipfs/go-unixfsnode/hamt"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/schema"
+	"github.com/ipld/go-ipld-prime/traversal"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/multiformats/go-varint"
+)
+
+var log = logging.Logger("w3rc-server")
+
+// These are the media types of the trustless responses.
+const (
+	RawType = "application/vnd.ipld.raw"
+	CarType = "application/vnd.ipld.car"
+)
+
+// chooser loads dag-pb blocks in the form UnixFS reification expects.
+var chooser = dagpb.AddSupportToChooser(basicnode.Chooser)
+
+// Handler serves content retrieved through a session.
+type Handler struct {
+	session w3rc.Session
+	ls      ipld.LinkSystem
+}
+
+// NewHandler creates a Handler retrieving through session, which must store
+// the blocks it retrieves in ls. The session is shared by every request, so
+// its storage must allow concurrent use.
+func NewHandler(session w3rc.Session, ls ipld.LinkSystem) *Handler {
+	// blocks are interpreted as UnixFS where it is wanted, and walked as is otherwise.
+	ls.NodeReifier = nil
+	return &Handler{session: session, ls: ls}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/ipfs/") && !strings.HasPrefix(r.URL.Path, "/ipns/") {
+		http.NotFound(w, r)
+		return
+	}
+	format, err := responseFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	root, path, err := h.session.Resolve(r.Context(), r.URL.Path)
+	if err != nil {
+		if errors.Is(err, namesys.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	w.Header().Set("X-Ipfs-Path", r.URL.Path)
+	if strings.HasPrefix(r.URL.Path, "/ipfs/") {
+		iw := &immutableWriter{ResponseWriter: w}
+		// a HEAD response may have nothing written before it is committed.
+		defer iw.WriteHeader(http.StatusOK)
+		w = iw
+	}
+
+	switch format {
+	case RawType:
+		err = h.serveRaw(w, r, root, path)
+	case CarType:
+		err = h.serveCar(w, r, root, path)
+	default:
+		err = h.serveUnixFS(w, r, root, path)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+// immutableWriter marks successful responses as cacheable for good, as the
+// content of an /ipfs/ path never changes. Errors are left uncached.
+type immutableWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *immutableWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusOK || code == http.StatusPartialContent {
+		w.Header().Set("Cache-Control", "public, max-age=29030400, immutable")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *immutableWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+// responseFormat is the media type asked for by the format parameter or else
+// the Accept header, which is empty for UnixFS.
+func responseFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "raw":
+		return RawType, nil
+	case "car":
+		return CarType, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported format %q", f)
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(accept, ",") {
+			mt := strings.TrimSpace(strings.SplitN(t, ";", 2)[0])
+			if mt == RawType || mt == CarType {
+				return mt, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func dagScope(r *http.Request) (w3rc.Scope, error) {
+	switch s := r.URL.Query().Get("dag-scope"); s {
+	case "", "all":
+		return w3rc.ScopeAll, nil
+	case "entity":
+		return w3rc.ScopeEntity, nil
+	case "block":
+		return w3rc.ScopeBlock, nil
+	default:
+		return 0, fmt.Errorf("unsupported dag-scope %q", s)
+	}
+}
+
+func errorStatus(err error) int {
+	var noField schema.ErrNoSuchField
+	var notExists datamodel.ErrNotExists
+	switch {
+	case errors.As(err, &noField), errors.As(err, &notExists):
+		return http.StatusNotFound
+	case errors.Is(err, w3rc.ErrNotFile):
+		return http.StatusNotAcceptable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func (h *Handler) serveRaw(w http.ResponseWriter, r *http.Request, root cid.Cid, path datamodel.Path) error {
+	if _, err := h.session.GetPath(r.Context(), root, path.String(), w3rc.ScopeBlock); err != nil {
+		return err
+	}
+	c, err := h.walk(r.Context(), &h.ls, root, path)
+	if err != nil {
+		return err
+	}
+	blk, err := h.ls.LoadRaw(ipld.LinkContext{Ctx: r.Context()}, cidlink.Link{Cid: c})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", RawType)
+	w.Header().Set("Content-Length", fmt.Sprint(len(blk)))
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, _ = w.Write(blk)
+	return nil
+}
+
+func (h *Handler) serveCar(w http.ResponseWriter, r *http.Request, root cid.Cid, path datamodel.Path) error {
+	scope, err := dagScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if _, err := h.session.GetPath(r.Context(), root, path.String(), scope); err != nil {
+		return err
+	}
+	blocks, err := h.collect(r.Context(), root, path, scope)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", CarType+"; version=1")
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	// the response has begun, so failures past here can only cut it short.
+	if err := writeCar(r.Context(), w, &h.ls, root, blocks); err != nil {
+		log.Warnf("writing car for %s: %s", r.URL.Path, err)
+	}
+	return nil
+}
+
+func (h *Handler) serveUnixFS(w http.ResponseWriter, r *http.Request, root cid.Cid, path datamodel.Path) error {
+	n, err := h.session.GetPath(r.Context(), root, path.String(), w3rc.ScopeBlock)
+	if err != nil {
+		return err
+	}
+	switch n.(type) {
+	case directory.UnixFSBasicDir, hamt.UnixFSHAMTShard:
+	default:
+		return h.serveFile(w, r, root, path)
+	}
+
+	// relative links in a directory index need the path to end in a slash.
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		u := *r.URL
+		u.Path += "/"
+		u.RawPath = ""
+		http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+		return nil
+	}
+	index := path.AppendSegmentString("index.html")
+	if _, err := h.session.GetPath(r.Context(), root, index.String(), w3rc.ScopeBlock); err == nil {
+		return h.serveFile(w, r, root, index)
+	}
+	dir, err := h.session.GetPath(r.Context(), root, path.String(), w3rc.ScopeEntity)
+	if err != nil {
+		return err
+	}
+	var names []string
+	itr := dir.MapIterator()
+	for !itr.Done() {
+		k, _, err := itr.Next()
+		if err != nil {
+			return err
+		}
+		name, err := k.AsString()
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+	return nil
+}
+
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, root cid.Cid, path datamodel.Path) error {
+	rs, err := h.session.GetRange(r.Context(), root, path.String(), 0, 0)
+	if err != nil {
+		return err
+	}
+	name := ""
+	if path.Len() > 0 {
+		name = path.Last().String()
+	}
+	// the file is fetched as it is read, for whichever range is asked.
+	http.ServeContent(w, r, name, time.Time{}, rs)
+	return nil
+}
+
+// walk follows path under root through blocks already held, returning the cid
+// the path ends at.
+func (h *Handler) walk(ctx context.Context, lsys *ipld.LinkSystem, root cid.Cid, path datamodel.Path) (cid.Cid, error) {
+	c := root
+	for _, seg := range path.Segments() {
+		n, err := load(ctx, lsys, c)
+		if err != nil {
+			return cid.Undef, err
+		}
+		entry, err := n.LookupBySegment(seg)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if c, err = linkCid(entry); err != nil {
+			return cid.Undef, err
+		}
+	}
+	return c, nil
+}
+
+// collect returns the cids of the blocks along path under root, then those of
+// the dag in scope where it ends, in the order they are visited. The blocks
+// must already be held, as after GetPath with the same scope.
+func (h *Handler) collect(ctx context.Context, root cid.Cid, path datamodel.Path, scope w3rc.Scope) ([]cid.Cid, error) {
+	var blocks []cid.Cid
+	seen := make(map[cid.Cid]struct{})
+	lsys := h.ls
+	lsys.StorageReadOpener = func(lc linking.LinkContext, l datamodel.Link) (io.Reader, error) {
+		if cl, ok := l.(cidlink.Link); ok {
+			if _, ok := seen[cl.Cid]; !ok {
+				seen[cl.Cid] = struct{}{}
+				blocks = append(blocks, cl.Cid)
+			}
+		}
+		return h.ls.StorageReadOpener(lc, l)
+	}
+
+	c, err := h.walk(ctx, &lsys, root, path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := load(ctx, &lsys, c)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case scope == w3rc.ScopeAll:
+		err = walkAll(ctx, &lsys, c)
+	case scope == w3rc.ScopeEntity:
+		if _, ok := n.(hamt.UnixFSHAMTShard); ok {
+			// listing a sharded directory visits each of its shards.
+			itr := n.MapIterator()
+			for !itr.Done() && err == nil {
+				_, _, err = itr.Next()
+			}
+		} else if n.Kind() == datamodel.Kind_Bytes {
+			err = walkAll(ctx, &lsys, c)
+		}
+	}
+	return blocks, err
+}
+
+// load loads the node at c, interpreted as UnixFS where it is so.
+func load(ctx context.Context, lsys *ipld.LinkSystem, c cid.Cid) (ipld.Node, error) {
+	lnk := cidlink.Link{Cid: c}
+	lc := ipld.LinkContext{Ctx: ctx}
+	np, err := chooser(lnk, lc)
+	if err != nil {
+		return nil, err
+	}
+	n, err := lsys.Load(lc, lnk, np)
+	if err != nil {
+		return nil, err
+	}
+	return unixfsnode.Reify(lc, n, lsys)
+}
+
+// walkAll visits every block of the dag under c.
+func walkAll(ctx context.Context, lsys *ipld.LinkSystem, c cid.Cid) error {
+	sel, err := ipldselector.CompileSelector(selectorparse.CommonSelector_ExploreAllRecursively)
+	if err != nil {
+		return err
+	}
+	lnk := cidlink.Link{Cid: c}
+	lc := ipld.LinkContext{Ctx: ctx}
+	np, err := chooser(lnk, lc)
+	if err != nil {
+		return err
+	}
+	n, err := lsys.Load(lc, lnk, np)
+	if err != nil {
+		return err
+	}
+	prog := traversal.Progress{Cfg: &traversal.Config{Ctx: ctx, LinkSystem: *lsys, LinkTargetNodePrototypeChooser: chooser}}
+	return prog.WalkAdv(n, sel, func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil })
+}
+
+func linkCid(n datamodel.Node) (cid.Cid, error) {
+	lnk, err := n.AsLink()
+	if err != nil {
+		return cid.Undef, err
+	}
+	cl, ok := lnk.(cidlink.Link)
+	if !ok {
+		return cid.Undef, fmt.Errorf("unsupported link %s", lnk)
+	}
+	return cl.Cid, nil
+}
+
+// writeCar writes a CARv1 of blocks, read from lsys, with root as its root.
+func writeCar(ctx context.Context, w io.Writer, lsys *ipld.LinkSystem, root cid.Cid, blocks []cid.Cid) error {
+	header, err := qp.BuildMap(basicnode.Prototype.Map, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "roots", qp.List(1, func(la datamodel.ListAssembler) {
+			qp.ListEntry(la, qp.Link(cidlink.Link{Cid: root}))
+		}))
+		qp.MapEntry(ma, "version", qp.Int(1))
+	})
+	if err != nil {
+		return err
+	}
+	var hb strings.Builder
+	if err := dagcbor.Encode(header, &hb); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(varint.ToUvarint(uint64(hb.Len()))); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString(hb.String()); err != nil {
+		return err
+	}
+	for _, c := range blocks {
+		blk, err := lsys.LoadRaw(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+		if err != nil {
+			return err
+		}
+		cb := c.Bytes()
+		if _, err := bw.Write(varint.ToUvarint(uint64(len(cb) + len(blk)))); err != nil {
+			return err
+		}
+		if _, err := bw.Write(cb); err != nil {
+			return err
+		}
+		if _, err := bw.Write(blk); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
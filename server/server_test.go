@@ -0,0 +1,247 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipfs-shipyard/w3rc"
+	"github.com/ipfs-shipyard/w3rc/contentrouting/static"
+	"github.com/ipfs-shipyard/w3rc/server"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	"github.com/ipfs/go-unixfsnode/hamt"
+	"github.com/ipld/go-car/v2"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+// syncStore guards a memstore, as requests are served concurrently.
+type syncStore struct {
+	lk  sync.Mutex
+	bag memstore.Store
+}
+
+func (s *syncStore) Has(ctx context.Context, key string) (bool, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.bag.Has(ctx, key)
+}
+
+func (s *syncStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.bag.Get(ctx, key)
+}
+
+func (s *syncStore) Put(ctx context.Context, key string, content []byte) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.bag.Put(ctx, key, content)
+}
+
+func newLinkSystem(store *syncStore) ipld.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(store)
+	lsys.SetWriteStorage(store)
+	return lsys
+}
+
+func addEntry(t *testing.T, lsys *ipld.LinkSystem, name string, content []byte) dagpb.PBLink {
+	lnk, size, err := builder.BuildUnixFSFile(bytes.NewReader(content), "size-256", lsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := builder.BuildUnixFSDirectoryEntry(name, int64(size), lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+func addDir(t *testing.T, lsys *ipld.LinkSystem, name string, entries []dagpb.PBLink, sharded bool) dagpb.PBLink {
+	build := builder.BuildUnixFSDirectory
+	if sharded {
+		build = func(entries []dagpb.PBLink, lsys *ipld.LinkSystem) (ipld.Link, uint64, error) {
+			return builder.BuildUnixFSShardedDirectory(16, hamt.HashMurmur3, entries, lsys)
+		}
+	}
+	lnk, size, err := build(entries, lsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := builder.BuildUnixFSDirectoryEntry(name, int64(size), lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+// sourceGateway serves the blocks of store as a trustless gateway would.
+func sourceGateway(t *testing.T, lsys ipld.LinkSystem) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := cid.Decode(strings.TrimPrefix(r.URL.Path, "/ipfs/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("format") == "raw" {
+			blk, err := lsys.LoadRaw(ipld.LinkContext{Ctx: r.Context()}, cidlink.Link{Cid: c})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", server.RawType)
+			_, _ = w.Write(blk)
+			return
+		}
+		w.Header().Set("Content-Type", server.CarType)
+		_, _ = car.TraverseV1(r.Context(), &lsys, c, selectorparse.CommonSelector_ExploreAllRecursively, w,
+			car.WithTraversalPrototypeChooser(dagpb.AddSupportToChooser(basicnode.Chooser)))
+	}))
+	t.Cleanup(srv.Close)
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("/ip4/%s/tcp/%s/http", host, port)
+}
+
+func get(t *testing.T, url string, header http.Header) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestHandler(t *testing.T) {
+	content := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	var files []dagpb.PBLink
+	for i := 0; i < 50; i++ {
+		files = append(files, addEntry(t, &srcLsys, fmt.Sprintf("%d.txt", i), []byte(fmt.Sprintf("file %d", i))))
+	}
+	rootLnk, _, err := builder.BuildUnixFSDirectory([]dagpb.PBLink{
+		addEntry(t, &srcLsys, "file.txt", content),
+		addDir(t, &srcLsys, "site", []dagpb.PBLink{addEntry(t, &srcLsys, "index.html", []byte("<p>hello</p>"))}, false),
+		addDir(t, &srcLsys, "sub", files, true),
+	}, &srcLsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := rootLnk.(cidlink.Link).Cid
+
+	router, err := static.New(static.Config{Routes: []static.Route{{
+		Match:     static.Wildcard,
+		Providers: []static.Provider{{Addrs: []string{sourceGateway(t, srcLsys)}, Transport: "transport-ipfs-gateway-http"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := &syncStore{}
+	lsys := newLinkSystem(dest)
+	sess, err := w3rc.NewSession(lsys, w3rc.WithRouter(router))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	srv := httptest.NewServer(server.NewHandler(sess, lsys))
+	defer srv.Close()
+	base := srv.URL + "/ipfs/" + root.String()
+
+	resp, body := get(t, base+"/file.txt", nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("unexpected file response %d", resp.StatusCode)
+	}
+	if cc := resp.Header.Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Fatalf("expected the file to be cached as immutable, got %q", cc)
+	}
+	resp, body = get(t, base+"/file.txt", http.Header{"Range": []string{"bytes=1000-1999"}})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[1000:2000]) {
+		t.Fatalf("unexpected range response %d", resp.StatusCode)
+	}
+
+	resp, body = get(t, base+"?format=raw", nil)
+	want, err := srcLsys.LoadRaw(ipld.LinkContext{}, rootLnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != server.RawType || !bytes.Equal(body, want) {
+		t.Fatalf("unexpected raw response %d", resp.StatusCode)
+	}
+
+	// the entity of a sharded directory is its shards, without the files in it.
+	resp, body = get(t, base+"/sub?dag-scope=entity", http.Header{"Accept": []string{server.CarType}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected car response %d: %s", resp.StatusCode, body)
+	}
+	br, err := car.NewBlockReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(br.Roots) != 1 || !br.Roots[0].Equals(root) {
+		t.Fatalf("unexpected car roots %v", br.Roots)
+	}
+	blocks := 0
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, err := blk.Cid().Prefix().Sum(blk.RawData()); err != nil || !c.Equals(blk.Cid()) {
+			t.Fatalf("block %s does not match its cid", blk.Cid())
+		}
+		blocks++
+	}
+	if blocks < 3 || blocks >= len(files) {
+		t.Fatalf("expected the path and shards only, got %d blocks", blocks)
+	}
+
+	resp, _ = get(t, base+"/missing.txt", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected not found, got %d", resp.StatusCode)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "" {
+		t.Fatalf("expected an error not to be cached, got %q", cc)
+	}
+	resp, _ = get(t, base+"/site?filename=x", nil)
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("expected a redirect to the directory, got %d", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); !strings.HasSuffix(loc, "/site/?filename=x") {
+		t.Fatalf("expected the redirect to keep the query, got %q", loc)
+	}
+	if resp, body := get(t, base+"/site/", nil); resp.StatusCode != http.StatusOK || string(body) != "<p>hello</p>" {
+		t.Fatalf("unexpected index response %d: %s", resp.StatusCode, body)
+	}
+}
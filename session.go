@@ -2,75 +2,428 @@ package w3rc
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"io"
+	"time"
 
 	"github.com/ipfs-shipyard/w3rc/contentrouting"
 	"github.com/ipfs-shipyard/w3rc/exchange"
+	"github.com/ipfs-shipyard/w3rc/exchange/filecoinretrieval"
+	"github.com/ipfs-shipyard/w3rc/namesys"
 	"github.com/ipfs-shipyard/w3rc/planning"
+	"github.com/ipfs-shipyard/w3rc/reputation"
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	ipldselector "github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/multiformats/go-multicodec"
 )
 
+// ErrNoProvider is returned when routing and scheduling are exhausted without
+// any transport succeeding.
+var ErrNoProvider = errors.New("no provider found")
+
 type simpleSession struct {
-	ls        ipld.LinkSystem
-	router    contentrouting.Routing
-	scheduler planning.Scheduler
-	mux       *exchange.ExchangeMux
+	ls       ipld.LinkSystem
+	router   contentrouting.Routing
+	resolver namesys.Resolver
+	// newScheduler plans each fetch, as a scheduler plans one at a time.
+	newScheduler func() planning.Scheduler
+	exchanges    []exchange.Exchange
+	ledger       *filecoinretrieval.Ledger
+	// reputations, if set, is told how each attempt went.
+	reputations *reputation.Store
+	// splitWays is how many providers a dag may be split among at once.
+	splitWays int
+	// closers are released along with the session, such as routers it started.
+	closers []io.Closer
 }
 
 func (s *simpleSession) Get(ctx context.Context, root cid.Cid, selector datamodel.Node) (ipld.Node, error) {
 	getCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	records := s.router.FindProviders(getCtx, root)
-	plan := s.scheduler.Schedule(getCtx, root, selector, records)
-	work := s.mux.Subscribe()
+	if err := s.fetch(getCtx, root, selectorOrDefault(selector), nil); err != nil {
+		return nil, err
+	}
+
+	link := cidlink.Link{Cid: root}
+	return s.ls.Load(ipld.LinkContext{Ctx: getCtx}, link, basicnode.Prototype.Any)
+}
+
+func (s *simpleSession) Resolve(ctx context.Context, path string) (cid.Cid, datamodel.Path, error) {
+	return namesys.ResolvePath(ctx, s.resolver, path)
+}
+
+func (s *simpleSession) GetStream(ctx context.Context, root cid.Cid, selector datamodel.Node) ResultChan {
+	results := make(ResultChan)
+	go s.stream(ctx, root, selectorOrDefault(selector), results)
+	return results
+}
+
+// stream walks the selector over the session link system while transports are
+// running, waiting on exchange progress whenever a block is not yet available.
+func (s *simpleSession) stream(ctx context.Context, root cid.Cid, selector datamodel.Node, results ResultChan) {
+	defer close(results)
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	send := func(r ProgressResult) bool {
+		select {
+		case results <- r:
+			return true
+		case <-streamCtx.Done():
+			return false
+		}
+	}
+
+	sel, err := ipldselector.CompileSelector(selector)
+	if err != nil {
+		send(ProgressResult{Status: ERROR, Error: err})
+		return
+	}
+
+	arrived := make(chan struct{}, 1)
+	fetched := make(chan error, 1)
+	go func() {
+		fetched <- s.fetch(streamCtx, root, selector, func(ev exchange.MuxEvent) {
+			if ev.Event == exchange.ProgressEvent || ev.Event == exchange.SuccessEvent {
+				select {
+				case arrived <- struct{}{}:
+				default:
+				}
+			}
+		})
+	}()
+
+	fetchDone := false
+	var fetchErr error
+	lsys := withUnixFS(s.ls)
+	lsys.StorageReadOpener = func(lc linking.LinkContext, l datamodel.Link) (io.Reader, error) {
+		for {
+			r, err := s.ls.StorageReadOpener(lc, l)
+			if err == nil || fetchDone {
+				if err != nil && fetchErr != nil {
+					return nil, fetchErr
+				}
+				return r, err
+			}
+			select {
+			case <-arrived:
+			case fetchErr = <-fetched:
+				fetchDone = true
+			case <-lc.Ctx.Done():
+				return nil, lc.Ctx.Err()
+			}
+		}
+	}
+
+	prog := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            streamCtx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: unixfsChooser,
+		},
+	}
+	rootLink := cidlink.Link{Cid: root}
+	var rootNode ipld.Node
+	lc := ipld.LinkContext{Ctx: streamCtx}
+	np, err := unixfsChooser(rootLink, lc)
+	if err == nil {
+		rootNode, err = lsys.Load(lc, rootLink, np)
+	}
+	if err != nil {
+		send(ProgressResult{Status: ERROR, Error: err})
+		return
+	}
+	prog.LastBlock.Link = rootLink
+	err = prog.WalkAdv(rootNode, sel, func(p traversal.Progress, n ipld.Node, _ traversal.VisitReason) error {
+		if !send(ProgressResult{Status: INPROGRESS, Path: p.Path, Node: n}) {
+			return streamCtx.Err()
+		}
+		return nil
+	})
+	if err != nil {
+		send(ProgressResult{Status: ERROR, Error: err})
+		return
+	}
+	send(ProgressResult{Status: COMPLETE})
+}
+
+// fetch drives routing, scheduling and transports for root+selector until the
+// full selector can be traversed locally, or until the scheduler has no further
+// options and every begun transport has finished.
+// Blocks already in the link system are not requested again: transports are
+// started only for the missing subtrees of the dag where the selector allows it.
+// Providers are found for the session root in ctx where there is one, so that
+// the parts of a dag fetched one after another share a routing lookup.
+// onEvent, if set, observes every exchange event.
+func (s *simpleSession) fetch(ctx context.Context, root cid.Cid, selector datamodel.Node, onEvent func(exchange.MuxEvent)) error {
+	routeBy := root
+	if sr, ok := exchange.SessionRoot(ctx); !ok {
+		ctx = exchange.WithSessionRoot(ctx, cidlink.Link{Cid: root})
+	} else if cl, ok := sr.(cidlink.Link); ok {
+		routeBy = cl.Cid
+	}
+	frontier, err := missingLinks(ctx, s.ls, root, selector)
+	if err != nil {
+		return err
+	}
+	if len(frontier) == 0 {
+		return nil
+	}
 
-	workDone := false
-	for !workDone {
+	// only records for transports the session can use are of interest.
+	records := s.router.FindProviders(ctx, routeBy, contentrouting.WithProtocols(s.protocols()...))
+	scheduler := s.newScheduler()
+	plan := scheduler.Schedule(ctx, root, selector, records)
+	mux := s.newMux()
+	work := mux.Subscribe()
+
+	pending := make(map[*planning.TransportRequest]*attempt)
+	// lastErr is the reason the most recent "successful" transport was not enough.
+	var lastErr error
+	exhausted := func() error {
+		if lastErr != nil {
+			return lastErr
+		}
+		return ErrNoProvider
+	}
+	// when splitting, attempts with no part of the dag left to fetch wait idle
+	// until another releases its part.
+	parts := newPartition(s.splitWays)
+	var idle []*attempt
+	start := func(a *attempt) error {
+		reqs := narrow(a.request, frontier)
+		if parts != nil {
+			if reqs = parts.assign(a, frontier); len(reqs) == 0 {
+				idle = append(idle, a)
+				return nil
+			}
+		}
+		for _, tr := range reqs {
+			if err := mux.Add(ctx, tr); err != nil {
+				return err
+			}
+			pending[tr] = a
+			a.outstanding++
+		}
+		return nil
+	}
+	// running is the roots of the requests of a still pending.
+	running := func(a *attempt) map[datamodel.Link]bool {
+		roots := make(map[datamodel.Link]bool, a.outstanding)
+		for tr, holder := range pending {
+			if holder == a {
+				roots[tr.Root] = true
+			}
+		}
+		return roots
+	}
+	var wake func()
+	fail := func(a *attempt, err error) {
+		if !a.failed {
+			a.failed = true
+			scheduler.Reconcile(a.request, false)
+			s.record(ctx, a, false, err)
+		}
+		if parts != nil {
+			// the requests of a still running keep their parts until they end.
+			parts.release(a, nil, running(a))
+			wake()
+		}
+	}
+	wake = func() {
+		waiting := idle
+		idle = nil
+		for _, a := range waiting {
+			if a.failed {
+				continue
+			}
+			if err := start(a); err != nil {
+				fail(a, err)
+			}
+		}
+	}
+	for {
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
 		case nextPlan, more := <-plan:
 			if !more {
-				return nil, fmt.Errorf("no provider found")
+				if len(pending) == 0 {
+					return exhausted()
+				}
+				plan = nil
+				continue
 			}
 			if nextPlan.Error != nil {
 				log.Warnf("planning error: %s\n", nextPlan.Error)
 				continue
 			}
 			for _, tr := range nextPlan.TransportRequests {
-				s.scheduler.Begin(tr)
-				if err := s.mux.Add(getCtx, tr); err != nil {
-					s.scheduler.Reconcile(tr, false)
+				scheduler.Begin(tr)
+				a := &attempt{request: tr, started: time.Now(), received: make(map[*planning.TransportRequest]uint64)}
+				if err := start(a); err != nil {
+					fail(a, err)
 					log.Warnf("could not honor transport req: %s\n", err)
 					continue
 				}
 			}
-		case transportEvent, more := <-work:
-			if transportEvent.Event == exchange.ErrorEvent {
+		case transportEvent := <-work:
+			if onEvent != nil {
+				onEvent(transportEvent)
+			}
+			a, ok := pending[transportEvent.Source]
+			if !ok {
+				continue
+			}
+			switch transportEvent.Event {
+			case exchange.ProgressEvent:
+				a.progress(transportEvent.Source, transportEvent.State)
+				if tracker, ok := scheduler.(planning.ProgressTracker); ok {
+					tracker.Progress(a.request)
+				}
+				continue
+			case exchange.ErrorEvent:
 				log.Warnf("error in transport: %s\n", transportEvent.State)
 				continue
+			case exchange.FailureEvent:
+				log.Warnf("transport failed: %s\n", transportEvent.State)
+				delete(pending, transportEvent.Source)
+				a.outstanding--
+				// fail over from whatever has been stored so far.
+				if missing, err := missingLinks(ctx, s.ls, root, selector); err == nil {
+					frontier = missing
+				}
+				err, _ := transportEvent.State.(error)
+				fail(a, err)
+			case exchange.SuccessEvent:
+				delete(pending, transportEvent.Source)
+				a.outstanding--
+				if a.outstanding > 0 {
+					continue
+				}
+				missing, err := missingLinks(ctx, s.ls, root, selector)
+				if err != nil {
+					return err
+				}
+				if len(missing) == 0 {
+					if !a.failed {
+						scheduler.Reconcile(a.request, true)
+						s.record(ctx, a, true, nil)
+					}
+					// the requests raced against this one are no longer needed.
+					for tr := range pending {
+						mux.Cancel(tr)
+					}
+					return nil
+				}
+				// a transport may end successfully with only part of the dag. While it
+				// makes progress it is asked for the rest, otherwise other providers
+				// are given the chance to finish it.
+				lastErr = &ErrIncompleteDAG{Root: root, Missing: missing}
+				progressed := !sameFrontier(frontier, missing)
+				if parts != nil {
+					// others progress too, so only the parts a fetched tell of it.
+					progressed = parts.release(a, missing, nil)
+				}
+				frontier = missing
+				if !a.failed && progressed {
+					if err := start(a); err == nil {
+						if parts != nil {
+							wake()
+						}
+						continue
+					}
+				}
+				log.Warnf("transport succeeded without full dag: %s\n", lastErr)
+				fail(a, lastErr)
+			default:
+				continue
 			}
-			if transportEvent.State == exchange.FailureEvent {
-				s.scheduler.Reconcile(transportEvent.Source, false)
-			} else if transportEvent.State == exchange.SuccessEvent {
-				s.scheduler.Reconcile(transportEvent.Source, true)
+			if plan == nil && len(pending) == 0 {
+				return exhausted()
 			}
+		}
+	}
+}
 
-			if !more {
-				// if we have everything, things are good.
-				link := cidlink.Link{Cid: root}
-				// TODO: this isn't enough to know that we've actually loaded the full selector, just that
-				// the mux has ended without an error. we need to know we can load the full requested selector
-				// to conclude that work is done.
-				return s.ls.Load(ipld.LinkContext{Ctx: getCtx}, link, basicnode.Prototype.Any)
-			}
+// progress notes data arriving for tr, one of the requests of a, in an event
+// of state.
+func (a *attempt) progress(tr *planning.TransportRequest, state exchange.State) {
+	switch st := state.(type) {
+	case interface{ Received() uint64 }:
+		if st.Received() == 0 {
+			return
 		}
+		a.received[tr] = st.Received()
+	case ipld.Link:
+	default:
+		return
+	}
+	if a.firstByte.IsZero() {
+		a.firstByte = time.Now()
+	}
+}
+
+// record adds how a went to the reputation of its provider.
+func (s *simpleSession) record(ctx context.Context, a *attempt, success bool, err error) {
+	if s.reputations == nil {
+		return
+	}
+	o := reputation.Outcome{Success: success, Duration: time.Since(a.started), Err: err}
+	if !a.firstByte.IsZero() {
+		o.TimeToFirstByte = a.firstByte.Sub(a.started)
+	}
+	for _, n := range a.received {
+		o.Bytes += n
+	}
+	if err := s.reputations.Record(ctx, a.request.RoutingProvider, o); err != nil {
+		log.Debugf("could not record reputation: %s", err)
+	}
+}
+
+func (s *simpleSession) newMux() *exchange.ExchangeMux {
+	mux := exchange.DefaultMux()
+	for _, ex := range s.exchanges {
+		_ = mux.Register(ex)
+	}
+	return mux
+}
+
+func (s *simpleSession) protocols() []multicodec.Code {
+	codes := make([]multicodec.Code, 0, len(s.exchanges))
+	for _, ex := range s.exchanges {
+		codes = append(codes, ex.Code())
+	}
+	return codes
+}
+
+func selectorOrDefault(selector datamodel.Node) datamodel.Node {
+	if selector == nil {
+		return selectorparse.CommonSelector_MatchPoint
 	}
-	return nil, nil
+	return selector
+}
+
+func (s *simpleSession) Spend() filecoinretrieval.SpendReport {
+	return s.ledger.Report()
 }
 
 func (s *simpleSession) Close() error {
-	return nil
+	for _, ex := range s.exchanges {
+		ex.Close()
+	}
+	var err error
+	for _, c := range s.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
@@ -0,0 +1,509 @@
+package w3rc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
+	"github.com/ipfs-shipyard/w3rc/exchange"
+	"github.com/ipfs-shipyard/w3rc/exchange/filecoinretrieval"
+	"github.com/ipfs-shipyard/w3rc/namesys"
+	"github.com/ipfs-shipyard/w3rc/planning"
+	"github.com/ipfs-shipyard/w3rc/reputation"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/multiformats/go-multicodec"
+)
+
+var linkProto = cidlink.LinkPrototype{Prefix: cid.Prefix{
+	Version:  1,
+	Codec:    uint64(multicodec.DagCbor),
+	MhType:   uint64(multicodec.Sha2_256),
+	MhLength: -1,
+}}
+
+// buildDag stores a root with a list of leaves linking to it, returning the
+// root and leaf cids.
+func buildDag(t *testing.T, lsys *ipld.LinkSystem, leaves int) (cid.Cid, []cid.Cid) {
+	links := make([]datamodel.Link, 0, leaves)
+	leafCids := make([]cid.Cid, 0, leaves)
+	for i := 0; i < leaves; i++ {
+		lnk, err := lsys.Store(ipld.LinkContext{}, linkProto, basicnode.NewInt(int64(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		links = append(links, lnk)
+		leafCids = append(leafCids, lnk.(cidlink.Link).Cid)
+	}
+	root, err := qp.BuildList(basicnode.Prototype.Any, int64(leaves), func(la datamodel.ListAssembler) {
+		for _, l := range links {
+			qp.ListEntry(la, qp.Link(l))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnk, err := lsys.Store(ipld.LinkContext{}, linkProto, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lnk.(cidlink.Link).Cid, leafCids
+}
+
+// syncStore guards a memstore, as exchanges write from their own goroutines.
+type syncStore struct {
+	lk  sync.Mutex
+	bag memstore.Store
+}
+
+func (s *syncStore) Has(ctx context.Context, key string) (bool, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.bag.Has(ctx, key)
+}
+
+func (s *syncStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.bag.Get(ctx, key)
+}
+
+func (s *syncStore) Put(ctx context.Context, key string, content []byte) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.bag.Put(ctx, key, content)
+}
+
+func newLinkSystem(store *syncStore) ipld.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(store)
+	lsys.SetWriteStorage(store)
+	return lsys
+}
+
+type testRecord struct {
+	root     cid.Cid
+	provider string
+}
+
+func (r testRecord) Request() cid.Cid          { return r.root }
+func (r testRecord) Protocol() multicodec.Code { return multicodec.TransportBitswap }
+func (r testRecord) Provider() interface{}     { return r.provider }
+func (r testRecord) Payload() interface{}      { return nil }
+
+type testRouter struct {
+	providers []string
+
+	lk    sync.Mutex
+	finds []cid.Cid
+}
+
+func (tr *testRouter) FindProviders(_ context.Context, c cid.Cid, _ ...contentrouting.RoutingOptions) <-chan contentrouting.RoutingRecord {
+	tr.lk.Lock()
+	tr.finds = append(tr.finds, c)
+	tr.lk.Unlock()
+	ch := make(chan contentrouting.RoutingRecord, len(tr.providers))
+	for _, p := range tr.providers {
+		ch <- testRecord{c, p}
+	}
+	close(ch)
+	return ch
+}
+
+// testExchange copies the blocks a provider holds from a source store into the
+// session store, one progress event per block, regardless of the requested root.
+type testExchange struct {
+	source *syncStore
+	dest   *syncStore
+	// holds restricts providers to a subset of the source blocks.
+	holds map[string][]cid.Cid
+	// fails makes providers report failure after copying what they hold.
+	fails map[string]bool
+	// stalls makes providers send nothing until their request is cancelled.
+	stalls map[string]chan struct{}
+
+	lk       sync.Mutex
+	requests map[string][]ipld.Link
+}
+
+func (te *testExchange) Code() multicodec.Code { return multicodec.TransportBitswap }
+
+func (te *testExchange) RequestData(ctx context.Context, root ipld.Link, _ ipld.Node, provider interface{}, _ interface{}) <-chan exchange.EventData {
+	p := provider.(string)
+	te.lk.Lock()
+	if te.requests == nil {
+		te.requests = make(map[string][]ipld.Link)
+	}
+	te.requests[p] = append(te.requests[p], root)
+	te.lk.Unlock()
+
+	evs := make(chan exchange.EventData)
+	go func() {
+		defer close(evs)
+		evs <- exchange.EventData{Event: exchange.StartEvent}
+		if stalled, ok := te.stalls[p]; ok {
+			<-ctx.Done()
+			close(stalled)
+			evs <- exchange.EventData{Event: exchange.FailureEvent, State: ctx.Err()}
+			return
+		}
+		var received uint64
+		for k, v := range te.source.bag.Bag {
+			if held, ok := te.holds[p]; ok && !containsKey(held, k) {
+				continue
+			}
+			if err := te.dest.Put(ctx, k, v); err != nil {
+				evs <- exchange.EventData{Event: exchange.FailureEvent, State: err}
+				return
+			}
+			c, _ := cid.Cast([]byte(k))
+			received += uint64(len(v))
+			evs <- exchange.EventData{Event: exchange.ProgressEvent, State: exchange.Progress{Link: cidlink.Link{Cid: c}, Bytes: received}}
+		}
+		if te.fails[p] {
+			evs <- exchange.EventData{Event: exchange.FailureEvent, State: errors.New("provider went away")}
+			return
+		}
+		evs <- exchange.EventData{Event: exchange.SuccessEvent, State: root}
+	}()
+	return evs
+}
+
+func (te *testExchange) requested(provider string) []ipld.Link {
+	te.lk.Lock()
+	defer te.lk.Unlock()
+	return te.requests[provider]
+}
+
+func containsKey(cids []cid.Cid, key string) bool {
+	for _, c := range cids {
+		if string(c.Bytes()) == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (te *testExchange) Close() {}
+
+func newTestSession(store *syncStore, router contentrouting.Routing, exchanges ...exchange.Exchange) *simpleSession {
+	return &simpleSession{
+		ls:           newLinkSystem(store),
+		router:       router,
+		newScheduler: func() planning.Scheduler { return planning.NewSimpleScheduler() },
+		exchanges:    exchanges,
+		ledger:       filecoinretrieval.NewLedger(abi.TokenAmount{}, abi.TokenAmount{}),
+	}
+}
+
+func TestGetStream(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, _ := buildDag(t, &srcLsys, 5)
+
+	dest := &syncStore{}
+	sess := newTestSession(dest, &testRouter{providers: []string{"a"}}, &testExchange{source: source, dest: dest})
+
+	results := sess.GetStream(context.Background(), root, selectorparse.CommonSelector_MatchAllRecursively)
+	var progress []ProgressResult
+	var last ProgressResult
+	for r := range results {
+		if r.Status == INPROGRESS {
+			progress = append(progress, r)
+		}
+		last = r
+	}
+	if last.Status != COMPLETE {
+		t.Fatalf("expected stream to complete, got status %d (%v)", last.Status, last.Error)
+	}
+	// the root list and its 5 leaves.
+	if len(progress) != 6 {
+		t.Fatalf("expected 6 progress results, got %d", len(progress))
+	}
+	if progress[5].Path.String() != "4" {
+		t.Fatalf("unexpected path for last leaf: %q", progress[5].Path.String())
+	}
+	if v, err := progress[5].Node.AsInt(); err != nil || v != 4 {
+		t.Fatalf("unexpected node for last leaf: %v", progress[5].Node)
+	}
+}
+
+func TestGetStreamNoProvider(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, _ := buildDag(t, &srcLsys, 1)
+
+	dest := &syncStore{}
+	sess := newTestSession(dest, &testRouter{}, &testExchange{source: source, dest: dest})
+
+	var last ProgressResult
+	for r := range sess.GetStream(context.Background(), root, nil) {
+		last = r
+	}
+	if last.Status != ERROR || last.Error == nil {
+		t.Fatalf("expected stream to end with an error, got status %d", last.Status)
+	}
+}
+
+func TestGetIncompleteDAG(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, _ := buildDag(t, &srcLsys, 3)
+
+	dest := &syncStore{}
+	ex := &testExchange{source: source, dest: dest, holds: map[string][]cid.Cid{"partial": {root}}}
+	sess := newTestSession(dest, &testRouter{providers: []string{"partial"}}, ex)
+
+	_, err := sess.Get(context.Background(), root, selectorparse.CommonSelector_ExploreAllRecursively)
+	var incomplete *ErrIncompleteDAG
+	if !errors.As(err, &incomplete) {
+		t.Fatalf("expected incomplete dag error, got %v", err)
+	}
+	if len(incomplete.Missing) != 3 {
+		t.Fatalf("expected 3 missing links, got %d", len(incomplete.Missing))
+	}
+	if incomplete.Missing[0].Path.String() != "0" {
+		t.Fatalf("unexpected path of first missing link: %q", incomplete.Missing[0].Path.String())
+	}
+}
+
+func TestGetContinuesAfterPartialSuccess(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, _ := buildDag(t, &srcLsys, 3)
+
+	dest := &syncStore{}
+	ex := &testExchange{source: source, dest: dest, holds: map[string][]cid.Cid{"partial": {root}}}
+	sess := newTestSession(dest, &testRouter{providers: []string{"partial", "full"}}, ex)
+
+	if _, err := sess.Get(context.Background(), root, selectorparse.CommonSelector_ExploreAllRecursively); err != nil {
+		t.Fatal(err)
+	}
+	if missing, err := missingLinks(context.Background(), sess.ls, root, selectorparse.CommonSelector_ExploreAllRecursively); err != nil || len(missing) != 0 {
+		t.Fatalf("expected full dag locally, missing %d (%v)", len(missing), err)
+	}
+}
+
+func TestGetResumesFromStoredBlocks(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, leaves := buildDag(t, &srcLsys, 4)
+
+	dest := &syncStore{}
+	ex := &testExchange{
+		source: source,
+		dest:   dest,
+		holds:  map[string][]cid.Cid{"flaky": {root, leaves[0], leaves[1]}},
+		fails:  map[string]bool{"flaky": true},
+	}
+	sess := newTestSession(dest, &testRouter{providers: []string{"flaky", "full"}}, ex)
+
+	if _, err := sess.Get(context.Background(), root, selectorparse.CommonSelector_ExploreAllRecursively); err != nil {
+		t.Fatal(err)
+	}
+	got := ex.requested("full")
+	if len(got) != 2 {
+		t.Fatalf("expected 2 subtree requests after failover, got %d", len(got))
+	}
+	for i, l := range got {
+		if l.(cidlink.Link).Cid != leaves[i+2] {
+			t.Fatalf("expected request %d for %s, got %s", i, leaves[i+2], l)
+		}
+	}
+}
+
+func TestGetRecordsReputations(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, leaves := buildDag(t, &srcLsys, 4)
+
+	dest := &syncStore{}
+	ex := &testExchange{
+		source: source,
+		dest:   dest,
+		holds:  map[string][]cid.Cid{"flaky": {root, leaves[0]}},
+		fails:  map[string]bool{"flaky": true},
+	}
+	sess := newTestSession(dest, &testRouter{providers: []string{"flaky", "full"}}, ex)
+	// outcomes decay while the test runs, so counts are rounded.
+	sess.reputations = reputation.New(dssync.MutexWrap(datastore.NewMapDatastore()))
+
+	if _, err := sess.Get(context.Background(), root, selectorparse.CommonSelector_ExploreAllRecursively); err != nil {
+		t.Fatal(err)
+	}
+	flaky, err := sess.reputations.Get(context.Background(), "flaky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Round(flaky.Failures) != 1 || flaky.Successes != 0 || flaky.LastFailure != "provider went away" {
+		t.Fatalf("unexpected reputation of failed provider %+v", flaky)
+	}
+	full, err := sess.reputations.Get(context.Background(), "full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Round(full.Successes) != 1 || full.Failures != 0 || full.TimeToFirstByte <= 0 || full.Throughput <= 0 {
+		t.Fatalf("unexpected reputation of successful provider %+v", full)
+	}
+}
+
+func TestFetchHedgesStalledProvider(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, _ := buildDag(t, &srcLsys, 3)
+
+	dest := &syncStore{}
+	stalled := make(chan struct{})
+	ex := &testExchange{source: source, dest: dest, stalls: map[string]chan struct{}{"stalled": stalled}}
+	sess := newTestSession(dest, &testRouter{providers: []string{"stalled", "full"}}, ex)
+	sess.newScheduler = func() planning.Scheduler {
+		return planning.NewSimpleScheduler(planning.WithHedging(200 * time.Millisecond))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	if err := sess.fetch(ctx, root, selectorparse.CommonSelector_ExploreAllRecursively, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("expected the second provider to wait for the first to stall, took %s", elapsed)
+	}
+	// the stalled request is cancelled on its own, while ctx is still live.
+	select {
+	case <-stalled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the stalled request to be cancelled")
+	}
+}
+
+func TestGetSplitsAcrossProviders(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, leaves := buildDag(t, &srcLsys, 12)
+
+	dest := &syncStore{}
+	providers := []string{"a", "b", "c"}
+	ex := &selectorExchange{source: source, dest: dest, delay: map[string]time.Duration{"a": 150 * time.Millisecond, "b": 150 * time.Millisecond, "c": 150 * time.Millisecond}}
+	sess := newTestSession(dest, &testRouter{providers: providers}, ex)
+	sess.splitWays = 3
+
+	if _, err := sess.Get(context.Background(), root, selectorparse.CommonSelector_ExploreAllRecursively); err != nil {
+		t.Fatal(err)
+	}
+	// the root is fetched once, then each leaf by a single provider.
+	requests := make(map[cid.Cid]int)
+	splitAmong := 0
+	for _, p := range providers {
+		got := ex.requested(p)
+		for _, l := range got {
+			requests[l.(cidlink.Link).Cid]++
+		}
+		if len(got) > 0 && got[len(got)-1].(cidlink.Link).Cid != root {
+			splitAmong++
+		}
+	}
+	for _, c := range append([]cid.Cid{root}, leaves...) {
+		if requests[c] != 1 {
+			t.Fatalf("expected %s to be requested once, got %d", c, requests[c])
+		}
+	}
+	if splitAmong < 2 {
+		t.Fatalf("expected the leaves to be split among providers, got %d", splitAmong)
+	}
+}
+
+func TestGetSplitKeepsRunningParts(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, leaves := buildDag(t, &srcLsys, 12)
+
+	// the flaky provider is slow to send what it does, and fails at once on
+	// every other leaf.
+	var evens []cid.Cid
+	for i := 0; i < len(leaves); i += 2 {
+		evens = append(evens, leaves[i])
+	}
+	dest := &syncStore{}
+	providers := []string{"flaky", "b", "c"}
+	ex := &selectorExchange{
+		source: source,
+		dest:   dest,
+		delay:  map[string]time.Duration{"flaky": 400 * time.Millisecond, "b": 100 * time.Millisecond, "c": 100 * time.Millisecond},
+		fails:  map[string][]cid.Cid{"flaky": evens},
+	}
+	sess := newTestSession(dest, &testRouter{providers: providers}, ex)
+	sess.splitWays = 3
+
+	if _, err := sess.Get(context.Background(), root, selectorparse.CommonSelector_ExploreAllRecursively); err != nil {
+		t.Fatal(err)
+	}
+	// leaves the flaky provider was still fetching are not requested again.
+	requests := make(map[cid.Cid]int)
+	for _, p := range providers {
+		for _, l := range ex.requested(p) {
+			requests[l.(cidlink.Link).Cid]++
+		}
+	}
+	for i, c := range leaves {
+		if i%2 == 1 && requests[c] != 1 {
+			t.Fatalf("expected %s to be requested once, got %d", c, requests[c])
+		}
+	}
+}
+
+func TestGetResolvedPath(t *testing.T) {
+	source := &syncStore{}
+	srcLsys := newLinkSystem(source)
+	root, leaves := buildDag(t, &srcLsys, 3)
+
+	dest := &syncStore{}
+	// the provider holds only the blocks along the path.
+	ex := &testExchange{source: source, dest: dest, holds: map[string][]cid.Cid{"a": {root, leaves[1]}}}
+	sess := newTestSession(dest, &testRouter{providers: []string{"a"}}, ex)
+	sess.resolver = namesys.Map{"example.com": "/ipfs/" + root.String() + "/1"}
+
+	c, path, err := sess.Resolve(context.Background(), "/ipns/example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != root || path.String() != "1" {
+		t.Fatalf("unexpected resolution %s/%s", c, path)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results := sess.GetStream(ctx, c, PathSelector(path, nil))
+	// the stream is released before the test ends.
+	defer func() {
+		cancel()
+		for range results {
+		}
+	}()
+	var last ProgressResult
+	for r := range results {
+		if r.Status != INPROGRESS {
+			break
+		}
+		last = r
+	}
+	if last.Path.String() != "1" {
+		t.Fatalf("expected the path to be reached, got %q", last.Path.String())
+	}
+	if v, err := last.Node.AsInt(); err != nil || v != 1 {
+		t.Fatalf("unexpected node at path: %v", last.Node)
+	}
+}
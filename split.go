@@ -0,0 +1,92 @@
+package w3rc
+
+import (
+	"github.com/ipfs-shipyard/w3rc/planning"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+// a partition shares out the missing subtrees of a dag among attempts, so that
+// each provider fetches a disjoint part of it.
+type partition struct {
+	// ways is how many providers the dag is split among.
+	ways int
+	// claims holds the attempt fetching each subtree.
+	claims map[datamodel.Link]*attempt
+}
+
+// newPartition splits dags among up to ways providers, or is nil where there
+// is nothing to split.
+func newPartition(ways int) *partition {
+	if ways < 2 {
+		return nil
+	}
+	return &partition{ways: ways, claims: make(map[datamodel.Link]*attempt)}
+}
+
+// assign derives the requests for the next part of the missing frontier a is
+// to fetch. Each attempt takes an even share of the frontier at a time, so
+// that attempts begun later find parts left to fetch. It is empty when other
+// attempts are fetching all that is missing.
+func (p *partition) assign(a *attempt, frontier []MissingLink) []*planning.TransportRequest {
+	tr := a.request
+	if _, ok := subtreeSelector(tr.Selector); !ok || len(frontier) == 0 {
+		// without subtrees to select, attempts fetch the dag as they would
+		// unsplit.
+		return narrow(tr, frontier)
+	}
+	if frontier[0].Path.Len() == 0 {
+		// the top of the dag is fetched on its own, to split what is under it.
+		if _, ok := p.claims[tr.Root]; ok {
+			return nil
+		}
+		p.claims[tr.Root] = a
+		return []*planning.TransportRequest{{
+			Codec:           tr.Codec,
+			Root:            tr.Root,
+			Selector:        selectorparse.CommonSelector_MatchPoint,
+			RoutingProvider: tr.RoutingProvider,
+			RoutingPayload:  tr.RoutingPayload,
+		}}
+	}
+
+	share := (len(frontier) + p.ways - 1) / p.ways
+	if share > maxResumeRequests {
+		share = maxResumeRequests
+	}
+	batch := make([]MissingLink, 0, share)
+	for _, m := range frontier {
+		if _, ok := p.claims[m.Link]; ok {
+			continue
+		}
+		p.claims[m.Link] = a
+		batch = append(batch, m)
+		if len(batch) == share {
+			break
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return narrow(tr, batch)
+}
+
+// release frees the subtrees a was fetching to be assigned again, other than
+// those in keep. It is true if any of them are no longer missing.
+func (p *partition) release(a *attempt, missing []MissingLink, keep map[datamodel.Link]bool) bool {
+	still := make(map[datamodel.Link]bool, len(missing))
+	for _, m := range missing {
+		still[m.Link] = true
+	}
+	progressed := false
+	for l, holder := range p.claims {
+		if holder != a || keep[l] {
+			continue
+		}
+		delete(p.claims, l)
+		if !still[l] {
+			progressed = true
+		}
+	}
+	return progressed
+}
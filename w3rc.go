@@ -2,13 +2,18 @@ package w3rc
 
 import (
 	"context"
+	"errors"
+	"io"
 
+	"github.com/ipfs-shipyard/w3rc/contentrouting"
 	"github.com/ipfs-shipyard/w3rc/contentrouting/delegated"
-	"github.com/ipfs-shipyard/w3rc/exchange"
+	"github.com/ipfs-shipyard/w3rc/contentrouting/dht"
 	"github.com/ipfs-shipyard/w3rc/exchange/bitswap"
 	"github.com/ipfs-shipyard/w3rc/exchange/filecoinretrieval"
-	"github.com/ipfs-shipyard/w3rc/planning"
+	"github.com/ipfs-shipyard/w3rc/exchange/gateway"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/datamodel"
@@ -27,25 +32,111 @@ func NewSession(ls ipld.LinkSystem, opts ...Option) (Session, error) {
 	if err := applyDefaults(ls, &conf); err != nil {
 		return nil, err
 	}
-	router, err := delegated.NewDelegatedHTTP(conf.indexerURL)
+	var closers []io.Closer
+	if conf.dht {
+		d, err := dht.New(context.Background(), conf.host)
+		if err != nil {
+			return nil, err
+		}
+		conf.routers = append(conf.routers, d)
+		closers = append(closers, d)
+	}
+	router, err := cachedRouter(&conf)
 	if err != nil {
+		// routers started for the session are not left running without it.
+		for _, c := range closers {
+			_ = c.Close()
+		}
 		return nil, err
 	}
 
 	session := simpleSession{
-		ls:        ls,
-		router:    router,
-		mux:       exchange.DefaultMux(),
-		scheduler: planning.NewSimpleScheduler(),
+		ls:           ls,
+		router:       router,
+		resolver:     conf.resolver,
+		newScheduler: conf.newScheduler,
+		reputations:  conf.reputations,
+		splitWays:    conf.splitWays,
+		ledger:       filecoinretrieval.NewLedger(conf.maxSpend, conf.maxSpendPerRetrieval),
+		closers:      closers,
 	}
 
 	dt := conf.dt
-	session.mux.Register(filecoinretrieval.NewFilecoinExchange(nil, conf.host, dt))
-	session.mux.Register(bitswap.NewBitswaExchange(conf.host, &ls))
+	if fex := filecoinretrieval.NewFilecoinExchange(conf.paymentAPI, conf.host, dt, filecoinretrieval.WithLedger(session.ledger)); fex != nil {
+		session.exchanges = append(session.exchanges, fex)
+	}
+	session.exchanges = append(session.exchanges, bitswap.NewBitswaExchange(conf.host, &ls))
+	session.exchanges = append(session.exchanges, gateway.NewGatewayExchange(nil, &ls))
 
 	return &session, nil
 }
 
+// NewRouter creates the content routing a session opened with the same
+// options would use, to find providers without retrieving anything. The DHT
+// is joined on the host of a session, so WithDHT is not supported here.
+func NewRouter(opts ...Option) (contentrouting.Routing, error) {
+	conf := config{}
+	if err := apply(&conf, opts...); err != nil {
+		return nil, err
+	}
+	if conf.dht {
+		return nil, errors.New("the dht is only available within a session")
+	}
+	if conf.ds == nil {
+		conf.ds = dssync.MutexWrap(datastore.NewMapDatastore())
+	}
+	return cachedRouter(&conf)
+}
+
+// cachedRouter is newRouter behind the routing cache, where one is configured.
+func cachedRouter(conf *config) (contentrouting.Routing, error) {
+	router, err := newRouter(conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.cacheRouting {
+		cacheOpts := conf.routingCache
+		if conf.persistRoutingCache {
+			cacheOpts = append(cacheOpts, contentrouting.WithCacheDatastore(conf.ds))
+		}
+		router = contentrouting.NewCache(router, cacheOpts...)
+	}
+	return router, nil
+}
+
+// newRouter combines the configured indexers and routers. When nothing else
+// is configured, the indexer URL is used as is.
+func newRouter(conf *config) (contentrouting.Routing, error) {
+	urls := conf.indexerURLs
+	if conf.indexerURL != "" || (len(urls) == 0 && len(conf.routingV1URLs) == 0 && len(conf.routers) == 0) {
+		urls = append([]string{conf.indexerURL}, urls...)
+	}
+	var opts []delegated.Option
+	if conf.readerPrivacy {
+		opts = append(opts, delegated.WithReaderPrivacy())
+	}
+	routers := make([]contentrouting.Routing, 0, len(urls)+len(conf.routingV1URLs)+len(conf.routers))
+	for _, url := range urls {
+		r, err := delegated.NewDelegatedHTTP(url, opts...)
+		if err != nil {
+			return nil, err
+		}
+		routers = append(routers, r)
+	}
+	for _, url := range conf.routingV1URLs {
+		r, err := delegated.NewRoutingV1(url)
+		if err != nil {
+			return nil, err
+		}
+		routers = append(routers, r)
+	}
+	routers = append(routers, conf.routers...)
+	if len(routers) == 1 {
+		return routers[0], nil
+	}
+	return contentrouting.NewComposite(routers...), nil
+}
+
 // ResultChan provides progress updates from a call to `GetStream`
 type ResultChan chan ProgressResult
 
@@ -78,7 +169,35 @@ type Session interface {
 	// `CommonSelector_MatchAllRecursively` should be provided.
 	Get(ctx context.Context, root cid.Cid, selector datamodel.Node) (ipld.Node, error)
 
-	// TODO: GetStream is not yet implemented - should follow logic of get but with incremental responses.
-	//GetStream(ctx context.Context, root cid.Cid, selector datamodel.Node) ResultChan
+	// GetStream follows the logic of Get, but reports each node of the dag as it becomes
+	// available. An INPROGRESS result is sent for every node visited by the selector,
+	// followed by a single COMPLETE or ERROR result before the channel is closed.
+	// The channel must be drained, or ctx canceled, to release the session's resources.
+	GetStream(ctx context.Context, root cid.Cid, selector datamodel.Node) ResultChan
+
+	// GetPath returns the node at path under root, following UnixFS directory
+	// entries, including those of HAMT-sharded directories, or else fields of
+	// the data model, which may lead within a block as well as through links.
+	// Only the blocks along the path are fetched, then scope decides how much
+	// of the dag is fetched under the block where the path ends.
+	// The returned node is interpreted as UnixFS where it is so.
+	GetPath(ctx context.Context, root cid.Cid, path string, scope Scope) (ipld.Node, error)
+
+	// GetRange returns a reader over the UnixFS file at path under root, having
+	// fetched only the blocks along the path and those holding the bytes from
+	// start up to end. An end of -1 is the end of the file. The reader is at
+	// start; reading or seeking elsewhere in the file fetches the blocks needed
+	// as they are read, under ctx.
+	GetRange(ctx context.Context, root cid.Cid, path string, start, end int64) (io.ReadSeeker, error)
+
+	// Resolve turns a content path, such as /ipns/example.com/index.html, into
+	// the cid of its root and the path remaining under it. Names are followed
+	// until an immutable /ipfs/ path is reached. A bare cid resolves to itself.
+	Resolve(ctx context.Context, path string) (cid.Cid, datamodel.Path, error)
+
+	// Spend reports the payments made for retrievals during the session,
+	// in total, per provider, and per retrieved root.
+	Spend() filecoinretrieval.SpendReport
+
 	Close() error
 }